@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Formats of logs. Logs are stored with ANSI escape codes
+const (
+	LogFormatPlain = "plain" // Escape codes are removed
+	LogFormatANSI  = "ansi"  // As is
+	LogFormatHTML  = "html"  // Colors are converted to HTML, text is escaped
+)
+
+// IsLogFormat returns true if the format is known
+func IsLogFormat(format string) bool {
+	return format == LogFormatPlain || format == LogFormatANSI || format == LogFormatHTML
+}
+
+// ansiStyle is the current graphic rendition of the text
+type ansiStyle struct {
+	fg        string // Class suffix for the basic 16 colors or #rrggbb
+	bg        string
+	bold      bool
+	faint     bool
+	italic    bool
+	underline bool
+}
+
+// openTag returns <span> with the style or empty string for the default style.
+// Only classes and hex colors which are generated here get into the tag
+func (s *ansiStyle) openTag() string {
+	var classes []string
+	var styles []string
+	if strings.HasPrefix(s.fg, "#") {
+		styles = append(styles, "color:"+s.fg)
+	} else if s.fg != "" {
+		classes = append(classes, "ansi-fg-"+s.fg)
+	}
+	if strings.HasPrefix(s.bg, "#") {
+		styles = append(styles, "background-color:"+s.bg)
+	} else if s.bg != "" {
+		classes = append(classes, "ansi-bg-"+s.bg)
+	}
+	if s.bold {
+		classes = append(classes, "ansi-bold")
+	}
+	if s.faint {
+		classes = append(classes, "ansi-faint")
+	}
+	if s.italic {
+		classes = append(classes, "ansi-italic")
+	}
+	if s.underline {
+		classes = append(classes, "ansi-underline")
+	}
+	if len(classes) == 0 && len(styles) == 0 {
+		return ""
+	}
+	tag := "<span"
+	if len(classes) > 0 {
+		tag += ` class="` + strings.Join(classes, " ") + `"`
+	}
+	if len(styles) > 0 {
+		tag += ` style="` + strings.Join(styles, ";") + `"`
+	}
+	return tag + ">"
+}
+
+// apply changes the style according to parameters of SGR sequence
+func (s *ansiStyle) apply(params []int) {
+	if len(params) == 0 {
+		params = []int{0}
+	}
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		switch {
+		case p == 0:
+			*s = ansiStyle{}
+		case p == 1:
+			s.bold = true
+		case p == 2:
+			s.faint = true
+		case p == 3:
+			s.italic = true
+		case p == 4:
+			s.underline = true
+		case p == 22:
+			s.bold = false
+			s.faint = false
+		case p == 23:
+			s.italic = false
+		case p == 24:
+			s.underline = false
+		case p >= 30 && p <= 37:
+			s.fg = strconv.Itoa(p - 30)
+		case p >= 90 && p <= 97:
+			s.fg = strconv.Itoa(p - 90 + 8)
+		case p == 39:
+			s.fg = ""
+		case p >= 40 && p <= 47:
+			s.bg = strconv.Itoa(p - 40)
+		case p >= 100 && p <= 107:
+			s.bg = strconv.Itoa(p - 100 + 8)
+		case p == 49:
+			s.bg = ""
+		case p == 38 || p == 48:
+			color, n := extendedColor(params[i+1:])
+			i += n
+			if p == 38 {
+				s.fg = color
+			} else {
+				s.bg = color
+			}
+		}
+	}
+}
+
+// extendedColor parses 5;n (256 colors) and 2;r;g;b (true color) parameters.
+// Returns the color and the number of used parameters
+func extendedColor(params []int) (string, int) {
+	if len(params) >= 2 && params[0] == 5 {
+		return color256(params[1]), 2
+	}
+	if len(params) >= 4 && params[0] == 2 {
+		return fmt.Sprintf("#%02x%02x%02x", clampByte(params[1]), clampByte(params[2]), clampByte(params[3])), 4
+	}
+	return "", len(params)
+}
+
+// color256 converts a color of the 256 colors palette
+func color256(n int) string {
+	switch {
+	case n < 0 || n > 255:
+		return ""
+	case n < 16:
+		return strconv.Itoa(n)
+	case n < 232:
+		levels := []int{0, 95, 135, 175, 215, 255}
+		n -= 16
+		return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[n/6%6], levels[n%6])
+	default:
+		gray := 8 + (n-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+	}
+}
+
+func clampByte(n int) int {
+	if n < 0 {
+		return 0
+	}
+	if n > 255 {
+		return 255
+	}
+	return n
+}
+
+// parseSGR returns parameters of Select Graphic Rendition sequence, the
+// second value is false for other escape sequences
+func parseSGR(seq string) ([]int, bool) {
+	switch {
+	case strings.HasPrefix(seq, "\u001B["):
+		seq = seq[len("\u001B["):]
+	case strings.HasPrefix(seq, "\u009B"):
+		seq = seq[len("\u009B"):]
+	default:
+		return nil, false
+	}
+	if !strings.HasSuffix(seq, "m") {
+		return nil, false
+	}
+	seq = strings.TrimSuffix(seq, "m")
+	if seq == "" {
+		return nil, true
+	}
+	var params []int
+	for _, item := range strings.Split(seq, ";") {
+		p, err := strconv.Atoi(item)
+		if err != nil {
+			p = 0
+		}
+		params = append(params, p)
+	}
+	return params, true
+}
+
+// ANSIConverter converts text with ANSI escape codes to HTML. The style is
+// kept between calls, so a log can be converted in parts. Spans never cross
+// lines
+type ANSIConverter struct {
+	style ansiStyle
+}
+
+// Convert returns escaped text where colors are replaced with <span> tags.
+// Escape codes other than colors are removed
+func (ac *ANSIConverter) Convert(text string) string {
+	var out strings.Builder
+	writeText := func(s string) {
+		for len(s) > 0 {
+			line := s
+			i := strings.IndexByte(s, '\n')
+			if i >= 0 {
+				line = s[:i]
+			}
+			if line != "" {
+				tag := ac.style.openTag()
+				out.WriteString(tag)
+				out.WriteString(html.EscapeString(line))
+				if tag != "" {
+					out.WriteString("</span>")
+				}
+			}
+			if i < 0 {
+				return
+			}
+			out.WriteByte('\n')
+			s = s[i+1:]
+		}
+	}
+	last := 0
+	for _, loc := range colorEscapeCodesRE.FindAllStringIndex(text, -1) {
+		writeText(text[last:loc[0]])
+		if params, ok := parseSGR(text[loc[0]:loc[1]]); ok {
+			ac.style.apply(params)
+		}
+		last = loc[1]
+	}
+	writeText(text[last:])
+	return out.String()
+}
+
+// FormatLog converts log data with ANSI escape codes to the format
+func FormatLog(data string, format string) string {
+	switch format {
+	case LogFormatANSI:
+		return data
+	case LogFormatHTML:
+		ac := ANSIConverter{}
+		return ac.Convert(data)
+	default:
+		return StripColor(data)
+	}
+}
+
+// logFormatter is a writer which converts complete lines of a log to the
+// format. Close writes the last incomplete line
+type logFormatter struct {
+	w       io.Writer
+	format  string
+	partial []byte
+	ansi    ANSIConverter
+}
+
+// newLogFormatter returns a writer which converts the log to the format
+func newLogFormatter(w io.Writer, format string) *logFormatter {
+	return &logFormatter{w: w, format: format}
+}
+
+func (lf *logFormatter) Write(p []byte) (int, error) {
+	if lf.format == LogFormatANSI {
+		return lf.w.Write(p)
+	}
+	i := bytes.LastIndexByte(p, '\n')
+	if i < 0 {
+		lf.partial = append(lf.partial, p...)
+		return len(p), nil
+	}
+	lines := append(lf.partial, p[:i+1]...)
+	lf.partial = append([]byte{}, p[i+1:]...)
+	_, err := io.WriteString(lf.w, lf.convert(string(lines)))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes the incomplete line, the underlying writer is not closed
+func (lf *logFormatter) Close() error {
+	if len(lf.partial) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(lf.w, lf.convert(string(lf.partial)))
+	lf.partial = nil
+	return err
+}
+
+func (lf *logFormatter) convert(data string) string {
+	if lf.format == LogFormatHTML {
+		return lf.ansi.Convert(data)
+	}
+	return StripColor(data)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestANSIConverter(t *testing.T) {
+	cases := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{
+			name:     "plain text is escaped",
+			text:     "a < b && \"c\"",
+			expected: "a &lt; b &amp;&amp; &#34;c&#34;",
+		},
+		{
+			name:     "basic colors",
+			text:     "\x1b[31mred\x1b[0m \x1b[1;92mbold green\x1b[m",
+			expected: `<span class="ansi-fg-1">red</span> <span class="ansi-fg-10 ansi-bold">bold green</span>`,
+		},
+		{
+			name:     "background and attributes",
+			text:     "\x1b[44;3;4mtext\x1b[23;24;49mplain",
+			expected: `<span class="ansi-bg-4 ansi-italic ansi-underline">text</span>plain`,
+		},
+		{
+			name:     "256 colors",
+			text:     "\x1b[38;5;9ma\x1b[38;5;196mb\x1b[48;5;232mc",
+			expected: `<span class="ansi-fg-9">a</span><span style="color:#ff0000">b</span><span style="color:#ff0000;background-color:#080808">c</span>`,
+		},
+		{
+			name:     "true color is clamped",
+			text:     "\x1b[38;2;300;0;16mtext",
+			expected: `<span style="color:#ff0010">text</span>`,
+		},
+		{
+			name:     "spans don't cross lines",
+			text:     "\x1b[33mline 1\nline 2\n\x1b[39m",
+			expected: "<span class=\"ansi-fg-3\">line 1</span>\n<span class=\"ansi-fg-3\">line 2</span>\n",
+		},
+		{
+			name:     "other escape codes are removed",
+			text:     "\x1b[2Kprogress\x1b[1A",
+			expected: "progress",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ac := ANSIConverter{}
+			got := ac.Convert(c.text)
+			if got != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestANSIConverterKeepsStyle(t *testing.T) {
+	ac := ANSIConverter{}
+	first := ac.Convert("\x1b[32mgreen\n")
+	second := ac.Convert("still green\x1b[0m\n")
+	if first != "<span class=\"ansi-fg-2\">green</span>\n" {
+		t.Errorf("unexpected first part %q", first)
+	}
+	if second != "<span class=\"ansi-fg-2\">still green</span>\n" {
+		t.Errorf("unexpected second part %q", second)
+	}
+}
+
+func TestFormatLog(t *testing.T) {
+	data := "\x1b[31m<red>\x1b[0m\n"
+	cases := []struct {
+		format   string
+		expected string
+	}{
+		{LogFormatANSI, data},
+		{LogFormatPlain, "<red>\n"},
+		{"", "<red>\n"},
+		{LogFormatHTML, "<span class=\"ansi-fg-1\">&lt;red&gt;</span>\n"},
+	}
+	for _, c := range cases {
+		got := FormatLog(data, c.format)
+		if got != c.expected {
+			t.Errorf("FormatLog(%q): expected %q, got %q", c.format, c.expected, got)
+		}
+	}
+}
+
+func TestLogFormatter(t *testing.T) {
+	var out strings.Builder
+	lf := newLogFormatter(&out, LogFormatHTML)
+	// The escape sequence is split between writes
+	for _, part := range []string{"\x1b[3", "1mfirst\nsec", "ond"} {
+		_, err := lf.Write([]byte(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out.String() != "<span class=\"ansi-fg-1\">first</span>\n" {
+		t.Errorf("incomplete line is written: %q", out.String())
+	}
+	err := lf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "<span class=\"ansi-fg-1\">first</span>\n<span class=\"ansi-fg-1\">second</span>"
+	if out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
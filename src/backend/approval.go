@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ApprovalApproved is a decision to continue the build
+const ApprovalApproved = "approved"
+
+// ApprovalRejected is a decision to fail the build
+const ApprovalRejected = "rejected"
+
+// ApprovalTimeout is a decision made when nobody approved the build in time
+const ApprovalTimeout = "timeout"
+
+// TaskApproval pauses the build until a user approves or rejects it. The build
+// doesn't occupy an executor while it is waiting
+type TaskApproval struct {
+	// Message is displayed to the approver
+	Message string `yaml:"message" json:"message"`
+	// The build fails if it is not approved within Timeout
+	Timeout string `yaml:"timeout" json:"timeout"`
+}
+
+// ApprovalDecision is a decision made by a user about the approval task
+type ApprovalDecision struct {
+	TaskID    int       `json:"taskID"`
+	Decision  string    `json:"decision"`
+	Approver  string    `json:"approver"`
+	Comment   string    `json:"comment"`
+	DecidedAt time.Time `json:"decidedAt"`
+}
+
+// waitForApproval pauses the build until it is approved, rejected or aborted.
+// The build is moved out of running builds while it is waiting
+func (b *Build) waitForApproval(task *Task) ItemStatus {
+	b.Logger.Printf("Task %d is waiting for approval\n", task.ID)
+	bw, err := b.openTaskLog(task)
+	if err != nil {
+		b.Logger.Println(err)
+		return StatusFailed
+	}
+	defer b.closeTaskLog(task, bw)
+
+	b.ProcessLogEntry("> Waiting for approval", bw, task.ID, task.startedAt)
+	if task.Approval.Message != "" {
+		b.ProcessLogEntry("> "+task.Approval.Message, bw, task.ID, task.startedAt)
+	}
+
+	var timeout time.Duration
+	if task.Approval.Timeout != "" {
+		timeout, err = time.ParseDuration(task.Approval.Timeout)
+		if err != nil {
+			b.ProcessLogEntry(fmt.Sprintf("> Invalid timeout: %s", err.Error()), bw, task.ID, task.startedAt)
+			return StatusFailed
+		}
+	}
+
+	// Drop a decision which came too late for the previous approval task
+	select {
+	case <-b.approvalChannel:
+	default:
+	}
+	b.pauseTimeout()
+	GlobalQueue.Suspend(b.ID)
+	b.setTaskStatus(task, StatusWaiting)
+	b.SetBuildStatus(StatusWaiting)
+
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			err := GlobalQueue.Decide(b.ID, &ApprovalDecision{Decision: ApprovalTimeout})
+			if err != nil {
+				b.Logger.Println(err)
+			}
+		})
+		defer timer.Stop()
+	}
+
+	msg := MsgBroadcast{
+		Type: "approval:waiting:" + fmt.Sprint(b.ID),
+		Data: &ApprovalRequestData{
+			ID:      b.ID,
+			Name:    b.Job.Name,
+			TaskID:  task.ID,
+			Task:    task.Name,
+			Message: task.Approval.Message,
+			Timeout: task.Approval.Timeout,
+		},
+	}
+	WSHub.broadcast <- &msg
+
+	var decision *ApprovalDecision
+	select {
+	case decision = <-b.approvalChannel:
+	case <-b.abortedChannel:
+		b.ProcessLogEntry("> Aborted.", bw, task.ID, task.startedAt)
+		return StatusAborted
+	}
+
+	decision.TaskID = task.ID
+	decision.DecidedAt = time.Now()
+	b.mutex.Lock()
+	b.Approvals = append(b.Approvals, decision)
+	b.mutex.Unlock()
+
+	switch decision.Decision {
+	case ApprovalApproved:
+		b.ProcessLogEntry(fmt.Sprintf("> Approved by %s: %s", decision.Approver, decision.Comment), bw, task.ID, task.startedAt)
+	case ApprovalRejected:
+		b.ProcessLogEntry(fmt.Sprintf("> Rejected by %s: %s", decision.Approver, decision.Comment), bw, task.ID, task.startedAt)
+		return StatusFailed
+	default:
+		b.ProcessLogEntry("> Approval timed out", bw, task.ID, task.startedAt)
+		return StatusFailed
+	}
+
+	// Wait for a free executor to continue
+	b.setTaskStatus(task, StatusRunning)
+	b.BroadcastUpdate()
+	if !GlobalQueue.Resume(b.ID) {
+		b.ProcessLogEntry("> Aborted.", bw, task.ID, task.startedAt)
+		return StatusAborted
+	}
+	select {
+	case <-b.resumeChannel:
+	case <-b.abortedChannel:
+		b.ProcessLogEntry("> Aborted.", bw, task.ID, task.startedAt)
+		return StatusAborted
+	}
+	b.Logger.Println("Build has been resumed")
+	b.setResumed()
+	return StatusFinished
+}
+
+// setResumed sets the running status of the build after approval. Unlike
+// SetBuildStatus it continues the timeout and doesn't run on_running tasks
+// again
+func (b *Build) setResumed() {
+	b.Logger.Printf("Status: %s\n", StatusRunning)
+	b.setStatus(StatusRunning)
+	b.reportStatus(StatusRunning)
+	b.resumeTimeout()
+	b.BroadcastUpdate()
+	b.notify(StatusRunning)
+}
+
+// Suspend moves a running build to the list of builds which are waiting for
+// approval, releasing its executor
+func (q *Queue) Suspend(id int) {
+	q.mutex.Lock()
+	for i, item := range q.running {
+		if item.ID == id {
+			q.running = append(q.running[:i], q.running[i+1:]...)
+			item.decided = false
+			q.waiting = append(q.waiting, item)
+			break
+		}
+	}
+	q.mutex.Unlock()
+	q.Take()
+}
+
+// Resume puts a build which was approved back to the queue. It is
+// started ahead of other queued builds. Returns false if the build has been
+// aborted after the decision, such build stays in waiting builds until it is
+// removed from the queue
+func (q *Queue) Resume(id int) bool {
+	q.mutex.Lock()
+	resumed := false
+	for i, item := range q.waiting {
+		if item.ID == id {
+			if item.abortRequested {
+				break
+			}
+			resumed = true
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			item.resuming = true
+			q.queued = append([]*Build{item}, q.queued...)
+			break
+		}
+	}
+	q.mutex.Unlock()
+	if resumed {
+		q.Take()
+	}
+	return resumed
+}
+
+// Decide delivers approval decision to the build which is waiting for it
+func (q *Queue) Decide(id int, decision *ApprovalDecision) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, item := range q.waiting {
+		if item.ID == id {
+			if item.decided {
+				return fmt.Errorf("Build %d has been already decided on", id)
+			}
+			item.decided = true
+			item.approvalChannel <- decision
+			return nil
+		}
+	}
+	return fmt.Errorf("Build %d is not waiting for approval", id)
+}
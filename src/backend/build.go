@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,9 +9,11 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bmatcuk/doublestar"
@@ -41,6 +42,25 @@ const StatusPending = "pending"
 // StatusAborted ...
 const StatusAborted = "aborted"
 
+// StatusSkipped is a status of a task which is not executed because it
+// succeeded in the original build, see RerunBuild
+const StatusSkipped = "skipped"
+
+// StatusWaiting is a status of a build which is waiting for approval
+const StatusWaiting = "waiting"
+
+// StatusSuperseded is a status of a build which was removed from the queue or
+// aborted because a newer build in the same concurrency group was scheduled
+const StatusSuperseded = "superseded"
+
+// StatusFixed is not a status of a build, but an event when the build has
+// finished and the previous terminal build of the job has failed
+const StatusFixed = "fixed"
+
+// StatusBroken is an event when the build has failed and the previous
+// terminal build of the job has finished (or there are no previous builds)
+const StatusBroken = "broken"
+
 // FinalTask is the task that is executed no matter what is the result of the build
 const FinalTask = "finally"
 
@@ -49,52 +69,156 @@ const WHEN_EVAL_TIMEOUT = 3
 
 // Build ...
 type Build struct {
-	ID             int
-	Job            *Job
-	Status         ItemStatus
-	Logger         *log.Logger
-	abortedChannel chan bool
-	flushChannel   chan bool // Instructs to flush bw
-	pendingTasksWG sync.WaitGroup
-	aborted        bool
-	Params         []map[string]string
-	Artifacts      []string // Deprecate
-	BuildArtifacts []*ArtifactInfo
-	StartedAt      time.Time
-	Duration       time.Duration
-	ETA            int         // seconds
-	timer          *time.Timer // A timer for Job.Timeout
-	mutex          deadlock.Mutex
+	ID               int
+	Job              *Job
+	Status           ItemStatus
+	Logger           *log.Logger
+	abortedChannel   chan bool
+	pendingTasksWG   sync.WaitGroup
+	aborted          bool
+	Params           []map[string]string
+	Artifacts        []string // Deprecate
+	BuildArtifacts   []*ArtifactInfo
+	QueuedAt         time.Time
+	StartedAt        time.Time
+	Duration         time.Duration
+	ETA              int         // ns, estimated total duration of the build
+	ETALow           int         // ns, confidence interval of ETA
+	ETAHigh          int         // ns
+	timer            *time.Timer // A timer for Job.Timeout
+	timeoutDeadline  time.Time
+	timeoutLeft      time.Duration // Remaining timeout while the build is waiting for approval
+	mutex            deadlock.Mutex
+	etaModel         *ETAModel
+	ConcurrencyGroup string // Expanded name of Job.ConcurrencyGroup
+	Priority         int    // Job.Priority, can be changed while the build is queued
+	supersededBy     int
+	Approvals        []*ApprovalDecision
+	approvalChannel  chan *ApprovalDecision
+	resumeChannel    chan bool // Build is allowed to continue after approval
+	resuming         bool      // Build is queued to continue after approval
+	decided          bool      // Approval decision is delivered, guarded by Queue.mutex
+	abortRequested   bool      // Build is aborted after the decision, guarded by Queue.mutex
+	RerunOf          int       // ID of the original build
+	Summary          *BuildSummary
+	logBuffer        *LogBuffer       // The latest log messages for reconnected clients
+	taskLogs         map[int]*TaskLog // Logs of running tasks by task ID
+	logSize          int64            // Size of all task logs, atomic
 }
 
 // Start starts execution of tasks in job
 func (b *Build) Start() {
 	b.SetBuildStatus(StatusRunning)
 	for _, task := range b.Job.Tasks {
-		if task.Kind != KindMain {
+		if task.Kind != KindMain || task.Status == StatusSkipped {
 			continue
 		}
-		task.Status = StatusRunning
-		task.startedAt = time.Now()
+		b.startTask(task)
+		b.UpdateETA()
 		b.BroadcastUpdate()
 
-		status := b.runTask(task)
+		var status ItemStatus
+		if task.Approval != nil {
+			status = b.waitForApproval(task)
+		} else {
+			status = b.runTask(task)
+		}
 
-		task.Status = status
-		task.duration = time.Since(task.startedAt)
+		b.completeTask(task, status)
 		switch status {
 		case StatusFailed:
+			b.CollectCoverage(StatusFailed)
 			b.SetBuildStatus(StatusFailed)
 			return
 		case StatusAborted:
-			b.SetBuildStatus(StatusAborted)
+			if b.getSupersededBy() != 0 {
+				b.SetBuildStatus(StatusSuperseded)
+			} else {
+				b.SetBuildStatus(StatusAborted)
+			}
 			return
 		}
+		b.UpdateETA()
 		b.BroadcastUpdate()
 	}
+	// Coverage requirements may fail the build
+	if b.CollectCoverage(StatusFinished) != nil {
+		b.SetBuildStatus(StatusFailed)
+		return
+	}
 	b.SetBuildStatus(StatusFinished)
 }
 
+// startTask marks the task as running. Task state is read by other
+// goroutines when the build update is generated
+func (b *Build) startTask(task *Task) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	task.Status = StatusRunning
+	task.startedAt = time.Now()
+}
+
+// completeTask sets the final status and the duration of the task
+func (b *Build) completeTask(task *Task, status ItemStatus) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	task.Status = status
+	task.duration = time.Since(task.startedAt)
+}
+
+// setTaskStatus changes the status of the task without affecting its timing
+func (b *Build) setTaskStatus(task *Task, status ItemStatus) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	task.Status = status
+}
+
+// getStatus returns the current status of the build
+func (b *Build) getStatus() ItemStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.Status
+}
+
+// getStartedAt returns the time when the build has been started
+func (b *Build) getStartedAt() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.StartedAt
+}
+
+// setStatus changes the status of the build. The start time is set when the
+// build is started
+func (b *Build) setStatus(status ItemStatus) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.Status = status
+	if status == StatusRunning && b.StartedAt.IsZero() {
+		b.StartedAt = time.Now()
+	}
+}
+
+// setDuration records the duration of the completed build
+func (b *Build) setDuration() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.Duration = time.Since(b.StartedAt)
+}
+
+// setSupersededBy marks the build as superseded by a newer build
+func (b *Build) setSupersededBy(id int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.supersededBy = id
+}
+
+// getSupersededBy returns id of the build which superseded this build
+func (b *Build) getSupersededBy() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.supersededBy
+}
+
 // runOnStatusTasks runs tasks on status change
 func (b *Build) runOnStatusTasks(status ItemStatus) {
 	if status == StatusPending {
@@ -103,14 +227,16 @@ func (b *Build) runOnStatusTasks(status ItemStatus) {
 	}
 	for _, task := range b.Job.Tasks {
 		if task.Kind == string(status) {
-			task.Status = StatusRunning
-			task.startedAt = time.Now()
+			if task.Approval != nil {
+				b.Logger.Printf("Approval task %d is skipped, only main tasks can be approved\n", task.ID)
+				continue
+			}
+			b.startTask(task)
 			b.BroadcastUpdate()
 
 			status := b.runTask(task)
 
-			task.Status = status
-			task.duration = time.Since(task.startedAt)
+			b.completeTask(task, status)
 			b.BroadcastUpdate()
 		}
 	}
@@ -129,7 +255,8 @@ func (b *Build) runTask(task *Task) ItemStatus {
 	// Create Cmd with options
 	// Modify default streaming buffer size (thanks, webpack)
 	cmd.DEFAULT_LINE_BUFFER_SIZE = 491520
-	taskCmd := cmd.NewCmdOptions(cmdOptions, "bash", "-c", task.Command)
+	command := b.substituteOutputs(task.Command)
+	taskCmd := cmd.NewCmdOptions(cmdOptions, "bash", "-c", command)
 
 	// Construct environment from params
 	taskCmd.Env = os.Environ()
@@ -141,38 +268,34 @@ func (b *Build) runTask(task *Task) ItemStatus {
 		}
 	}
 
+	// Outputs of previous tasks and the file for outputs of this task
+	taskCmd.Env = append(taskCmd.Env, b.getOutputsEnv()...)
+	taskCmd.Env = append(taskCmd.Env, fmt.Sprintf("WAKE_OUTPUT=%s", b.GetOutputFilename(task)))
+	taskCmd.Env = append(taskCmd.Env, fmt.Sprintf("WAKE_SUMMARY=%s", b.GetSummaryFilename(task)))
+
 	for key, value := range task.Env {
 		taskCmd.Env = append(taskCmd.Env, fmt.Sprintf("%s=%s", key, value))
 	}
 
 	// Configure task logs
-	file, err := os.Create(b.GetWakespaceDir() + fmt.Sprintf("task_%d.log", task.ID))
-	bw := bufio.NewWriter(file)
-	defer func() {
-		err = bw.Flush()
-		if err != nil {
-			b.Logger.Println(err)
-		}
-		err = file.Close()
-		if err != nil {
-			b.Logger.Println(err)
-		}
-	}()
+	bw, err := b.openTaskLog(task)
 	if err != nil {
 		b.Logger.Println(err)
 		return StatusFailed
 	}
+	defer b.closeTaskLog(task, bw)
 
 	// Checking condition in when
 	if task.When != "" {
-		condCmd := exec.Command("bash", "-c", fmt.Sprintf("[[ %s ]]", task.When))
+		when := b.substituteOutputs(task.When)
+		condCmd := exec.Command("bash", "-c", fmt.Sprintf("[[ %s ]]", when))
 		condCmd.Env = taskCmd.Env
 		condCmd.Dir = taskCmd.Dir
 		b.ProcessLogEntry("> Checking `when` condition: "+task.When, bw, task.ID, task.startedAt)
-		expandedCondCmd := os.Expand(task.When, getEnvMapper(condCmd.Env))
+		expandedCondCmd := os.Expand(when, b.getLogEnvMapper(condCmd.Env))
 		if expandedCondCmd != task.When {
 			b.ProcessLogEntry(
-				"> Expanded condition: "+os.Expand(task.When, getEnvMapper(condCmd.Env)), bw, task.ID, task.startedAt,
+				"> Expanded condition: "+expandedCondCmd, bw, task.ID, task.startedAt,
 			)
 		}
 		condErr := condCmd.Start()
@@ -210,13 +333,26 @@ func (b *Build) runTask(task *Task) ItemStatus {
 
 	// Add executed command to logs
 	b.ProcessLogEntry("> Running command: "+task.Command, bw, task.ID, task.startedAt)
-	expandedTaskCmd := os.Expand(task.Command, getEnvMapper(taskCmd.Env))
+	expandedTaskCmd := os.Expand(command, b.getLogEnvMapper(taskCmd.Env))
 	if expandedTaskCmd != task.Command {
 		b.ProcessLogEntry(
-			"> Expanded command: "+os.Expand(task.Command, getEnvMapper(taskCmd.Env)), bw, task.ID, task.startedAt,
+			"> Expanded command: "+expandedTaskCmd, bw, task.ID, task.startedAt,
 		)
 	}
 
+	outputFile, err := os.Create(b.GetOutputFilename(task))
+	if err != nil {
+		b.ProcessLogEntry(fmt.Sprintf("> Unable to create output file: %s", err.Error()), bw, task.ID, task.startedAt)
+		return StatusFailed
+	}
+	outputFile.Close()
+	summaryFile, err := os.Create(b.GetSummaryFilename(task))
+	if err != nil {
+		b.ProcessLogEntry(fmt.Sprintf("> Unable to create summary file: %s", err.Error()), bw, task.ID, task.startedAt)
+		return StatusFailed
+	}
+	summaryFile.Close()
+
 	// Print STDOUT and STDERR lines streaming from Cmd
 	// See example https://github.com/go-cmd/cmd/blob/master/examples/blocking-streaming/main.go
 	doneChan := make(chan struct{})
@@ -243,9 +379,6 @@ func (b *Build) runTask(task *Task) ItemStatus {
 					taskCmd.Stop()
 					b.aborted = true
 				}
-			case <-b.flushChannel:
-				b.Logger.Println("Flushing log file...")
-				bw.Flush()
 			}
 		}
 	}()
@@ -269,6 +402,30 @@ func (b *Build) runTask(task *Task) ItemStatus {
 
 	b.ProcessLogEntry(fmt.Sprintf("> Exit code: %d", status.Exit), bw, task.ID, task.startedAt)
 
+	// Summary is informational, it never fails the task
+	updated, err := b.collectSummary(task)
+	if err != nil {
+		b.ProcessLogEntry(fmt.Sprintf("> Unable to read summary: %s", err.Error()), bw, task.ID, task.startedAt)
+	} else if updated {
+		b.ProcessLogEntry("> Build summary has been updated", bw, task.ID, task.startedAt)
+		b.BroadcastUpdate()
+	}
+
+	outputs, err := b.collectOutputs(task)
+	if err != nil {
+		b.ProcessLogEntry(fmt.Sprintf("> Unable to read outputs: %s", err.Error()), bw, task.ID, task.startedAt)
+		if !task.IgnoreErrors {
+			return StatusFailed
+		}
+	} else if len(outputs) > 0 {
+		keys := make([]string, 0, len(outputs))
+		for key := range outputs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.ProcessLogEntry("> Outputs: "+strings.Join(keys, ", "), bw, task.ID, task.startedAt)
+	}
+
 	if !status.Complete || status.Exit != 0 || status.Error != nil {
 		if task.IgnoreErrors {
 			b.ProcessLogEntry("> Ignorring exit code", bw, task.ID, task.startedAt)
@@ -283,9 +440,12 @@ func (b *Build) runTask(task *Task) ItemStatus {
 // Generate default set of environmental variables that are injected before
 // running a task, for example WAKE_BUILD_ID
 func (b *Build) generateDefaultEnvVariables() []string {
+	// Values of secret params are masked, they are available only in their own
+	// variables
 	params := url.Values{}
-	for idx := range b.Params {
-		for pkey, pval := range b.Params[idx] {
+	masked := b.Job.Params.MaskSecrets(b.Params)
+	for idx := range masked {
+		for pkey, pval := range masked[idx] {
 			params.Set(pkey, pval)
 		}
 	}
@@ -296,14 +456,67 @@ func (b *Build) generateDefaultEnvVariables() []string {
 		fmt.Sprintf("WAKE_JOB_PARAMS=%s", params.Encode()),
 		fmt.Sprintf("WAKE_CONFIG_DIR=%s", Config.JobDir),
 	}
-	if Config.Port == "443" {
-		evs = append(evs, fmt.Sprintf("WAKE_URL=https://%s/", Config.Hostname))
-	} else {
-		evs = append(evs, fmt.Sprintf("WAKE_URL=http://localhost:%s/", Config.Port))
-	}
+	evs = append(evs, fmt.Sprintf("WAKE_URL=%s", GetServiceURL()))
 	return evs
 }
 
+// expandParams replaces ${var} in the string with values of build params and
+// default environmental variables
+func (b *Build) expandParams(str string) string {
+	env := b.generateDefaultEnvVariables()
+	for idx := range b.Params {
+		for pkey, pval := range b.Params[idx] {
+			env = append(env, fmt.Sprintf("%s=%s", pkey, pval))
+		}
+	}
+	return os.Expand(str, getEnvMapper(env))
+}
+
+// getParamsMap returns build params as a map, values of secret params are
+// masked
+func (b *Build) getParamsMap() map[string]string {
+	params := map[string]string{}
+	for _, item := range b.Job.Params.MaskSecrets(b.Params) {
+		for pkey, pval := range item {
+			params[pkey] = pval
+		}
+	}
+	return params
+}
+
+// startTimeout aborts the build after the duration
+func (b *Build) startTimeout(duration time.Duration) {
+	b.timeoutDeadline = time.Now().Add(duration)
+	b.timer = time.AfterFunc(duration, func() {
+		b.Logger.Printf("Build %d has timed out\n", b.ID)
+		err := GlobalQueue.Abort(b.ID)
+		if err != nil {
+			b.Logger.Println(err)
+		}
+	})
+}
+
+// pauseTimeout stops the timeout and remembers the remaining time
+func (b *Build) pauseTimeout() {
+	if b.timer == nil || !b.timer.Stop() {
+		return
+	}
+	b.timer = nil
+	b.timeoutLeft = time.Until(b.timeoutDeadline)
+	if b.timeoutLeft <= 0 {
+		b.timeoutLeft = time.Nanosecond
+	}
+}
+
+// resumeTimeout restarts the timeout paused by pauseTimeout
+func (b *Build) resumeTimeout() {
+	if b.timeoutLeft == 0 {
+		return
+	}
+	b.startTimeout(b.timeoutLeft)
+	b.timeoutLeft = 0
+}
+
 // Cleanup is called when a job finished, failed or aborted
 func (b *Build) Cleanup() {
 	if b.timer != nil {
@@ -313,6 +526,28 @@ func (b *Build) Cleanup() {
 	GlobalQueue.Take()
 }
 
+// discard removes the build which was created but never queued
+func (b *Build) discard() {
+	b.Logger.Println("Discarding the build...")
+	if GlobalEvents != nil {
+		GlobalEvents.Forget(b.ID)
+	}
+	err := os.RemoveAll(b.GetWorkspaceDir())
+	if err != nil {
+		b.Logger.Println(err)
+	}
+	err = os.RemoveAll(b.GetWakespaceDir())
+	if err != nil {
+		b.Logger.Println(err)
+	}
+	err = DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(HistoryBucket).Delete(Itob(b.ID))
+	})
+	if err != nil {
+		b.Logger.Println(err)
+	}
+}
+
 // CollectArtifacts copies artifacts from workspace to wakespace
 func (b *Build) CollectArtifacts() {
 	for _, artPattern := range b.Job.Artifacts {
@@ -367,6 +602,9 @@ func (b *Build) BroadcastUpdate() {
 		Data: data,
 	}
 	WSHub.broadcast <- &msg
+	if GlobalEvents != nil {
+		GlobalEvents.PublishBuildUpdate(b)
+	}
 
 	err := DB.Update(func(tx *bolt.Tx) error {
 		var err error
@@ -391,38 +629,49 @@ func (b *Build) GenerateBuildUpdateData() *BuildUpdateData {
 		Name:           b.Job.Name,
 		Status:         b.Status,
 		Tasks:          b.GetTasksStatus(),
-		Params:         b.Params,
+		Params:         b.Job.Params.MaskSecrets(b.Params),
 		Artifacts:      b.Artifacts, // Deprecate
 		BuildArtifacts: b.BuildArtifacts,
 		StartedAt:      b.StartedAt,
 		Duration:       b.Duration,
 		ETA:            b.ETA,
+		ETALow:         b.ETALow,
+		ETAHigh:        b.ETAHigh,
+		SupersededBy:   b.supersededBy,
+		Approvals:      b.Approvals,
+		RerunOf:        b.RerunOf,
+		Summary:        b.Summary.copy(),
+		LogSize:        atomic.LoadInt64(&b.logSize),
 	}
 }
 
 // ProcessLogEntry handles log messages from tasks
-func (b *Build) ProcessLogEntry(line string, buffer *bufio.Writer, taskID int, startedAt time.Time) {
-	// Format and clean up the log line:
+func (b *Build) ProcessLogEntry(line string, buffer *TaskLog, taskID int, startedAt time.Time) {
+	// Format the log line:
 	// - add duration and a new line to the log entry
-	// - stip out color info
+	// - keep color info, it is removed or converted when the log is read
 	//
 	// Note: Internal logs start with `>`
-	pline := fmt.Sprintf("[%10s] ", time.Since(startedAt).Truncate(time.Millisecond).String()) + StripColor(line) + "\n"
+	prefix := fmt.Sprintf("[%10s] ", time.Since(startedAt).Truncate(time.Millisecond).String())
+	pline := prefix + line + "\n"
+	// Logs which exceed the limits are truncated, the marker is the last line
+	ok, limit := buffer.reserve(len(pline))
+	if !ok {
+		if limit == "" {
+			return
+		}
+		pline = prefix + fmt.Sprintf(LogTruncatedMarker, limit) + "\n"
+	}
 	// Write to the task's log file
 	_, err := buffer.WriteString(pline)
 	if err != nil {
 		b.Logger.Println(err)
 	}
 
-	// Send the log to all subscribed users
-	msg := MsgBroadcast{
-		Type: "build:log:" + strconv.Itoa(b.ID),
-		Data: &CommandLogData{
-			TaskID: taskID,
-			Data:   pline,
-		},
-	}
-	WSHub.broadcast <- &msg
+	// Send the log to all subscribed users. The hub sends new messages in
+	// batches, so the task doesn't wait for slow clients
+	b.logBuffer.Add(taskID, pline)
+	WSHub.PublishLogs("build:log:"+strconv.Itoa(b.ID), b.logBuffer)
 }
 
 // GetWorkspaceDir returns path to the workspace, where all user created files
@@ -451,27 +700,50 @@ func (b *Build) GetBuildConfigFilename() string {
 func (b *Build) GetTasksStatus() []*TaskStatus {
 	info := make([]*TaskStatus, 0)
 	for _, t := range b.Job.Tasks {
+		var eta int
+		if b.etaModel != nil {
+			eta = int(b.etaModel.Tasks[t.Kind+"/"+t.Name])
+		}
+		logSize, logTruncated := t.logSize, t.logTruncated
+		if tl, ok := b.taskLogs[t.ID]; ok {
+			logSize, logTruncated = tl.Size(), tl.Truncated()
+		}
 		info = append(info, &TaskStatus{
-			ID:        t.ID,
-			Status:    t.Status,
-			StartedAt: t.startedAt,
-			Duration:  t.duration,
-			Kind:      t.Kind,
+			ID:           t.ID,
+			Status:       t.Status,
+			StartedAt:    t.startedAt,
+			Duration:     t.duration,
+			Kind:         t.Kind,
+			Outputs:      t.outputs,
+			ETA:          eta,
+			LogSize:      logSize,
+			LogTruncated: logTruncated,
 		})
 	}
 	return info
 }
 
+// abort signals the build to abort. The signal is kept until the build reads
+// it, e.g. when the next task starts
+func (b *Build) abort() {
+	select {
+	case b.abortedChannel <- true:
+	default:
+		// The build has already been signalled
+	}
+}
+
 // SetBuildStatus sets the status of the builds
 func (b *Build) SetBuildStatus(status ItemStatus) {
 	b.Logger.Printf("Status: %s\n", status)
-	b.Status = status
-	if status == StatusRunning {
-		b.StartedAt = time.Now()
-	}
+	b.setStatus(status)
+	b.reportStatus(status)
 	// Wait for pending task to finish before running anything else
 	b.pendingTasksWG.Wait()
+	change := b.getStatusChange(status)
 	switch status {
+	case StatusWaiting:
+		b.BroadcastUpdate()
 	case StatusPending:
 		b.BroadcastUpdate()
 		// Run onStatusTasks of kind pending in separate goroutine so it doesn't
@@ -486,48 +758,104 @@ func (b *Build) SetBuildStatus(status ItemStatus) {
 			if err != nil {
 				b.Logger.Println(err)
 			} else {
-				b.timer = time.NewTimer(duration)
-				go func() {
-					<-b.timer.C
-					b.Logger.Printf("Build %d has timed out\n", b.ID)
-					err = GlobalQueue.Abort(b.ID)
-					if err != nil {
-						b.Logger.Println(err)
-					}
-				}()
+				b.startTimeout(duration)
 			}
 		}
 		b.runOnStatusTasks(status)
 	case StatusAborted:
 		b.runOnStatusTasks(status)
 		b.runOnStatusTasks(FinalTask)
-		b.Duration = time.Since(b.StartedAt)
+		b.setDuration()
 		b.Cleanup()
+		b.recordStats()
+		b.BroadcastUpdate()
+	case StatusSuperseded:
+		// Superseded build is an aborted build
+		b.runOnStatusTasks(StatusAborted)
+		b.runOnStatusTasks(FinalTask)
+		b.setDuration()
+		b.Cleanup()
+		b.recordStats()
 		b.BroadcastUpdate()
 	case StatusFailed:
 		b.runOnStatusTasks(status)
+		if change != "" {
+			b.runOnStatusTasks(change)
+		}
 		b.CollectArtifacts()
+		b.CollectReports()
 		b.runOnStatusTasks(FinalTask)
-		b.Duration = time.Since(b.StartedAt)
+		b.setDuration()
 		b.Cleanup()
+		b.recordStats()
 		b.BroadcastUpdate()
 	case StatusFinished:
 		b.runOnStatusTasks(status)
+		if change != "" {
+			b.runOnStatusTasks(change)
+		}
 		b.CollectArtifacts()
+		b.CollectReports()
 		b.runOnStatusTasks(FinalTask)
-		b.Duration = time.Since(b.StartedAt)
+		b.setDuration()
 		b.Cleanup()
-		err := RecordBuildDuration(b.Job.Name, int(b.Duration))
-		if err != nil {
-			b.Logger.Println(err)
-		}
+		b.recordStats()
 		b.BroadcastUpdate()
 	}
+	b.notify(status)
+	if change != "" {
+		b.notify(change)
+	}
+	switch status {
+	case StatusFinished, StatusFailed, StatusAborted, StatusSuperseded:
+		if GlobalEvents != nil {
+			GlobalEvents.Forget(b.ID)
+		}
+	}
+}
 
+// getStatusChange returns StatusFixed or StatusBroken if the outcome of the
+// build differs from the previous terminal build of the job
+func (b *Build) getStatusChange(status ItemStatus) ItemStatus {
+	switch status {
+	case StatusFinished, StatusFailed:
+		break
+	default:
+		return ""
+	}
+	previous, err := GetPreviousBuildStatus(b.Job.Name, b.ID)
+	if err != nil {
+		b.Logger.Println(err)
+		return ""
+	}
+	// The first build of the job doesn't change anything
+	if previous == "" {
+		return ""
+	}
+	if status == StatusFinished && previous == StatusFailed {
+		b.Logger.Println("Build is fixed")
+		return StatusFixed
+	}
+	if status == StatusFailed && previous != StatusFailed {
+		b.Logger.Println("Build is broken")
+		return StatusBroken
+	}
+	return ""
+}
+
+// recordStats saves statistics and metrics of the terminal build
+func (b *Build) recordStats() {
+	err := RecordBuildStats(b)
+	if err != nil {
+		b.Logger.Println(err)
+	}
+	GlobalMetrics.ObserveBuild(b)
 }
 
-// CreateBuild creates Build instance and all necessary files and folders in wakespace
-func CreateBuild(job *Job, jobPath string) (*Build, error) {
+// CreateBuild creates Build instance and all necessary files and folders in
+// wakespace. Params are assigned before the build gets pending status, so
+// they are available to notifiers and forges
+func CreateBuild(job *Job, jobPath string, params []map[string]string) (*Build, error) {
 	var counti int
 	err := DB.Update(func(tx *bolt.Tx) error {
 		var err error
@@ -550,12 +878,15 @@ func CreateBuild(job *Job, jobPath string) (*Build, error) {
 	}
 
 	build := Build{
-		Job:            job,
-		ID:             counti,
-		abortedChannel: make(chan bool),
-		flushChannel:   make(chan bool),
-		Params:         job.DefaultParams,
-		ETA:            GetJobETA(job.Name),
+		Job:             job,
+		ID:              counti,
+		abortedChannel:  make(chan bool, 1),
+		approvalChannel: make(chan *ApprovalDecision, 1),
+		resumeChannel:   make(chan bool, 1),
+		logBuffer:       NewLogBuffer(LogBufferSize),
+		taskLogs:        map[int]*TaskLog{},
+		Params:          params,
+		Priority:        job.Priority,
 	}
 	build.Logger = log.New(os.Stdout, fmt.Sprintf("[build #%d] ", build.ID), log.Lmicroseconds|log.Lshortfile)
 
@@ -619,3 +950,17 @@ func getEnvMapper(env []string) func(string) string {
 	}
 	return mapper
 }
+
+// Used to expand env variables in commands before logging them. Values of
+// secret params are masked
+func (b *Build) getLogEnvMapper(env []string) func(string) string {
+	envMapper := getEnvMapper(env)
+	mapper := func(evar string) string {
+		p := b.Job.Params.Get(evar)
+		if p != nil && p.Secret {
+			return SecretMask
+		}
+		return envMapper(evar)
+	}
+	return mapper
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+// CHOICES_EVAL_TIMEOUT is the timeout for running `choices_from` command of params
+const CHOICES_EVAL_TIMEOUT = 10
+
+// DefaultChoicesCachePeriod is a period during which choices generated by
+// `choices_from` command are reused
+const DefaultChoicesCachePeriod = time.Minute
+
+// ChoicesCache stores results of `choices_from` commands
+type ChoicesCache struct {
+	items map[string]*choicesCacheItem
+	mu    deadlock.Mutex
+}
+
+type choicesCacheItem struct {
+	choices []string
+	expires time.Time
+}
+
+// GlobalChoicesCache is a global cache of dynamic param choices
+var GlobalChoicesCache = &ChoicesCache{
+	items: map[string]*choicesCacheItem{},
+}
+
+// Get returns choices generated by the command, runs the command if they
+// are not cached or expired
+func (cc *ChoicesCache) Get(jobName string, p *JobParam) ([]string, error) {
+	key := jobName + "\x00" + p.Name + "\x00" + p.ChoicesFrom
+	cc.mu.Lock()
+	item, ok := cc.items[key]
+	cc.mu.Unlock()
+	if ok && item.expires.After(time.Now()) {
+		return item.choices, nil
+	}
+
+	period := DefaultChoicesCachePeriod
+	if p.ChoicesCache != "" {
+		var err error
+		period, err = time.ParseDuration(p.ChoicesCache)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	choices, err := runChoicesCommand(jobName, p.ChoicesFrom)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get choices for param %s: %s", p.Name, err.Error())
+	}
+
+	cc.mu.Lock()
+	cc.items[key] = &choicesCacheItem{
+		choices: choices,
+		expires: time.Now().Add(period),
+	}
+	cc.mu.Unlock()
+	return choices, nil
+}
+
+// runChoicesCommand runs the command and returns not empty lines of its output
+func runChoicesCommand(jobName string, command string) ([]string, error) {
+	Logger.Printf("Generating choices for job %s: %s\n", jobName, command)
+	var stdout bytes.Buffer
+	choicesCmd := exec.Command("bash", "-c", command)
+	choicesCmd.Dir = Config.JobDir
+	choicesCmd.Env = append(
+		os.Environ(),
+		fmt.Sprintf("WAKE_JOB_NAME=%s", jobName),
+		fmt.Sprintf("WAKE_CONFIG_DIR=%s", Config.JobDir),
+	)
+	choicesCmd.Stdout = &stdout
+	err := choicesCmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	killed := false
+	timer := time.AfterFunc(CHOICES_EVAL_TIMEOUT*time.Second, func() {
+		killed = true
+		choicesCmd.Process.Kill()
+	})
+	err = choicesCmd.Wait()
+	timer.Stop()
+	if killed {
+		return nil, fmt.Errorf("command timed out")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	choices := []string{}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			choices = append(choices, line)
+		}
+	}
+	return choices, nil
+}
+
+// ResolveChoices fills choices of params which have `choices_from` command
+func (jp JobParams) ResolveChoices(jobName string) error {
+	for _, p := range jp {
+		if p.ChoicesFrom == "" {
+			continue
+		}
+		choices, err := GlobalChoicesCache.Get(jobName, p)
+		if err != nil {
+			return err
+		}
+		p.Choices = choices
+	}
+	return nil
+}
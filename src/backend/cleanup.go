@@ -41,6 +41,7 @@ func (cl *Cleaner) Clean() {
 		// Find starting point for removing
 		fromB := make([]byte, 8)
 		binary.BigEndian.PutUint64(fromB, binary.BigEndian.Uint64(lastK)-uint64(preserve))
+		cleaned := false
 		for key, _ := c.Seek(fromB); key != nil; key, _ = c.Prev() {
 			var id = binary.BigEndian.Uint64(key)
 			if id > binary.BigEndian.Uint64(fromB) {
@@ -59,10 +60,26 @@ func (cl *Cleaner) Clean() {
 			if err != nil {
 				cl.Logger.Println(err)
 			}
+			err = tx.Bucket(TestsBucket).Delete(key)
+			if err != nil {
+				cl.Logger.Println(err)
+			}
+			err = deleteBuildCoverage(tx, int(id))
+			if err != nil {
+				cl.Logger.Println(err)
+			}
+			cleaned = true
+		}
+		if cleaned {
+			err = pruneTestHistory(tx, int(binary.BigEndian.Uint64(fromB)))
+			if err != nil {
+				cl.Logger.Println(err)
+			}
 		}
 		return nil
 	})
 	cl.Logger.Printf("Took %s\n", time.Since(started))
+	GlobalMetrics.ObserveCleaner(time.Since(started))
 	if err != nil {
 		cl.Logger.Println(err)
 		return
@@ -103,6 +120,12 @@ func CleanupJobsBucket() {
 			if err != nil {
 				Logger.Println(err)
 			}
+			if tx.Bucket(TestHistoryBucket).Bucket(rk) != nil {
+				err = tx.Bucket(TestHistoryBucket).DeleteBucket(rk)
+				if err != nil {
+					Logger.Println(err)
+				}
+			}
 		}
 		return nil
 	})
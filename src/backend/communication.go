@@ -26,6 +26,18 @@ type MsgIncoming struct {
 // InSubscribeData ...
 type InSubscribeData struct {
 	To []string `json:"to"`
+	// ID of the last received log message. If it is set, missed messages of
+	// running builds are sent before new ones
+	Since *int `json:"since"`
+	// Format of log messages: plain (default) or html. It applies to all
+	// subscriptions of the client
+	Format string `json:"format"`
+}
+
+// LogMissedData is sent as `build:log:missed:<id>` when some of the log
+// messages can't be replayed and the log should be reloaded
+type LogMissedData struct {
+	Since int `json:"since"`
 }
 
 // JobsListData is a format of data that JobsView receives and JobsBucket stores
@@ -33,17 +45,25 @@ type JobsListData struct {
 	Name          string              `json:"name"`
 	Desc          string              `json:"desc"`
 	DefaultParams []map[string]string `json:"defaultParams"`
+	Params        JobParams           `json:"params"`
 	Interval      string              `json:"interval"`
 	Active        string              `json:"active"`
+	Stats         *JobStatsSummary    `json:"stats"`
 }
 
 // TaskStatus contains basic info about a task, used for status updates
 type TaskStatus struct {
-	ID        int           `json:"id"`
-	Status    ItemStatus    `json:"status"`
-	StartedAt time.Time     `json:"startedAt"`
-	Duration  time.Duration `json:"duration"`
-	Kind      string        `json:"kind"`
+	ID        int               `json:"id"`
+	Status    ItemStatus        `json:"status"`
+	StartedAt time.Time         `json:"startedAt"`
+	Duration  time.Duration     `json:"duration"`
+	Kind      string            `json:"kind"`
+	Outputs   map[string]string `json:"outputs"`
+	ETA       int               `json:"eta"`
+	// Size of the log in bytes, it is stored compressed when the task is
+	// completed
+	LogSize      int64 `json:"logSize"`
+	LogTruncated bool  `json:"logTruncated"`
 }
 
 // BuildUpdateData is viewable on the feed page
@@ -58,6 +78,13 @@ type BuildUpdateData struct {
 	StartedAt      time.Time           `json:"startedAt"`
 	Duration       time.Duration       `json:"duration"`
 	ETA            int                 `json:"eta"`
+	ETALow         int                 `json:"etaLow"`
+	ETAHigh        int                 `json:"etaHigh"`
+	SupersededBy   int                 `json:"supersededBy"`
+	Approvals      []*ApprovalDecision `json:"approvals"`
+	RerunOf        int                 `json:"rerunOf"`
+	Summary        *BuildSummary       `json:"summary"`
+	LogSize        int64               `json:"logSize"` // Size of all task logs in bytes
 }
 
 // CommandLogData ...
@@ -75,5 +102,58 @@ type SettingsData struct {
 
 // JobData used for editing a job
 type JobData struct {
-	Content string `json:"fileContent"`
+	Content string    `json:"fileContent"`
+	Params  JobParams `json:"params"`
+}
+
+// LockStateData describes which builds hold and wait for a named lock
+type LockStateData struct {
+	Name    string          `json:"name"`
+	Holders []*LockUserData `json:"holders"`
+	Waiters []*LockUserData `json:"waiters"`
+}
+
+// LockUserData is a build which holds or waits for a lock
+type LockUserData struct {
+	BuildID int        `json:"buildID"`
+	Job     string     `json:"job"`
+	Mode    string     `json:"mode"`
+	Status  ItemStatus `json:"status"`
+}
+
+// QueueStateData contains information about running and queued builds
+type QueueStateData struct {
+	ConcurrentBuilds int              `json:"concurrentBuilds"`
+	Running          []*QueueItemData `json:"running"`
+	Waiting          []*QueueItemData `json:"waiting"`
+	Queued           []*QueueItemData `json:"queued"`
+	Locks            []*LockStateData `json:"locks"`
+}
+
+// QueueItemData describes a build in the queue
+type QueueItemData struct {
+	ID                int                 `json:"id"`
+	Name              string              `json:"name"`
+	Status            ItemStatus          `json:"status"`
+	Position          int                 `json:"position"`
+	Priority          int                 `json:"priority"`
+	Params            []map[string]string `json:"params"`
+	Locks             []*JobLock          `json:"locks"`
+	WaitingReason     string              `json:"waitingReason"`
+	EffectivePriority int                 `json:"effectivePriority"`
+	QueuedAt          time.Time           `json:"queuedAt"`
+	WaitTime          time.Duration       `json:"waitTime"`
+	StartedAt         time.Time           `json:"startedAt"`
+	ETA               int                 `json:"eta"`
+	ETAToStart        time.Duration       `json:"etaToStart"`
+}
+
+// ApprovalRequestData is sent when a build is waiting for approval
+type ApprovalRequestData struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	TaskID  int    `json:"taskID"`
+	Task    string `json:"task"`
+	Message string `json:"message"`
+	Timeout string `json:"timeout"`
 }
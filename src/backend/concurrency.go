@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ConcurrencyPolicyQueue - builds in the same concurrency group wait for each other
+const ConcurrencyPolicyQueue = "queue"
+
+// ConcurrencyPolicyReplacePending - a new build removes older queued builds in
+// the same concurrency group
+const ConcurrencyPolicyReplacePending = "replace-pending"
+
+// ConcurrencyPolicyCancelRunning - a new build removes older queued builds and
+// aborts the running build in the same concurrency group
+const ConcurrencyPolicyCancelRunning = "cancel-running"
+
+// ConcurrencyGroup ensures that only one build in the group is running at
+// the same time. The name of the group may contain params, e.g. `deploy-${BRANCH}`.
+// In job file it can be specified as a string (with `queue` policy) or as an
+// object with `name` and `policy`
+type ConcurrencyGroup struct {
+	Name   string `yaml:"name" json:"name"`
+	Policy string `yaml:"policy" json:"policy"`
+}
+
+// UnmarshalYAML allows to specify a concurrency group as a plain string
+func (g *ConcurrencyGroup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	err := unmarshal(&name)
+	if err == nil {
+		g.Name = name
+		g.Policy = ConcurrencyPolicyQueue
+		return nil
+	}
+
+	type plainGroup ConcurrencyGroup
+	var pg plainGroup
+	err = unmarshal(&pg)
+	if err != nil {
+		return err
+	}
+	if pg.Name == "" {
+		return fmt.Errorf("concurrency group name is required")
+	}
+	switch pg.Policy {
+	case "":
+		pg.Policy = ConcurrencyPolicyQueue
+	case ConcurrencyPolicyQueue, ConcurrencyPolicyReplacePending, ConcurrencyPolicyCancelRunning:
+		break
+	default:
+		return fmt.Errorf("invalid policy %q for concurrency group %s", pg.Policy, pg.Name)
+	}
+	*g = ConcurrencyGroup(pg)
+	return nil
+}
+
+// Supersede applies concurrency policy of the new build to older builds in
+// the same concurrency group
+func (q *Queue) Supersede(b *Build) {
+	if b.ConcurrencyGroup == "" || b.Job.ConcurrencyGroup.Policy == ConcurrencyPolicyQueue {
+		return
+	}
+
+	var superseded []*Build
+	var toAbort []*Build
+	q.mutex.Lock()
+	queued := make([]*Build, 0, len(q.queued))
+	for _, item := range q.queued {
+		if item.ID != b.ID && item.ConcurrencyGroup == b.ConcurrencyGroup {
+			item.setSupersededBy(b.ID)
+			if item.resuming {
+				// The build has been started and is waiting for an executor
+				// after approval, it is aborted and removed when finished
+				toAbort = append(toAbort, item)
+				queued = append(queued, item)
+				continue
+			}
+			superseded = append(superseded, item)
+			continue
+		}
+		queued = append(queued, item)
+	}
+	q.queued = queued
+	if b.Job.ConcurrencyGroup.Policy == ConcurrencyPolicyCancelRunning {
+		for _, item := range q.running {
+			if item.ConcurrencyGroup == b.ConcurrencyGroup {
+				item.setSupersededBy(b.ID)
+				toAbort = append(toAbort, item)
+			}
+		}
+		for _, item := range q.waiting {
+			if item.ConcurrencyGroup == b.ConcurrencyGroup {
+				item.setSupersededBy(b.ID)
+				toAbort = append(toAbort, item)
+			}
+		}
+	}
+	q.mutex.Unlock()
+
+	for _, item := range superseded {
+		item.Logger.Printf("Build has been superseded by build %d\n", b.ID)
+		go item.SetBuildStatus(StatusSuperseded)
+	}
+	for _, item := range toAbort {
+		item.Logger.Printf("Aborting the build, superseded by build %d\n", b.ID)
+		go func(id int) {
+			err := q.Abort(id)
+			if err != nil {
+				Logger.Println(err)
+			}
+		}(item.ID)
+	}
+	if len(superseded) > 0 {
+		q.BroadcastUpdate()
+	}
+}
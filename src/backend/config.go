@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -19,8 +21,35 @@ type WakeConfig struct {
 	WorkDir string `yaml:"workdir"`
 	// Configuration directory - all your job files
 	JobDir string `yaml:"jobdir"`
+	// Queued builds gain 1 priority point every PriorityAging, so builds with
+	// low priority are not starved by a stream of high priority builds.
+	// Disabled if empty or 0
+	PriorityAging string `yaml:"priority_aging"`
+	// Builds which are waiting longer than StarvationTimeout reserve an
+	// executor, so newer builds can't overtake them. Disabled if empty or 0
+	StarvationTimeout string `yaml:"starvation_timeout"`
+	// Token which is required to access /metrics. If it is not set, only
+	// local requests are allowed
+	MetricsToken string `yaml:"metrics_token"`
+	// Notification channels which are used by `notify` key of jobs
+	Notifiers map[string]*NotifierConfig `yaml:"notifiers"`
+	// URLs which receive events about builds, see Event
+	EventHooks []*EventHookConfig `yaml:"event_hooks"`
+	// Maximum size of the log of a task, e.g. 100M. Logs which exceed it are
+	// truncated. 0 disables the limit
+	TaskLogLimit string `yaml:"task_log_limit"`
+	// Maximum size of logs of all tasks of a build
+	BuildLogLimit string `yaml:"build_log_limit"`
 	// Job files extension
 	jobsExt string
+	// Parsed PriorityAging
+	priorityAging time.Duration
+	// Parsed StarvationTimeout
+	starvationTimeout time.Duration
+	// Parsed TaskLogLimit in bytes
+	taskLogLimit int64
+	// Parsed BuildLogLimit in bytes
+	buildLogLimit int64
 }
 
 // CreateWakeConfig creates new config instance
@@ -57,6 +86,14 @@ func CreateWakeConfig(path string) (*WakeConfig, error) {
 		config.JobDir = "./"
 	}
 
+	if config.TaskLogLimit == "" {
+		config.TaskLogLimit = "100M"
+	}
+
+	if config.BuildLogLimit == "" {
+		config.BuildLogLimit = "500M"
+	}
+
 	config.jobsExt = ".yaml"
 
 	// Clean up the config object
@@ -71,6 +108,57 @@ func CreateWakeConfig(path string) (*WakeConfig, error) {
 	if !filepath.IsAbs(config.JobDir) {
 		config.JobDir = filepath.Join(cwd, config.JobDir) + "/"
 	}
-	Logger.Printf("Current config: %+v\n", config)
+
+	// Aging and reservation of executors are disabled by default
+	if config.PriorityAging != "" {
+		config.priorityAging, err = time.ParseDuration(config.PriorityAging)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.StarvationTimeout != "" {
+		config.starvationTimeout, err = time.ParseDuration(config.StarvationTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config.taskLogLimit, err = ParseSize(config.TaskLogLimit)
+	if err != nil {
+		return nil, fmt.Errorf("task_log_limit: %s", err.Error())
+	}
+
+	config.buildLogLimit, err = ParseSize(config.BuildLogLimit)
+	if err != nil {
+		return nil, fmt.Errorf("build_log_limit: %s", err.Error())
+	}
+	for name, notifier := range config.Notifiers {
+		err = notifier.Verify(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hook := range config.EventHooks {
+		err = hook.Verify()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	printable := config
+	if printable.MetricsToken != "" {
+		printable.MetricsToken = "***"
+	}
+	Logger.Printf("Current config: %+v\n", printable)
 	return &config, nil
 }
+
+// GetServiceURL returns URL of the service, e.g. https://myci.space/
+func GetServiceURL() string {
+	if Config.Port == "443" {
+		return fmt.Sprintf("https://%s/", Config.Hostname)
+	}
+	return fmt.Sprintf("http://localhost:%s/", Config.Port)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar"
+	bolt "go.etcd.io/bbolt"
+)
+
+// MaxCoverageHistory is the maximum number of builds in the coverage trend
+// of the job
+const MaxCoverageHistory = 100
+
+// JobCoverage describes where coverage reports of the job are and what
+// coverage is acceptable
+type JobCoverage struct {
+	Files            []string `yaml:"files" json:"files"`
+	Threshold        float64  `yaml:"threshold" json:"threshold"`
+	FailOnRegression bool     `yaml:"fail_on_regression" json:"failOnRegression"`
+	RegressionMargin float64  `yaml:"regression_margin" json:"regressionMargin"`
+}
+
+// UnmarshalYAML allows to specify coverage as a list of files
+func (c *JobCoverage) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var files []string
+	err := unmarshal(&files)
+	if err == nil {
+		c.Files = files
+		return nil
+	}
+
+	type plainCoverage JobCoverage
+	var pc plainCoverage
+	err = unmarshal(&pc)
+	if err != nil {
+		return err
+	}
+	if len(pc.Files) == 0 {
+		return fmt.Errorf("coverage files are required")
+	}
+	if pc.Threshold < 0 || pc.Threshold > 100 {
+		return fmt.Errorf("invalid coverage threshold %v", pc.Threshold)
+	}
+	*c = JobCoverage(pc)
+	return nil
+}
+
+// BuildCoverage is the coverage of the build, percentages are from 0 to 100
+type BuildCoverage struct {
+	BuildID   int                `json:"buildID"`
+	Job       string             `json:"job"`
+	Status    ItemStatus         `json:"status"`
+	Total     float64            `json:"total"`
+	Packages  map[string]float64 `json:"packages"`
+	Files     []string           `json:"files"`
+	Error     string             `json:"error"`
+	CreatedAt time.Time          `json:"createdAt"`
+}
+
+// coverageCounter counts covered and total lines (or statements) per package
+type coverageCounter map[string]*[2]int
+
+func (cc coverageCounter) add(pkg string, covered int, total int) {
+	if _, ok := cc[pkg]; !ok {
+		cc[pkg] = &[2]int{}
+	}
+	cc[pkg][0] += covered
+	cc[pkg][1] += total
+}
+
+// CollectCoverage parses coverage reports from the workspace, verifies them
+// against the job's requirements and saves them. mainStatus is the status of
+// the build after main tasks. Returns an error when coverage is not acceptable
+func (b *Build) CollectCoverage(mainStatus ItemStatus) error {
+	if b.Job.Coverage == nil {
+		return nil
+	}
+	counter := coverageCounter{}
+	var files []string
+	for _, covPattern := range b.Job.Coverage.Files {
+		matches, err := doublestar.Glob(b.GetWorkspaceDir() + covPattern)
+		if err != nil {
+			b.Logger.Println(err)
+			continue
+		}
+		for _, f := range matches {
+			fi, err := os.Stat(f)
+			if err != nil {
+				b.Logger.Println(err)
+				continue
+			}
+			if fi.IsDir() {
+				continue
+			}
+			relPath := strings.TrimPrefix(f, b.GetWorkspaceDir())
+			b.Logger.Printf("Parsing coverage report %s...\n", relPath)
+			err = parseCoverageReport(f, b.GetWorkspaceDir(), counter)
+			if err != nil {
+				b.Logger.Printf("Unable to parse %s: %s\n", relPath, err.Error())
+				continue
+			}
+			files = append(files, relPath)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	coverage := BuildCoverage{
+		BuildID:   b.ID,
+		Job:       b.Job.Name,
+		Status:    mainStatus,
+		Packages:  map[string]float64{},
+		Files:     files,
+		CreatedAt: time.Now(),
+	}
+	var covered, total int
+	for pkg, c := range counter {
+		coverage.Packages[pkg] = coveragePercent(c[0], c[1])
+		covered += c[0]
+		total += c[1]
+	}
+	coverage.Total = coveragePercent(covered, total)
+	b.Logger.Printf("Coverage: %v%%\n", coverage.Total)
+
+	var checkErr error
+	if mainStatus == StatusFinished {
+		checkErr = b.checkCoverage(&coverage)
+		if checkErr != nil {
+			coverage.Status = StatusFailed
+			coverage.Error = checkErr.Error()
+			b.Logger.Println(checkErr)
+			// All tasks have succeeded, so the reason is shown in the summary
+			b.addSummaryNote("**Coverage check failed:** " + checkErr.Error())
+		}
+	}
+
+	err := DB.Update(func(tx *bolt.Tx) error {
+		dataB, err := json.Marshal(coverage)
+		if err != nil {
+			return err
+		}
+		jb, err := tx.Bucket(CoverageBucket).CreateBucketIfNotExists([]byte(b.Job.Name))
+		if err != nil {
+			return err
+		}
+		return jb.Put(Itob(b.ID), dataB)
+	})
+	if err != nil {
+		b.Logger.Println(err)
+	}
+	return checkErr
+}
+
+// checkCoverage verifies the threshold and compares coverage with the
+// previous successful build of the job
+func (b *Build) checkCoverage(coverage *BuildCoverage) error {
+	if coverage.Total < b.Job.Coverage.Threshold {
+		return fmt.Errorf("coverage %v%% is below threshold %v%%", coverage.Total, b.Job.Coverage.Threshold)
+	}
+	if !b.Job.Coverage.FailOnRegression {
+		return nil
+	}
+	previous, err := GetJobCoverage(b.Job.Name, b.ID, 1, true)
+	if err != nil {
+		return err
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	if coverage.Total+b.Job.Coverage.RegressionMargin < previous[0].Total {
+		return fmt.Errorf("coverage %v%% is lower than %v%% of build %d", coverage.Total, previous[0].Total, previous[0].BuildID)
+	}
+	return nil
+}
+
+// GetJobCoverage returns coverage of the last builds of the job which are
+// older than beforeID (0 means any build). Result is sorted from the newest
+// to the oldest build
+func GetJobCoverage(jobName string, beforeID int, last int, onlySuccessful bool) ([]*BuildCoverage, error) {
+	var result []*BuildCoverage
+	err := DB.View(func(tx *bolt.Tx) error {
+		jb := tx.Bucket(CoverageBucket).Bucket([]byte(jobName))
+		if jb == nil {
+			return nil
+		}
+		c := jb.Cursor()
+		var key, value []byte
+		if beforeID > 0 {
+			key, value = c.Seek(Itob(beforeID))
+			if key == nil {
+				key, value = c.Last()
+			} else {
+				key, value = c.Prev()
+			}
+		} else {
+			key, value = c.Last()
+		}
+		for ; key != nil && len(result) < last; key, value = c.Prev() {
+			var coverage BuildCoverage
+			err := json.Unmarshal(value, &coverage)
+			if err != nil {
+				return err
+			}
+			if onlySuccessful && coverage.Status != StatusFinished {
+				continue
+			}
+			result = append(result, &coverage)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// getBuildCoverage returns coverage of the build from the bucket of its job
+// or nil
+func getBuildCoverage(tx *bolt.Tx, buildID int) []byte {
+	var data []byte
+	c := tx.Bucket(CoverageBucket).Cursor()
+	for key, value := c.First(); key != nil && data == nil; key, value = c.Next() {
+		// Only nested buckets of jobs are stored
+		if value != nil {
+			continue
+		}
+		data = tx.Bucket(CoverageBucket).Bucket(key).Get(Itob(buildID))
+	}
+	return data
+}
+
+// deleteBuildCoverage removes coverage of the build from the bucket of its
+// job
+func deleteBuildCoverage(tx *bolt.Tx, buildID int) error {
+	cb := tx.Bucket(CoverageBucket)
+	return cb.ForEach(func(key, value []byte) error {
+		if value != nil {
+			return nil
+		}
+		return cb.Bucket(key).Delete(Itob(buildID))
+	})
+}
+
+func coveragePercent(covered int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(covered)*10000/float64(total)) / 100
+}
+
+// parseCoverageReport detects the format of the report (Go coverprofile,
+// Cobertura XML or LCOV) and adds its data to the counter
+func parseCoverageReport(filename string, workspace string, counter coverageCounter) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("mode:")):
+		return parseGoCoverage(data, counter)
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return parseCoberturaCoverage(data, counter)
+	case bytes.Contains(trimmed, []byte("SF:")):
+		return parseLCOVCoverage(data, workspace, counter)
+	}
+	return fmt.Errorf("unknown coverage format")
+}
+
+// parseGoCoverage parses output of `go test -coverprofile`. Blocks which are
+// present several times (merged profiles) are counted once
+func parseGoCoverage(data []byte, counter coverageCounter) error {
+	type block struct {
+		pkg     string
+		stmts   int
+		covered bool
+	}
+	blocks := map[string]*block{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+		// name.go:line.column,line.column numberOfStatements count
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !strings.Contains(fields[0], ":") {
+			return fmt.Errorf("invalid line: %s", line)
+		}
+		stmts, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return err
+		}
+		bl, ok := blocks[fields[0]]
+		if !ok {
+			file := fields[0][:strings.LastIndex(fields[0], ":")]
+			bl = &block{pkg: path.Dir(file), stmts: stmts}
+			blocks[fields[0]] = bl
+		}
+		bl.covered = bl.covered || count > 0
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, bl := range blocks {
+		if bl.covered {
+			counter.add(bl.pkg, bl.stmts, bl.stmts)
+		} else {
+			counter.add(bl.pkg, 0, bl.stmts)
+		}
+	}
+	return nil
+}
+
+type coberturaReport struct {
+	Packages []struct {
+		Name    string `xml:"name,attr"`
+		Classes []struct {
+			Lines []struct {
+				Hits int `xml:"hits,attr"`
+			} `xml:"lines>line"`
+		} `xml:"classes>class"`
+	} `xml:"packages>package"`
+}
+
+func parseCoberturaCoverage(data []byte, counter coverageCounter) error {
+	var report coberturaReport
+	err := xml.Unmarshal(data, &report)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range report.Packages {
+		var covered, total int
+		for _, class := range pkg.Classes {
+			for _, line := range class.Lines {
+				total++
+				if line.Hits > 0 {
+					covered++
+				}
+			}
+		}
+		counter.add(pkg.Name, covered, total)
+	}
+	return nil
+}
+
+// parseLCOVCoverage parses LCOV tracefile, the package is the directory of
+// the source file
+func parseLCOVCoverage(data []byte, workspace string, counter coverageCounter) error {
+	var pkg string
+	var found, hit int
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			pkg = path.Dir(strings.TrimPrefix(strings.TrimPrefix(line, "SF:"), workspace))
+			found, hit = 0, 0
+		case strings.HasPrefix(line, "DA:"):
+			// DA:<line number>,<execution count>[,<checksum>]
+			fields := strings.Split(strings.TrimPrefix(line, "DA:"), ",")
+			if len(fields) < 2 {
+				return fmt.Errorf("invalid line: %s", line)
+			}
+			found++
+			if fields[1] != "0" {
+				hit++
+			}
+		case line == "end_of_record":
+			counter.add(pkg, hit, found)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseCoverageReport(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		expected map[string][2]int
+		err      bool
+	}{
+		{
+			name: "go coverprofile",
+			data: `mode: set
+example.com/pkg/a.go:1.1,3.2 2 1
+example.com/pkg/a.go:5.1,7.2 3 0
+example.com/pkg/sub/b.go:1.1,2.2 4 0
+`,
+			expected: map[string][2]int{"example.com/pkg": {2, 5}, "example.com/pkg/sub": {0, 4}},
+		},
+		{
+			name: "merged go coverprofiles",
+			data: `mode: count
+example.com/pkg/a.go:1.1,3.2 2 0
+example.com/pkg/a.go:5.1,7.2 3 0
+mode: count
+example.com/pkg/a.go:1.1,3.2 2 5
+example.com/pkg/a.go:5.1,7.2 3 0
+`,
+			expected: map[string][2]int{"example.com/pkg": {2, 5}},
+		},
+		{
+			name: "invalid go coverprofile",
+			data: "mode: set\nexample.com/pkg/a.go 2 1\n",
+			err:  true,
+		},
+		{
+			name: "cobertura",
+			data: `<?xml version="1.0"?>
+<coverage>
+  <packages>
+    <package name="app">
+      <classes>
+        <class><lines><line hits="1"/><line hits="0"/></lines></class>
+        <class><lines><line hits="3"/></lines></class>
+      </classes>
+    </package>
+    <package name="app.utils">
+      <classes>
+        <class><lines><line hits="0"/></lines></class>
+      </classes>
+    </package>
+  </packages>
+</coverage>`,
+			expected: map[string][2]int{"app": {2, 3}, "app.utils": {0, 1}},
+		},
+		{
+			name: "lcov",
+			data: `TN:
+SF:/workspace/src/a.js
+DA:1,1
+DA:2,0
+DA:3,5,abc
+end_of_record
+SF:/workspace/src/b.js
+DA:1,0
+end_of_record
+SF:/workspace/lib/c.js
+DA:1,1
+end_of_record
+`,
+			expected: map[string][2]int{"src": {2, 4}, "lib": {1, 1}},
+		},
+		{
+			name: "invalid lcov",
+			data: "SF:/workspace/a.js\nDA:1\nend_of_record\n",
+			err:  true,
+		},
+		{
+			name: "unknown format",
+			data: "coverage: 100%\n",
+			err:  true,
+		},
+	}
+	dir := t.TempDir()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			filename := filepath.Join(dir, "coverage.out")
+			err := ioutil.WriteFile(filename, []byte(c.data), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counter := coverageCounter{}
+			err = parseCoverageReport(filename, "/workspace/", counter)
+			if c.err {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string][2]int{}
+			for pkg, counts := range counter {
+				got[pkg] = *counts
+			}
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestCoveragePercent(t *testing.T) {
+	cases := []struct {
+		covered  int
+		total    int
+		expected float64
+	}{
+		{0, 0, 0},
+		{0, 10, 0},
+		{10, 10, 100},
+		{1, 3, 33.33},
+		{2, 3, 66.67},
+	}
+	for _, c := range cases {
+		got := coveragePercent(c.covered, c.total)
+		if got != c.expected {
+			t.Errorf("coveragePercent(%d, %d): expected %v, got %v", c.covered, c.total, c.expected, got)
+		}
+	}
+}
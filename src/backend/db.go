@@ -13,9 +13,12 @@ import (
 // JobsBucket contains all registered jobs
 // Schema (key is the name of the file):
 // | defaultParams | null    |
+// | params        | null    |
 // | desc          | New job |
 // | interval      |         |
 // | active        | true    |
+// | stats         | bucket  |
+// `stats` contains BuildStatsRecord of every terminal build
 var JobsBucket = []byte("jobs")
 
 // GlobalBucket contains information about global configuration
@@ -25,6 +28,26 @@ var GlobalBucket = []byte("global")
 // HistoryBucket contains information about all executed builds
 var HistoryBucket = []byte("history")
 
+// TestsBucket contains test summaries of builds, see TestSummary
+// Schema (key is the id of the build):
+// | 1 | {"total":...} |
+var TestsBucket = []byte("tests")
+
+// TestHistoryBucket contains the latest results of each test, see TestRun
+// Schema (nested bucket per job, key is the name of the test):
+// | test name | [{"buildID":1,"status":"passed"}] |
+var TestHistoryBucket = []byte("test_history")
+
+// CoverageBucket contains coverage of builds, see BuildCoverage
+// Schema (nested bucket per job, key is the id of the build):
+// | 1 | {"total":80.5,...} |
+var CoverageBucket = []byte("coverage")
+
+// EventsBucket contains the latest events, see Event
+// Schema (key is the sequence number of the event):
+// | 1 | {"seq":1,"type":"build:created",...} |
+var EventsBucket = []byte("events")
+
 // ByteToInt convert byte to int via string
 func ByteToInt(b []byte) (int, error) {
 	bs := string(b)
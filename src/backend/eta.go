@@ -3,81 +3,177 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
-// DurationWindowLength shows how many duration samples are stored to calculate ETA
-const DurationWindowLength = 5
+// ETAHistorySize is the number of the latest finished builds which are used
+// to estimate duration of a build
+const ETAHistorySize = 20
 
-// RecordBuildDuration saves build duration in JobsBucket
-func RecordBuildDuration(jobName string, duration int) error {
-	err := DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(JobsBucket)
-		jb := b.Bucket([]byte(jobName))
-		if jb == nil {
-			return fmt.Errorf("job with name %s is not found in JobsBucket", jobName)
-		}
+// ETAMinSamples is the minimal number of builds with the same values of
+// `eta_params` which are required to use only them for the estimation
+const ETAMinSamples = 3
 
-		// Load duration list
-		durationListByte := jb.Get([]byte("durationList"))
-		var durationList []int
+// ETADecay is the weight of each next older build relative to the newer one
+const ETADecay = 0.8
 
-		json.Unmarshal(durationListByte, &durationList)
+// ETAConfidenceZ is z-score of the confidence interval (90%)
+const ETAConfidenceZ = 1.645
 
-		durationList = append(durationList, duration)
-		// Shift duration list
-		if len(durationList) > DurationWindowLength {
-			durationList = durationList[1:]
-		}
-
-		// Save duration list
-		newListByte, err := json.Marshal(durationList)
-		if err != nil {
-			return err
-		}
-		return jb.Put([]byte("durationList"), newListByte)
-	})
-	return err
+// ETAModel contains estimated durations of a build and its tasks, ns
+type ETAModel struct {
+	Samples  int
+	Duration float64
+	StdDev   float64
+	// Time which is spent outside of main tasks
+	Overhead float64
+	// Keys are kind/name of the task
+	Tasks map[string]float64
 }
 
-// GetJobETA returns ETA for job to complete, s
-func GetJobETA(jobName string) int {
-	var eta int
+// LoadETAModel builds ETAModel from statistics of the latest finished builds
+// of the job. More recent builds have higher weights. If job has `eta_params`,
+// only builds with the same values of these params are used when there are
+// enough of them
+func LoadETAModel(job *Job, params map[string]string) *ETAModel {
+	var all, matching []*BuildStatsRecord
 	err := DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(JobsBucket)
-		jb := b.Bucket([]byte(jobName))
+		jb := tx.Bucket(JobsBucket).Bucket([]byte(job.Name))
 		if jb == nil {
-			return fmt.Errorf("job with name %s is not found in JobsBucket", jobName)
+			return fmt.Errorf("job with name %s is not found in JobsBucket", job.Name)
 		}
-
-		// Load duration list
-		durationListByte := jb.Get([]byte("durationList"))
-		var durationList []int
-
-		err := json.Unmarshal(durationListByte, &durationList)
-		if err != nil {
-			return err
+		sb := jb.Bucket([]byte(StatsBucketName))
+		if sb == nil {
+			return nil
+		}
+		c := sb.Cursor()
+		for key, value := c.Last(); key != nil && len(all) < ETAHistorySize; key, value = c.Prev() {
+			var record BuildStatsRecord
+			err := json.Unmarshal(value, &record)
+			if err != nil {
+				return err
+			}
+			if record.Status != StatusFinished {
+				continue
+			}
+			all = append(all, &record)
+			if len(job.ETAParams) > 0 && record.matchParams(job.ETAParams, params) {
+				matching = append(matching, &record)
+			}
 		}
-
-		eta = calcAvg(&durationList)
 		return nil
 	})
-
 	if err != nil {
 		Logger.Println(err)
+		return nil
+	}
+	if len(matching) >= ETAMinSamples {
+		return calcETAModel(matching)
+	}
+	return calcETAModel(all)
+}
+
+// matchParams verifies if the build had the same values of the params
+func (r *BuildStatsRecord) matchParams(names []string, params map[string]string) bool {
+	for _, name := range names {
+		if r.Params[name] != params[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// calcETAModel calculates weighted mean durations, records are sorted from
+// the newest to the oldest
+func calcETAModel(records []*BuildStatsRecord) *ETAModel {
+	if len(records) == 0 {
+		return nil
+	}
+	model := ETAModel{Samples: len(records), Tasks: map[string]float64{}}
+	taskWeights := map[string]float64{}
+	var weights float64
+	weight := 1.0
+	for _, r := range records {
+		weights += weight
+		model.Duration += weight * float64(r.Duration)
+		overhead := float64(r.Duration)
+		for _, t := range r.Tasks {
+			if t.Kind != KindMain {
+				continue
+			}
+			key := t.Kind + "/" + t.Name
+			model.Tasks[key] += weight * float64(t.Duration)
+			taskWeights[key] += weight
+			overhead -= float64(t.Duration)
+		}
+		if overhead > 0 {
+			model.Overhead += weight * overhead
+		}
+		weight *= ETADecay
+	}
+	model.Duration /= weights
+	model.Overhead /= weights
+	for key := range model.Tasks {
+		model.Tasks[key] /= taskWeights[key]
+	}
+
+	var variance float64
+	weight = 1.0
+	for _, r := range records {
+		variance += weight * math.Pow(float64(r.Duration)-model.Duration, 2)
+		weight *= ETADecay
 	}
-	return eta
+	model.StdDev = math.Sqrt(variance / weights)
+	return &model
 }
 
-func calcAvg(durationList *[]int) int {
-	var eta int
-	var sum int
-	for _, item := range *durationList {
-		sum += item
+// UpdateETA estimates the duration of the build based on its progress. ETA is
+// the total duration of the build, so the remaining time is ETA minus time
+// since the build has started
+func (b *Build) UpdateETA() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.etaModel == nil {
+		return
 	}
-	if len(*durationList) > 0 {
-		eta = sum / len(*durationList)
+
+	var elapsed time.Duration
+	if !b.StartedAt.IsZero() {
+		elapsed = time.Since(b.StartedAt)
+	}
+	remaining := b.etaModel.Overhead
+	for _, t := range b.Job.Tasks {
+		if t.Kind != KindMain {
+			continue
+		}
+		estimate, ok := b.etaModel.Tasks[t.Kind+"/"+t.Name]
+		if !ok {
+			continue
+		}
+		switch t.Status {
+		case StatusPending:
+			remaining += estimate
+		case StatusRunning:
+			remaining += math.Max(estimate-float64(time.Since(t.startedAt)), 0)
+		}
 	}
-	return eta
+
+	// Uncertainty decreases as the build progresses
+	spread := 0.0
+	if b.etaModel.Duration > 0 {
+		spread = ETAConfidenceZ * b.etaModel.StdDev * math.Min(remaining/b.etaModel.Duration, 1)
+	}
+	b.ETA = int(elapsed) + int(remaining)
+	b.ETALow = int(elapsed) + int(math.Max(remaining-spread, 0))
+	b.ETAHigh = int(elapsed) + int(remaining+spread)
+}
+
+// getETA returns ETA of the build
+func (b *Build) getETA() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.ETA
 }
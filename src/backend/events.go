@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sasha-s/go-deadlock"
+	bolt "go.etcd.io/bbolt"
+)
+
+// EventSchemaVersion is the version of Event format. It changes only when
+// fields are removed or their meaning changes
+const EventSchemaVersion = 1
+
+// Types of events
+const (
+	EventBuildCreated   = "build:created"
+	EventBuildStatus    = "build:status"
+	EventTaskStatus     = "task:status"
+	EventBuildArtifacts = "build:artifacts"
+)
+
+// MaxStoredEvents is the number of the latest events which are kept in
+// EventsBucket for replay
+const MaxStoredEvents = 10000
+
+// EventSubscriberBufferSize is the number of events which wait for delivery
+// to a stream subscriber. Slow subscribers are disconnected and should
+// resume from the last received sequence number
+const EventSubscriberBufferSize = 256
+
+// EventKeepAlivePeriod is how often a comment is sent to idle event streams
+const EventKeepAlivePeriod = 30 * time.Second
+
+// Event describes a change of a build. It is sent to event streams and event
+// hooks
+type Event struct {
+	Seq       uint64              `json:"seq"`
+	Version   int                 `json:"version"`
+	Type      string              `json:"type"`
+	Time      time.Time           `json:"time"`
+	BuildID   int                 `json:"buildID"`
+	Job       string              `json:"job"`
+	Status    ItemStatus          `json:"status"`
+	URL       string              `json:"url"`
+	Params    []map[string]string `json:"params,omitempty"`
+	Task      *EventTask          `json:"task,omitempty"`
+	Artifacts []*ArtifactInfo     `json:"artifacts,omitempty"`
+}
+
+// EventTask describes the task which changed its status
+type EventTask struct {
+	ID       int           `json:"id"`
+	Name     string        `json:"name"`
+	Kind     string        `json:"kind"`
+	Status   ItemStatus    `json:"status"`
+	Duration time.Duration `json:"duration"`
+}
+
+// EventHookConfig describes an URL which receives events
+type EventHookConfig struct {
+	URL string `yaml:"url"`
+	// Additional headers
+	Headers map[string]string `yaml:"headers"`
+	// Types of events, all events by default
+	Events []string `yaml:"events"`
+	// Names of jobs, all jobs by default
+	Jobs []string `yaml:"jobs"`
+	// Key to sign the payload, the signature is sent in X-Wakeci-Signature
+	// header as sha256=<hex encoded HMAC-SHA256>
+	Secret string `yaml:"secret"`
+}
+
+// Verify verifies the configuration of the event hook
+func (eh *EventHookConfig) Verify() error {
+	if eh.URL == "" {
+		return fmt.Errorf("event hook: url is required")
+	}
+	for _, t := range eh.Events {
+		switch t {
+		case EventBuildCreated, EventBuildStatus, EventTaskStatus, EventBuildArtifacts:
+		default:
+			return fmt.Errorf("event hook %s: unknown event %q", eh.URL, t)
+		}
+	}
+	return nil
+}
+
+// EventFilter selects events by type and job. Empty lists match everything
+type EventFilter struct {
+	Types []string
+	Jobs  []string
+}
+
+// Match returns true if the event is selected by the filter
+func (f *EventFilter) Match(event *Event) bool {
+	return matchAny(f.Types, event.Type) && matchAny(f.Jobs, event.Job)
+}
+
+func matchAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// buildSnapshot is the last published state of the build
+type buildSnapshot struct {
+	status    ItemStatus
+	tasks     map[int]ItemStatus
+	artifacts int
+}
+
+// EventBus converts build updates to events, stores them and delivers them
+// to stream subscribers and event hooks
+type EventBus struct {
+	mutex       deadlock.Mutex
+	flushMutex  deadlock.Mutex // Keeps order of the stored and delivered events
+	builds      map[int]*buildSnapshot
+	pending     []*Event // Events which are not stored yet
+	subscribers map[chan *Event]bool
+	hooks       []chan *Event
+	Logger      *log.Logger
+}
+
+// GlobalEvents publishes events about builds
+var GlobalEvents *EventBus
+
+// CreateEventBus creates an event bus and starts delivering events to the
+// hooks from Config
+func CreateEventBus() *EventBus {
+	eb := EventBus{
+		builds:      map[int]*buildSnapshot{},
+		subscribers: map[chan *Event]bool{},
+		Logger:      log.New(os.Stdout, "[events] ", log.Lmicroseconds|log.Lshortfile),
+	}
+	for _, hook := range Config.EventHooks {
+		queue := make(chan *Event, NotificationQueueSize)
+		eb.hooks = append(eb.hooks, queue)
+		go eb.runHook(hook, queue)
+	}
+	return &eb
+}
+
+// PublishBuildUpdate compares the build with its last published state and
+// publishes events about the changes
+func (eb *EventBus) PublishBuildUpdate(b *Build) {
+	b.mutex.Lock()
+	status := b.Status
+	params := b.Job.Params.MaskSecrets(b.Params)
+	artifacts := make([]*ArtifactInfo, len(b.BuildArtifacts))
+	copy(artifacts, b.BuildArtifacts)
+	tasks := make([]*EventTask, 0, len(b.Job.Tasks))
+	for _, t := range b.Job.Tasks {
+		tasks = append(tasks, &EventTask{ID: t.ID, Name: t.Name, Kind: t.Kind, Status: t.Status, Duration: t.duration})
+	}
+	b.mutex.Unlock()
+
+	newEvent := func(eventType string) *Event {
+		return &Event{
+			Version: EventSchemaVersion,
+			Type:    eventType,
+			Time:    time.Now(),
+			BuildID: b.ID,
+			Job:     b.Job.Name,
+			Status:  status,
+			URL:     fmt.Sprintf("%sbuild/%d", GetServiceURL(), b.ID),
+		}
+	}
+
+	eb.mutex.Lock()
+	snapshot, ok := eb.builds[b.ID]
+	if !ok {
+		// Completed builds are forgotten after their last update, late
+		// updates would publish their status again
+		switch status {
+		case StatusFinished, StatusFailed, StatusAborted, StatusSuperseded:
+			eb.mutex.Unlock()
+			return
+		}
+		snapshot = &buildSnapshot{tasks: map[int]ItemStatus{}}
+		for _, t := range tasks {
+			snapshot.tasks[t.ID] = t.Status
+		}
+		eb.builds[b.ID] = snapshot
+		// A build which is not pending was created before the snapshot was
+		// lost, only its changes are published
+		if status == StatusPending {
+			snapshot.status = status
+			event := newEvent(EventBuildCreated)
+			event.Params = params
+			eb.pending = append(eb.pending, event)
+		}
+	}
+	for _, t := range tasks {
+		if snapshot.tasks[t.ID] == t.Status {
+			continue
+		}
+		snapshot.tasks[t.ID] = t.Status
+		event := newEvent(EventTaskStatus)
+		event.Task = t
+		eb.pending = append(eb.pending, event)
+	}
+	if len(artifacts) > snapshot.artifacts {
+		snapshot.artifacts = len(artifacts)
+		event := newEvent(EventBuildArtifacts)
+		event.Artifacts = artifacts
+		eb.pending = append(eb.pending, event)
+	}
+	if snapshot.status != status {
+		snapshot.status = status
+		eb.pending = append(eb.pending, newEvent(EventBuildStatus))
+	}
+	eb.mutex.Unlock()
+
+	eb.flush()
+}
+
+// Forget removes the last published state of the build. It is called after
+// the last update of a completed build
+func (eb *EventBus) Forget(id int) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	delete(eb.builds, id)
+}
+
+// flush stores all pending events in one transaction and delivers them.
+// Events of concurrent updates are flushed by whoever gets flushMutex first
+func (eb *EventBus) flush() {
+	eb.flushMutex.Lock()
+	defer eb.flushMutex.Unlock()
+
+	eb.mutex.Lock()
+	events := eb.pending
+	eb.pending = nil
+	eb.mutex.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	err := DB.Update(func(tx *bolt.Tx) error {
+		evb := tx.Bucket(EventsBucket)
+		var seq uint64
+		for _, event := range events {
+			var err error
+			seq, err = evb.NextSequence()
+			if err != nil {
+				return err
+			}
+			event.Seq = seq
+			dataB, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			err = evb.Put(Itob(int(seq)), dataB)
+			if err != nil {
+				return err
+			}
+		}
+		// Remove the oldest events
+		if seq > MaxStoredEvents {
+			c := evb.Cursor()
+			for key, _ := c.First(); key != nil && binary.BigEndian.Uint64(key) <= seq-MaxStoredEvents; key, _ = c.First() {
+				err := c.Delete()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		eb.Logger.Println(err)
+		return
+	}
+
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	for _, event := range events {
+		for sub := range eb.subscribers {
+			select {
+			case sub <- event:
+			default:
+				eb.Logger.Println("Subscriber is too slow, disconnecting")
+				delete(eb.subscribers, sub)
+				close(sub)
+			}
+		}
+		for _, queue := range eb.hooks {
+			select {
+			case queue <- event:
+			default:
+				eb.Logger.Printf("Queue is full, dropping event %d\n", event.Seq)
+			}
+		}
+	}
+}
+
+// Subscribe returns a channel which receives all new events. The channel is
+// closed when the subscriber is too slow
+func (eb *EventBus) Subscribe() chan *Event {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	sub := make(chan *Event, EventSubscriberBufferSize)
+	eb.subscribers[sub] = true
+	return sub
+}
+
+// Unsubscribe stops delivering events to the channel
+func (eb *EventBus) Unsubscribe(sub chan *Event) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	if _, ok := eb.subscribers[sub]; ok {
+		delete(eb.subscribers, sub)
+		close(sub)
+	}
+}
+
+// GetEvents returns stored events with sequence number greater than since
+func GetEvents(since uint64) ([]*Event, error) {
+	var events []*Event
+	err := DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(EventsBucket).Cursor()
+		for key, value := c.Seek(Itob(int(since + 1))); key != nil; key, value = c.Next() {
+			var event Event
+			err := json.Unmarshal(value, &event)
+			if err != nil {
+				return err
+			}
+			events = append(events, &event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+func (eb *EventBus) runHook(hook *EventHookConfig, queue chan *Event) {
+	filter := EventFilter{Types: hook.Events, Jobs: hook.Jobs}
+	for event := range queue {
+		if !filter.Match(event) {
+			continue
+		}
+		var err error
+		for attempt := 1; attempt <= StatusReportRetries; attempt++ {
+			err = hook.send(event)
+			if err == nil {
+				break
+			}
+			eb.Logger.Printf("Event %d: attempt %d to deliver to %s failed: %s\n", event.Seq, attempt, hook.URL, err.Error())
+			if attempt < StatusReportRetries {
+				time.Sleep(time.Duration(attempt*attempt) * time.Second)
+			}
+		}
+	}
+}
+
+// send posts the event to the hook
+func (eh *EventHookConfig) send(event *Event) error {
+	payloadB, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, eh.URL, bytes.NewReader(payloadB))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Wakeci-Event", event.Type)
+	req.Header.Set("X-Wakeci-Delivery", fmt.Sprint(event.Seq))
+	for key, value := range eh.Headers {
+		req.Header.Set(key, value)
+	}
+	if eh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(eh.Secret))
+		mac.Write(payloadB)
+		req.Header.Set("X-Wakeci-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := http.Client{Timeout: NotificationTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// writeSSE writes the event in Server-Sent Events format
+func writeSSE(w io.Writer, event *Event) error {
+	dataB, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, dataB)
+	return err
+}
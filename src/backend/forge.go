@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Types of forges which receive commit statuses
+const (
+	ForgeGitea  = "gitea"
+	ForgeGitHub = "github"
+)
+
+// States of a commit status
+const (
+	CommitStatePending = "pending"
+	CommitStateSuccess = "success"
+	CommitStateFailure = "failure"
+	CommitStateError   = "error"
+)
+
+// GitHubAPIURL is the API of github.com
+const GitHubAPIURL = "https://api.github.com"
+
+// StatusReportRetries is the number of attempts to deliver a commit status
+const StatusReportRetries = 3
+
+// StatusReporter sets commit statuses in a forge
+type StatusReporter interface {
+	ReportStatus(status *CommitStatus) error
+}
+
+// StatusReporterFactory creates a reporter which uses the forge at baseURL.
+// An empty baseURL means the public instance of the forge
+type StatusReporterFactory func(baseURL string, token string) (StatusReporter, error)
+
+// StatusReporters contains factories of reporters by forge type
+var StatusReporters = map[string]StatusReporterFactory{
+	ForgeGitea:  newGiteaReporter,
+	ForgeGitHub: newGitHubReporter,
+}
+
+// CommitStatus is a status of the commit in the forge
+type CommitStatus struct {
+	BuildID     int    `json:"-"`
+	Repo        string `json:"-"`
+	SHA         string `json:"-"`
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+// JobStatusReport describes where the job reports statuses of its builds
+type JobStatusReport struct {
+	Forge string `yaml:"forge" json:"forge"`
+	// Base URL of the forge, e.g. https://gitea.example.com
+	URL string `yaml:"url" json:"url"`
+	// Repository in owner/name format
+	Repo string `yaml:"repo" json:"repo"`
+	// Name of the param which contains the commit SHA
+	SHA string `yaml:"sha" json:"sha"`
+	// Name of the secret param which contains the access token
+	Token string `yaml:"token" json:"token"`
+	// Name of the status in the forge, wakeci/<job name> by default
+	Context string `yaml:"context" json:"context"`
+}
+
+// Verify verifies the configuration against params of the job
+func (rs *JobStatusReport) Verify(job *Job) error {
+	if _, ok := StatusReporters[rs.Forge]; !ok {
+		return fmt.Errorf("report_status: unknown forge %q", rs.Forge)
+	}
+	if rs.Forge == ForgeGitea && rs.URL == "" {
+		return fmt.Errorf("report_status: url is required")
+	}
+	if strings.Count(rs.Repo, "/") != 1 {
+		return fmt.Errorf("report_status: repo must be in owner/name format")
+	}
+	if job.Params.Get(rs.SHA) == nil {
+		return fmt.Errorf("report_status: unknown param %s in sha", rs.SHA)
+	}
+	p := job.Params.Get(rs.Token)
+	if p == nil {
+		return fmt.Errorf("report_status: unknown param %s in token", rs.Token)
+	}
+	if !p.Secret {
+		return fmt.Errorf("report_status: param %s must be secret", rs.Token)
+	}
+	return nil
+}
+
+// getCommitState converts status of the build to the state of the commit.
+// Returns empty string if the status is not reported
+func getCommitState(status ItemStatus) (string, string) {
+	switch status {
+	case StatusPending:
+		return CommitStatePending, "The build is queued"
+	case StatusWaiting:
+		return CommitStatePending, "The build is waiting for approval"
+	case StatusRunning:
+		return CommitStatePending, "The build is running"
+	case StatusFinished:
+		return CommitStateSuccess, "The build has finished"
+	case StatusFailed:
+		return CommitStateFailure, "The build has failed"
+	case StatusAborted:
+		return CommitStateError, "The build was aborted"
+	case StatusSuperseded:
+		return CommitStateError, "The build was superseded"
+	}
+	return "", ""
+}
+
+// reportStatus sends the status of the build to the forge
+func (b *Build) reportStatus(status ItemStatus) {
+	rs := b.Job.ReportStatus
+	if rs == nil || GlobalNotifier == nil {
+		return
+	}
+	state, desc := getCommitState(status)
+	if state == "" {
+		return
+	}
+	values := map[string]string{}
+	b.mutex.Lock()
+	for _, item := range b.Params {
+		for pkey, pval := range item {
+			values[pkey] = pval
+		}
+	}
+	b.mutex.Unlock()
+	if values[rs.SHA] == "" {
+		b.Logger.Printf("Commit status is not reported: param %s is empty\n", rs.SHA)
+		return
+	}
+	context := rs.Context
+	if context == "" {
+		context = "wakeci/" + b.Job.Name
+	}
+	reporter, err := StatusReporters[rs.Forge](rs.URL, values[rs.Token])
+	if err != nil {
+		b.Logger.Println(err)
+		return
+	}
+	GlobalNotifier.ReportStatus(reporter, &CommitStatus{
+		BuildID:     b.ID,
+		Repo:        rs.Repo,
+		SHA:         values[rs.SHA],
+		State:       state,
+		TargetURL:   fmt.Sprintf("%sbuild/%d", GetServiceURL(), b.ID),
+		Description: desc,
+		Context:     context,
+	})
+}
+
+// forgeReporter posts statuses to /repos/{owner}/{repo}/statuses/{sha}
+// endpoint which is the same in Gitea and GitHub
+type forgeReporter struct {
+	apiURL string
+	token  string
+}
+
+func newGiteaReporter(baseURL string, token string) (StatusReporter, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("url of gitea is required")
+	}
+	return &forgeReporter{apiURL: strings.TrimSuffix(baseURL, "/") + "/api/v1", token: token}, nil
+}
+
+// newGitHubReporter creates a reporter for github.com or GitHub Enterprise
+func newGitHubReporter(baseURL string, token string) (StatusReporter, error) {
+	apiURL := GitHubAPIURL
+	if baseURL != "" && baseURL != "https://github.com" {
+		apiURL = strings.TrimSuffix(baseURL, "/") + "/api/v3"
+	}
+	return &forgeReporter{apiURL: apiURL, token: token}, nil
+}
+
+// ReportStatus creates the commit status
+func (fr *forgeReporter) ReportStatus(status *CommitStatus) error {
+	owner := status.Repo[:strings.Index(status.Repo, "/")]
+	repo := status.Repo[len(owner)+1:]
+	endpoint := fmt.Sprintf(
+		"%s/repos/%s/%s/statuses/%s",
+		fr.apiURL, url.PathEscape(owner), url.PathEscape(repo), url.PathEscape(status.SHA),
+	)
+	payloadB, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payloadB))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if fr.token != "" {
+		req.Header.Set("Authorization", "token "+fr.token)
+	}
+	client := http.Client{Timeout: NotificationTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// statusReport is a commit status which should be delivered by the reporter
+type statusReport struct {
+	reporter StatusReporter
+	status   *CommitStatus
+}
+
+// ReportStatus puts the commit status in the delivery queue. Statuses are
+// delivered one by one, so the forge receives them in order
+func (n *Notifier) ReportStatus(reporter StatusReporter, status *CommitStatus) {
+	select {
+	case n.statuses <- &statusReport{reporter: reporter, status: status}:
+	default:
+		n.Logger.Printf("Queue is full, dropping commit status of build %d\n", status.BuildID)
+	}
+}
+
+func (n *Notifier) runStatusReports() {
+	for item := range n.statuses {
+		var err error
+		for attempt := 1; attempt <= StatusReportRetries; attempt++ {
+			err = item.reporter.ReportStatus(item.status)
+			if err == nil {
+				n.Logger.Printf("Build %d: commit status %s reported to %s\n", item.status.BuildID, item.status.State, item.status.Repo)
+				break
+			}
+			n.Logger.Printf("Build %d: attempt %d to report commit status failed: %s\n", item.status.BuildID, attempt, err.Error())
+			if attempt < StatusReportRetries {
+				time.Sleep(time.Duration(attempt*attempt) * time.Second)
+			}
+		}
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"archive/zip"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	bolt "go.etcd.io/bbolt"
@@ -32,7 +36,22 @@ func HandleRunJob(w http.ResponseWriter, r *http.Request) {
 	build, err := RunJob(chi.URLParam(r, "name"), r.Form)
 	if err != nil {
 		logger.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		var verr *ParamsValidationError
+		if errors.As(err, &verr) {
+			payloadB, err := json.Marshal(verr)
+			if err == nil {
+				w.Header().Set("content-type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(payloadB)
+				return
+			}
+		}
+		var qerr *QueueFullError
+		if errors.As(err, &qerr) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
 		w.Write([]byte(err.Error()))
 		return
 	}
@@ -63,7 +82,7 @@ func HandleGetBuild(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	job, err := CreateJobFromFile(buildConfigFilename)
+	job, err := CreateJobFromBuildFile(buildConfigFilename)
 	if err != nil {
 		logger.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -139,6 +158,7 @@ func HandleFeedView(w http.ResponseWriter, r *http.Request) {
 	}
 
 	filter := r.URL.Query().Get("filter")
+	badge := r.URL.Query().Get("badge")
 
 	var payload []*BuildUpdateData
 	err = DB.Update(func(tx *bolt.Tx) error {
@@ -152,7 +172,7 @@ func HandleFeedView(w http.ResponseWriter, r *http.Request) {
 		}
 		// Find starting point
 		fromB := make([]byte, 8)
-		if filter == "" {
+		if filter == "" && badge == "" {
 			binary.BigEndian.PutUint64(fromB, binary.BigEndian.Uint64(lastK)-uint64(offset))
 		} else {
 			// If interval is specified, always iterate from the beginning to take
@@ -166,7 +186,7 @@ func HandleFeedView(w http.ResponseWriter, r *http.Request) {
 				logger.Println(err)
 			} else {
 				switch msg.Status {
-				case StatusPending, StatusRunning:
+				case StatusPending, StatusRunning, StatusWaiting:
 					if !GlobalQueue.Verify(msg.ID) {
 						msg.Status = StatusAborted
 						updatedB, err := json.Marshal(msg)
@@ -176,8 +196,12 @@ func HandleFeedView(w http.ResponseWriter, r *http.Request) {
 						b.Put(Itob(msg.ID), updatedB)
 					}
 				}
-				if filter != "" {
-					if strings.Contains(fmt.Sprintf("%v %v %v %v", msg.ID, msg.Name, msg.Status, msg.Params), filter) {
+				if filter != "" || badge != "" {
+					matched := filter == "" || strings.Contains(fmt.Sprintf("%v %v %v %v", msg.ID, msg.Name, msg.Status, msg.Params), filter)
+					if badge != "" {
+						matched = matched && msg.Summary.matchBadge(badge)
+					}
+					if matched {
 						count++
 						if count <= offset {
 							continue
@@ -232,12 +256,24 @@ func HandleJobsView(w http.ResponseWriter, r *http.Request) {
 				if err != nil {
 					return err
 				}
+				paramsSchema := jb.Get([]byte("params"))
+				if paramsSchema != nil {
+					err = json.Unmarshal(paramsSchema, &job.Params)
+					if err != nil {
+						return err
+					}
+				}
 				desc := jb.Get([]byte("desc"))
 				job.Desc = string(desc)
 				interval := jb.Get([]byte("interval"))
 				job.Interval = string(interval)
 				active := jb.Get([]byte("active"))
 				job.Active = string(active)
+				stats, err := calcJobStats(jb, job.Name, DefaultStatsWindow)
+				if err != nil {
+					return err
+				}
+				job.Stats = stats.Summary()
 			}
 			data = append(data, &job)
 		}
@@ -259,6 +295,104 @@ func HandleJobsView(w http.ResponseWriter, r *http.Request) {
 	w.Write(payloadB)
 }
 
+// HandleQueueView returns running and queued builds
+func HandleQueueView(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	payloadB, err := json.Marshal(GlobalQueue.GetState())
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(payloadB)
+}
+
+// HandleQueueMove moves a queued build to a new position
+func HandleQueueMove(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	position, err := strconv.Atoi(r.FormValue("position"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = GlobalQueue.Move(id, position)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+}
+
+// HandleQueuePriority changes priority of a queued build
+func HandleQueuePriority(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	priority, err := strconv.Atoi(r.FormValue("priority"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = GlobalQueue.SetPriority(id, priority)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+}
+
+// HandleLocksView returns holders and waiters of all named locks
+func HandleLocksView(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	payloadB, err := json.Marshal(GlobalQueue.GetLocksState())
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(payloadB)
+}
+
 // HandleAbortBuild aborts build
 func HandleAbortBuild(w http.ResponseWriter, r *http.Request) {
 	logger, ok := r.Context().Value(HL).(*log.Logger)
@@ -310,6 +444,8 @@ func HandleSettingsPost(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(err.Error()))
 			return
 		}
+		// Close ws connections which were opened with the old password
+		WSHub.Revalidate()
 	}
 
 	// Number of concurrent builds
@@ -407,6 +543,20 @@ func HandleJobGet(w http.ResponseWriter, r *http.Request) {
 	jd := JobData{
 		Content: string(data),
 	}
+
+	// Params with generated choices, the content of the job is returned even
+	// if it is not valid
+	job, err := CreateJobFromFile(path)
+	if err != nil {
+		logger.Println(err)
+	} else {
+		err = job.Params.ResolveChoices(job.Name)
+		if err != nil {
+			logger.Println(err)
+		}
+		jd.Params = job.Params.Masked()
+	}
+
 	payloadB, err := json.Marshal(jd)
 	if err != nil {
 		logger.Println(err)
@@ -417,6 +567,47 @@ func HandleJobGet(w http.ResponseWriter, r *http.Request) {
 	w.Write(payloadB)
 }
 
+// HandleJobParams returns params of the job with generated choices
+func HandleJobParams(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	path := Config.JobDir + chi.URLParam(r, "name") + Config.jobsExt
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		logger.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	job, err := CreateJobFromFile(path)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = job.Params.ResolveChoices(job.Name)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	payloadB, err := json.Marshal(job.Params.Masked())
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(payloadB)
+}
+
 // HandleJobPost updates content of a specific job
 func HandleJobPost(w http.ResponseWriter, r *http.Request) {
 	logger, ok := r.Context().Value(HL).(*log.Logger)
@@ -438,6 +629,14 @@ func HandleJobPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = job.Verify()
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
 	// Verify provided interval
 	err = job.verifyInterval()
 	if err != nil {
@@ -605,6 +804,83 @@ func HandleJobSetActive(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(activeStatus))
 }
 
+// HandleRerunBuild creates a new build with the same config and params as
+// the original build. Returns id of the new build
+func HandleRerunBuild(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	build, err := RerunBuild(id, r.FormValue("from_task"))
+	if err != nil {
+		logger.Println(err)
+		var qerr *QueueFullError
+		if errors.As(err, &qerr) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte(strconv.Itoa(build.ID)))
+}
+
+// HandleApproveBuild approves the build which is waiting for approval
+func HandleApproveBuild(w http.ResponseWriter, r *http.Request) {
+	handleApprovalDecision(w, r, ApprovalApproved)
+}
+
+// HandleRejectBuild rejects the build which is waiting for approval
+func HandleRejectBuild(w http.ResponseWriter, r *http.Request) {
+	handleApprovalDecision(w, r, ApprovalRejected)
+}
+
+func handleApprovalDecision(w http.ResponseWriter, r *http.Request, decision string) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// The approver is taken from credentials, so it can't be forged
+	approver, ok := r.Context().Value(AU).(string)
+	if !ok {
+		logger.Println("Approver is unknown")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	err = GlobalQueue.Decide(id, &ApprovalDecision{
+		Decision: decision,
+		Approver: approver,
+		Comment:  r.FormValue("comment"),
+	})
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	logger.Printf("Build %d has been %s by %s\n", id, decision, approver)
+}
+
 // HandleFlushTaskLogs signals to flush logs
 func HandleFlushTaskLogs(w http.ResponseWriter, r *http.Request) {
 	logger, ok := r.Context().Value(HL).(*log.Logger)
@@ -628,3 +904,488 @@ func HandleFlushTaskLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// HandleGetBuildTests returns the test summary of the build
+func HandleGetBuildTests(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	buildID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var payloadB []byte
+	err = DB.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(TestsBucket).Get(Itob(buildID))
+		if data != nil {
+			payloadB = append([]byte{}, data...)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if payloadB == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Test summary not found"))
+		return
+	}
+	w.Write(payloadB)
+}
+
+// HandleGetBuildCoverage returns coverage of the build
+func HandleGetBuildCoverage(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	buildID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var payloadB []byte
+	err = DB.View(func(tx *bolt.Tx) error {
+		data := getBuildCoverage(tx, buildID)
+		if data != nil {
+			payloadB = append([]byte{}, data...)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if payloadB == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Coverage not found"))
+		return
+	}
+	w.Write(payloadB)
+}
+
+// HandleJobCoverage returns coverage of the latest builds of the job, from the
+// oldest to the newest
+func HandleJobCoverage(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	last := 10
+	if lastS := r.URL.Query().Get("last"); lastS != "" {
+		var err error
+		last, err = strconv.Atoi(lastS)
+		if err != nil || last < 1 {
+			errMsg := fmt.Sprintf("Invalid last: %q", lastS)
+			logger.Println(errMsg)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(errMsg))
+			return
+		}
+	}
+
+	if last > MaxCoverageHistory {
+		last = MaxCoverageHistory
+	}
+
+	coverage, err := GetJobCoverage(chi.URLParam(r, "name"), 0, last, false)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	payload := make([]*BuildCoverage, 0, len(coverage))
+	for idx := len(coverage) - 1; idx >= 0; idx-- {
+		payload = append(payload, coverage[idx])
+	}
+	payloadB, err := json.Marshal(payload)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(payloadB)
+}
+
+// HandleJobStats returns statistics of the job's builds
+func HandleJobStats(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	window, err := parseStatsWindow(r.URL.Query().Get("window"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	stats, err := GetJobStats(chi.URLParam(r, "name"), window)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	payloadB, err := json.Marshal(stats)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(payloadB)
+}
+
+// HandleMetrics returns metrics in Prometheus text format
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	GlobalMetrics.Write(w)
+}
+
+// prepareStream sets headers of a response which is written in chunks.
+// Compression and proxies buffer small chunks, so they are disabled
+func prepareStream(w http.ResponseWriter) (http.Flusher, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Streaming is not supported"))
+		return nil, false
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("Content-Encoding", "identity")
+	return flusher, true
+}
+
+// HandleEvents streams events about builds in Server-Sent Events format.
+// Stored events newer than `since` (or Last-Event-ID header) are sent first
+func HandleEvents(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	sinceStr := r.URL.Query().Get("since")
+	if sinceStr == "" {
+		sinceStr = r.Header.Get("Last-Event-ID")
+	}
+	var since uint64
+	if sinceStr != "" {
+		var err error
+		since, err = strconv.ParseUint(sinceStr, 10, 64)
+		if err != nil {
+			logger.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	filter := EventFilter{}
+	if types := r.URL.Query().Get("types"); types != "" {
+		filter.Types = strings.Split(types, ",")
+	}
+	if jobs := r.URL.Query().Get("jobs"); jobs != "" {
+		filter.Jobs = strings.Split(jobs, ",")
+	}
+
+	// Subscribe before reading stored events, so nothing is missed in between
+	sub := GlobalEvents.Subscribe()
+	defer GlobalEvents.Unsubscribe(sub)
+	var stored []*Event
+	if sinceStr != "" {
+		var err error
+		stored, err = GetEvents(since)
+		if err != nil {
+			logger.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	flusher, ok := prepareStream(w)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	// Suggest clients to reconnect after 3 seconds
+	fmt.Fprint(w, "retry: 3000\n\n")
+	last := since
+	for _, event := range stored {
+		last = event.Seq
+		if !filter.Match(event) {
+			continue
+		}
+		err := writeSSE(w, event)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(EventKeepAlivePeriod)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-sub:
+			if !ok {
+				logger.Println("Event stream is closed")
+				return
+			}
+			// Already sent from the stored events
+			if event.Seq <= last || !filter.Match(event) {
+				continue
+			}
+			err := writeSSE(w, event)
+			if err != nil {
+				logger.Println(err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// HandleGetTaskLog returns the log of the task. A part of the log can be
+// selected with offset/limit (bytes), fromLine/toLine and tail. With
+// follow=true new content is streamed until the task is completed. Colors
+// are removed, kept or converted to HTML depending on format
+func HandleGetTaskLog(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	taskID, err := strconv.Atoi(chi.URLParam(r, "task"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	lr, err := ParseLogRange(r)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	format, err := getLogFormat(r)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	follow := r.URL.Query().Get("follow") == "true"
+	if follow && lr.IsBounded() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("follow can't be used with limit and toLine"))
+		return
+	}
+
+	// Logs of running tasks are flushed, so the file has the latest content
+	if tl := GlobalQueue.GetTaskLog(id, taskID); tl != nil {
+		err = tl.Flush()
+		if err != nil {
+			logger.Println(err)
+		}
+	}
+	filename := getTaskLogFilename(id, taskID)
+	size, err := getTaskLogSize(filename)
+	exists := err == nil
+	if err != nil && !(follow && os.IsNotExist(err) && GlobalQueue.Verify(id)) {
+		logger.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if format == LogFormatHTML {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	lf := newLogFormatter(w, format)
+	defer lf.Close()
+	if !follow {
+		// The response ends at the current size even if the task is still
+		// writing, so the size can be used as offset of the next request
+		if lr.Limit == 0 || lr.Offset+lr.Limit > size {
+			lr.Limit = size - lr.Offset
+		}
+		w.Header().Set("X-Log-Size", strconv.FormatInt(size, 10))
+		if lr.Limit <= 0 {
+			return
+		}
+		_, err = lr.WriteTo(lf, filename)
+		if err != nil {
+			logger.Println(err)
+		}
+		return
+	}
+
+	flusher, ok := prepareStream(w)
+	if !ok {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	var pos int64
+	if exists {
+		pos, err = lr.WriteTo(lf, filename)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		flusher.Flush()
+	}
+	err = followTaskLog(r.Context(), lf, flusher, id, taskID, pos)
+	if err != nil {
+		logger.Println(err)
+	}
+}
+
+// HandleSearchBuildLog returns lines of all task logs of the build which
+// match the regular expression q
+func HandleSearchBuildLog(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("q is required"))
+		return
+	}
+	re, err := regexp.Compile(q)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	limit := MaxLogSearchResults
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("limit must be a positive number"))
+			return
+		}
+	}
+
+	taskIDs, err := getTaskLogIDs(id)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Ignore the error, the build may be completed already
+	GlobalQueue.FlushLogs(id)
+	result, err := searchTaskLogs(id, taskIDs, re, limit)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	payloadB, err := json.Marshal(result)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payloadB)
+}
+
+// HandleDownloadBuildLog returns logs of all tasks of the build as a zip
+// archive, colors are removed unless another format is requested
+func HandleDownloadBuildLog(w http.ResponseWriter, r *http.Request) {
+	logger, ok := r.Context().Value(HL).(*log.Logger)
+	if !ok {
+		logger = Logger
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	format, err := getLogFormat(r)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	taskIDs, err := getTaskLogIDs(id)
+	if err != nil {
+		logger.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// Ignore the error, the build may be completed already
+	GlobalQueue.FlushLogs(id)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"build_%d_logs.zip\"", id))
+	zw := zip.NewWriter(w)
+	for _, taskID := range taskIDs {
+		err = addLogToZip(zw, getTaskLogFilename(id, taskID), fmt.Sprintf("task_%d.log", taskID), format)
+		if err != nil {
+			// The response has already started
+			logger.Println(err)
+			return
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		logger.Println(err)
+	}
+}
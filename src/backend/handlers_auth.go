@@ -70,6 +70,8 @@ func HandleLogOut(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			logger.Println(err)
 		}
+		// Close ws connections of the session
+		WSHub.Revalidate()
 	}
 
 	expires, _ := time.Parse(time.RFC3339, "1970-01-01T00:00:00+00:00")
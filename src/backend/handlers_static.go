@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 )
 
@@ -56,6 +57,28 @@ func HandleWakespaceResource(h http.Handler) http.Handler {
 		*r2.URL = *r.URL
 		r2.URL.Path = strings.TrimPrefix(r.URL.Path, "/storage/build/")
 		logger.Printf("storage %s --> %s\n", r.URL.Path, r2.URL.Path)
+
+		// Task logs are stored with colors and compressed when the task is
+		// completed. They are decompressed and colors are removed unless
+		// another format is requested
+		format, err := getLogFormat(r)
+		if err != nil {
+			logger.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if taskLogPathRE.MatchString(r2.URL.Path) {
+			err = serveTaskLog(w, r, Config.WorkDir+"wakespace/"+r2.URL.Path, format)
+			if os.IsNotExist(err) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				logger.Println(err)
+			}
+			return
+		}
 		h.ServeHTTP(w, r2)
 	})
 }
@@ -31,15 +31,24 @@ const KindMain = "main"
 // Job represents Job
 // Default params are stored as params in yaml files
 type Job struct {
-	Name          string              `yaml:"name" json:"name"`
-	Desc          string              `yaml:"desc" json:"desc"`
-	Tasks         []*Task             `yaml:"tasks" json:"tasks"`
-	DefaultParams []map[string]string `yaml:"params" json:"defaultParams"`
-	Artifacts     []string            `yaml:"artifacts" json:"artifacts"`
-	Interval      string              `yaml:"interval" json:"interval"`
-	Timeout       string              `yaml:"timeout" json:"timeout"`
-	AllowParallel bool                `yaml:"allow_parallel"`
-	Priority      int                 `yaml:"priority"`
+	Name             string              `yaml:"name" json:"name"`
+	Desc             string              `yaml:"desc" json:"desc"`
+	Tasks            []*Task             `yaml:"tasks" json:"tasks"`
+	Params           JobParams           `yaml:"params" json:"params"`
+	DefaultParams    []map[string]string `yaml:"-" json:"defaultParams"`
+	Artifacts        []string            `yaml:"artifacts" json:"artifacts"`
+	Reports          []string            `yaml:"reports" json:"reports"`
+	Coverage         *JobCoverage        `yaml:"coverage" json:"coverage"`
+	Interval         string              `yaml:"interval" json:"interval"`
+	Timeout          string              `yaml:"timeout" json:"timeout"`
+	AllowParallel    bool                `yaml:"allow_parallel"`
+	Priority         int                 `yaml:"priority"`
+	MaxQueued        int                 `yaml:"max_queued" json:"maxQueued"`
+	Locks            []*JobLock          `yaml:"locks" json:"locks"`
+	ConcurrencyGroup *ConcurrencyGroup   `yaml:"concurrency_group" json:"concurrencyGroup"`
+	ETAParams        []string            `yaml:"eta_params" json:"etaParams"`
+	Notify           []*JobNotification  `yaml:"notify" json:"notify"`
+	ReportStatus     *JobStatusReport    `yaml:"report_status" json:"reportStatus"`
 }
 
 // AddToCron adds a job to cron
@@ -63,6 +72,36 @@ func (j *Job) Run() {
 	build.Logger.Printf("The build for job %s is scheduled via cron\n", j.Name)
 }
 
+// Verify verifies the definition of the job: params and everything which
+// refers to params or Wakefile.yaml
+func (j *Job) Verify() error {
+	err := j.Params.Verify()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range j.ETAParams {
+		if j.Params.Get(name) == nil {
+			return fmt.Errorf("unknown param %s in eta_params", name)
+		}
+	}
+
+	for _, n := range j.Notify {
+		err = n.Verify()
+		if err != nil {
+			return err
+		}
+	}
+
+	if j.ReportStatus != nil {
+		err = j.ReportStatus.Verify(j)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Used to verify interval before saving after editing
 func (j *Job) verifyInterval() error {
 	if j.Interval == "" {
@@ -87,8 +126,12 @@ type Task struct {
 	IncludePath  string            `yaml:"include"`
 	Block        []*Task           `yaml:"block"`
 	IgnoreErrors bool              `yaml:"ignore_errors"`
+	Approval     *TaskApproval     `yaml:"approval" json:"approval"`
 	startedAt    time.Time
 	duration     time.Duration
+	outputs      map[string]string
+	logSize      int64 // Size of the completed log
+	logTruncated bool
 }
 
 // OnTasks is a list of tasks that should be ran on status change
@@ -98,11 +141,28 @@ type OnTasks struct {
 	OnFailed   []*Task `yaml:"on_failed"`
 	OnAborted  []*Task `yaml:"on_aborted"`
 	OnFinished []*Task `yaml:"on_finished"`
+	OnFixed    []*Task `yaml:"on_fixed"`
+	OnBroken   []*Task `yaml:"on_broken"`
 	Finally    []*Task `yaml:"finally"`
 }
 
-// CreateJobFromFile reads job from a file
+// CreateJobFromFile reads job from the job file and verifies it
 func CreateJobFromFile(path string) (*Job, error) {
+	job, err := CreateJobFromBuildFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = job.Verify()
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// CreateJobFromBuildFile reads job from the config stored with a build. The
+// job is not verified, as Wakefile.yaml could have changed since the build
+// was created
+func CreateJobFromBuildFile(path string) (*Job, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -112,6 +172,7 @@ func CreateJobFromFile(path string) (*Job, error) {
 	if err != nil {
 		return nil, err
 	}
+	job.DefaultParams = job.Params.DefaultValues()
 
 	// Assign main kind to all tasks
 	for _, t := range job.Tasks {
@@ -159,6 +220,20 @@ func CreateJobFromFile(path string) (*Job, error) {
 		job.Tasks = append(job.Tasks, ot.OnFinished...)
 	}
 
+	if ot.OnFixed != nil {
+		for _, t := range ot.OnFixed {
+			t.Kind = StatusFixed
+		}
+		job.Tasks = append(job.Tasks, ot.OnFixed...)
+	}
+
+	if ot.OnBroken != nil {
+		for _, t := range ot.OnBroken {
+			t.Kind = StatusBroken
+		}
+		job.Tasks = append(job.Tasks, ot.OnBroken...)
+	}
+
 	if ot.Finally != nil {
 		for _, t := range ot.Finally {
 			t.Kind = "finally"
@@ -206,7 +281,7 @@ func ScanAllJobs() error {
 			if err != nil {
 				return err
 			}
-			paramsB, err := json.Marshal(job.DefaultParams)
+			paramsB, err := json.Marshal(job.Params.MaskSecrets(job.DefaultParams))
 			if err != nil {
 				return err
 			}
@@ -214,6 +289,14 @@ func ScanAllJobs() error {
 			if err != nil {
 				return err
 			}
+			paramsSchemaB, err := json.Marshal(job.Params.Masked())
+			if err != nil {
+				return err
+			}
+			err = jb.Put([]byte("params"), paramsSchemaB)
+			if err != nil {
+				return err
+			}
 			err = jb.Put([]byte("desc"), []byte(job.Desc))
 			if err != nil {
 				return err
@@ -270,24 +353,55 @@ func RunJob(name string, params url.Values) (*Build, error) {
 	if err != nil {
 		return nil, err
 	}
-	build, err := CreateBuild(job, jobFile)
+
+	// Avoid creating a build which won't fit into the queue. The limit is
+	// checked again when the build is added to the queue
+	if job.MaxQueued > 0 && GlobalQueue.CountQueued(name) >= job.MaxQueued {
+		return nil, &QueueFullError{Job: name, MaxQueued: job.MaxQueued}
+	}
+
+	// Validate params from URL
+	err = job.Params.ResolveChoices(name)
+	if err != nil {
+		return nil, err
+	}
+	buildParams, err := job.Params.ApplyParams(params)
 	if err != nil {
 		return nil, err
 	}
 
-	// Update params from URL
-	for idx := range build.Params {
-		for pkey := range build.Params[idx] {
-			value := params.Get(pkey)
-			if value != "" {
-				build.Params[idx][pkey] = value
-				build.Logger.Printf("Updating key %s to %s", pkey, value)
-			}
-		}
+	build, err := CreateBuild(job, jobFile, buildParams)
+	if err != nil {
+		return nil, err
+	}
+	build.Logger.Printf("Params: %v\n", job.Params.MaskSecrets(build.Params))
+
+	err = ScheduleBuild(build)
+	if err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+// ScheduleBuild puts the build in the queue. The build is discarded if it
+// doesn't fit into the queue
+func ScheduleBuild(build *Build) error {
+	if build.Job.ConcurrencyGroup != nil {
+		build.ConcurrencyGroup = build.expandParams(build.Job.ConcurrencyGroup.Name)
+		build.Logger.Printf("Concurrency group: %s\n", build.ConcurrencyGroup)
+		GlobalQueue.Supersede(build)
 	}
 
-	GlobalQueue.Add(build)
+	build.etaModel = LoadETAModel(build.Job, build.getParamsMap())
+	build.UpdateETA()
+
+	err := GlobalQueue.Add(build)
+	if err != nil {
+		build.Logger.Println(err)
+		build.discard()
+		return err
+	}
 	GlobalQueue.Take()
 	build.BroadcastUpdate()
-	return build, nil
+	return nil
 }
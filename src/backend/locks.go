@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// LockModeRead is a shared lock mode - many builds can hold it at the same time
+const LockModeRead = "read"
+
+// LockModeWrite is an exclusive lock mode - only one build can hold it
+const LockModeWrite = "write"
+
+// JobLock is a named lock which is held by a build while it is running. It is
+// used to prevent builds of different jobs from running at the same time.
+// In job file it can be specified as a string (write lock) or as an object:
+//
+//	locks:
+//	  - staging
+//	  - name: database
+//	    mode: read
+type JobLock struct {
+	Name string `yaml:"name" json:"name"`
+	Mode string `yaml:"mode" json:"mode"`
+}
+
+// UnmarshalYAML allows to specify a lock as a plain string
+func (l *JobLock) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	err := unmarshal(&name)
+	if err == nil {
+		l.Name = name
+		l.Mode = LockModeWrite
+		return nil
+	}
+
+	type plainLock JobLock
+	var pl plainLock
+	err = unmarshal(&pl)
+	if err != nil {
+		return err
+	}
+	if pl.Name == "" {
+		return fmt.Errorf("lock name is required")
+	}
+	switch pl.Mode {
+	case "":
+		pl.Mode = LockModeWrite
+	case LockModeRead, LockModeWrite:
+		break
+	default:
+		return fmt.Errorf("invalid mode %q for lock %s", pl.Mode, pl.Name)
+	}
+	*l = JobLock(pl)
+	return nil
+}
+
+// conflicts returns true if both locks can't be held at the same time
+func (l *JobLock) conflicts(other *JobLock) bool {
+	return l.Name == other.Name && (l.Mode == LockModeWrite || other.Mode == LockModeWrite)
+}
+
+// findLockConflict returns the first lock from `locks` which conflicts with
+// any of the `held` locks
+func findLockConflict(locks []*JobLock, held []*JobLock) *JobLock {
+	for _, l := range locks {
+		for _, h := range held {
+			if l.conflicts(h) {
+				return l
+			}
+		}
+	}
+	return nil
+}
+
+// getLocksState returns holders and waiters of all locks used by queued,
+// running and paused builds. Builds which are paused for approval keep
+// holding their locks. Should be called when q.mutex is locked
+func (q *Queue) getLocksState() []*LockStateData {
+	states := map[string]*LockStateData{}
+	getState := func(name string) *LockStateData {
+		state, ok := states[name]
+		if !ok {
+			state = &LockStateData{
+				Name:    name,
+				Holders: []*LockUserData{},
+				Waiters: []*LockUserData{},
+			}
+			states[name] = state
+		}
+		return state
+	}
+	for _, hItem := range q.getHolders() {
+		for _, l := range hItem.Job.Locks {
+			state := getState(l.Name)
+			state.Holders = append(state.Holders, &LockUserData{
+				BuildID: hItem.ID,
+				Job:     hItem.Job.Name,
+				Mode:    l.Mode,
+				Status:  hItem.getStatus(),
+			})
+		}
+	}
+	for _, qItem := range q.queued {
+		if qItem.resuming {
+			continue
+		}
+		for _, l := range qItem.Job.Locks {
+			state := getState(l.Name)
+			state.Waiters = append(state.Waiters, &LockUserData{
+				BuildID: qItem.ID,
+				Job:     qItem.Job.Name,
+				Mode:    l.Mode,
+				Status:  qItem.getStatus(),
+			})
+		}
+	}
+
+	result := make([]*LockStateData, 0, len(states))
+	for _, state := range states {
+		result = append(result, state)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// GetLocksState returns holders and waiters of all locks
+func (q *Queue) GetLocksState() []*LockStateData {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.getLocksState()
+}
+
+// BroadcastLocksUpdate sends current state of locks to all subscribed clients
+func (q *Queue) BroadcastLocksUpdate() {
+	msg := MsgBroadcast{
+		Type: "locks:update",
+		Data: q.GetLocksState(),
+	}
+	WSHub.broadcast <- &msg
+}
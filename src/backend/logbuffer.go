@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+// LogBufferSize is the number of the latest log messages of a build which
+// are kept in memory to be replayed to reconnected clients
+const LogBufferSize = 5000
+
+// LogBuffer is a ring buffer of the latest log messages of a build. Messages
+// get monotonically increasing IDs starting from 1
+type LogBuffer struct {
+	mutex  deadlock.Mutex
+	items  []*CommandLogData
+	start  int // Index of the oldest message
+	count  int
+	lastID int
+	sentID int // ID of the last message which was broadcasted
+}
+
+// NewLogBuffer creates a buffer which keeps up to size messages
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{items: make([]*CommandLogData, size)}
+}
+
+// Add assigns ID to the message and saves it, the oldest message is dropped
+// when the buffer is full
+func (lb *LogBuffer) Add(taskID int, data string) *CommandLogData {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.lastID++
+	item := &CommandLogData{TaskID: taskID, ID: lb.lastID, Data: data}
+	if lb.count < len(lb.items) {
+		lb.items[(lb.start+lb.count)%len(lb.items)] = item
+		lb.count++
+	} else {
+		lb.items[lb.start] = item
+		lb.start = (lb.start + 1) % len(lb.items)
+	}
+	return item
+}
+
+// CountUnsent returns number of messages which were added after the last
+// call of Unsent
+func (lb *LogBuffer) CountUnsent() int {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.lastID - lb.sentID
+}
+
+// Unsent returns messages which were added after the previous call. The
+// second value is false if some of them were already dropped from the buffer
+func (lb *LogBuffer) Unsent() ([]*CommandLogData, bool) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	sentID := lb.sentID
+	lb.sentID = lb.lastID
+	return lb.since(sentID)
+}
+
+// Since returns messages with ID greater than since. The second value is
+// false if some of these messages were already dropped from the buffer
+func (lb *LogBuffer) Since(since int) ([]*CommandLogData, bool) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.since(since)
+}
+
+func (lb *LogBuffer) since(since int) ([]*CommandLogData, bool) {
+	var result []*CommandLogData
+	complete := true
+	for i := 0; i < lb.count; i++ {
+		item := lb.items[(lb.start+i)%len(lb.items)]
+		if i == 0 && item.ID > since+1 {
+			complete = false
+		}
+		if item.ID > since {
+			result = append(result, item)
+		}
+	}
+	if lb.count == 0 && lb.lastID > since {
+		complete = false
+	}
+	return result, complete
+}
+
+// mergeLogs merges consecutive messages of the same task up to maxSize bytes.
+// The merged message has ID of the last one
+func mergeLogs(items []*CommandLogData, maxSize int) []*CommandLogData {
+	var result []*CommandLogData
+	var merged *CommandLogData
+	var data strings.Builder
+	for _, item := range items {
+		if merged != nil && (merged.TaskID != item.TaskID || data.Len()+len(item.Data) > maxSize) {
+			merged.Data = data.String()
+			merged = nil
+		}
+		if merged == nil {
+			merged = &CommandLogData{TaskID: item.TaskID}
+			result = append(result, merged)
+			data.Reset()
+		}
+		merged.ID = item.ID
+		data.WriteString(item.Data)
+	}
+	if merged != nil {
+		merged.Data = data.String()
+	}
+	return result
+}
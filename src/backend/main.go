@@ -46,7 +46,10 @@ var Assets embed.FS
 
 func init() {
 	Logger = log.New(os.Stdout, "", log.Lmicroseconds|log.Lshortfile)
+}
 
+func main() {
+	// Flags are parsed here and not in init, so tests can define their own
 	configFlag := flag.String("config", "Wakefile.yaml", "Configuration file location")
 	flag.Parse()
 
@@ -55,10 +58,7 @@ func init() {
 	if err != nil {
 		Logger.Fatal(err)
 	}
-}
 
-func main() {
-	var err error
 	err = os.MkdirAll(Config.WorkDir, os.ModePerm)
 	if err != nil {
 		Logger.Fatal(err)
@@ -107,6 +107,26 @@ func main() {
 			return err
 		}
 
+		_, err = tx.CreateBucketIfNotExists(TestsBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(TestHistoryBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(CoverageBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(EventsBucket)
+		if err != nil {
+			return err
+		}
+
 		return nil
 	})
 
@@ -116,6 +136,10 @@ func main() {
 
 	GlobalSessionStorage = CreateSessionStorage(SessionCleanupPeriod)
 
+	GlobalNotifier = CreateNotifier()
+
+	GlobalEvents = CreateEventBus()
+
 	GlobalQueue, err = CreateQueue()
 	if err != nil {
 		Logger.Fatal(err)
@@ -153,6 +177,7 @@ func main() {
 	router.Route("/api", func(router chi.Router) {
 		router.Use(AuthMi)
 		router.Get("/feed", HandleFeedView)
+		router.Get("/events", HandleEvents)
 
 		router.Route("/jobs", func(router chi.Router) {
 			router.Get("/", HandleJobsView)
@@ -165,19 +190,40 @@ func main() {
 			router.Delete("/{name}", HandleDeleteJob)
 			router.Post("/{name}", HandleJobPost)
 			router.Get("/{name}", HandleJobGet)
+			router.Get("/{name}/params", HandleJobParams)
+			router.Get("/{name}/coverage", HandleJobCoverage)
+			router.Get("/{name}/stats", HandleJobStats)
 			router.Post("/{name}/set_active", HandleJobSetActive)
 		})
 
 		router.Route("/build", func(router chi.Router) {
 			router.Get("/{id}", HandleGetBuild)
+			router.Get("/{id}/tests", HandleGetBuildTests)
+			router.Get("/{id}/coverage", HandleGetBuildCoverage)
 			router.Post("/{id}/abort", HandleAbortBuild)
 			router.Post("/{id}/flush", HandleFlushTaskLogs)
+			router.Get("/{id}/task/{task}/log", HandleGetTaskLog)
+			router.Get("/{id}/log/search", HandleSearchBuildLog)
+			router.Get("/{id}/log/download", HandleDownloadBuildLog)
+			router.Post("/{id}/rerun", HandleRerunBuild)
+			router.Post("/{id}/approve", HandleApproveBuild)
+			router.Post("/{id}/reject", HandleRejectBuild)
+		})
+
+		router.Route("/queue", func(router chi.Router) {
+			router.Get("/", HandleQueueView)
+			router.Post("/{id}/move", HandleQueueMove)
+			router.Post("/{id}/priority", HandleQueuePriority)
 		})
 
+		router.Get("/locks", HandleLocksView)
+
 		router.Get("/settings", HandleSettingsGet)
 		router.Post("/settings", HandleSettingsPost)
 	})
 
+	router.With(MetricsAuthMi).Get("/metrics", HandleMetrics)
+
 	router.Route("/internal", func(router chi.Router) {
 		router.Use(InternalAuthMi)
 		router.Post("/api/job/{name}/run", HandleRunJob)
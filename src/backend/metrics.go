@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+// Buckets of duration histograms, s
+var (
+	httpDurationBuckets  = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	buildDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600, 7200}
+)
+
+// GlobalMetrics collects metrics which are exported in Prometheus format
+var GlobalMetrics = NewMetrics()
+
+// histogram is a Prometheus histogram
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// histogramVec is a set of histograms with different label values
+type histogramVec struct {
+	labels     []string
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		labels:     labels,
+		buckets:    buckets,
+		histograms: map[string]*histogram{},
+	}
+}
+
+func (hv *histogramVec) observe(v float64, values ...string) {
+	key := formatLabels(hv.labels, values)
+	h, ok := hv.histograms[key]
+	if !ok {
+		h = &histogram{buckets: hv.buckets, counts: make([]uint64, len(hv.buckets))}
+		hv.histograms[key] = h
+	}
+	h.observe(v)
+}
+
+func (hv *histogramVec) write(w io.Writer, name string, help string) {
+	writeHeader(w, name, help, "histogram")
+	keys := make([]string, 0, len(hv.histograms))
+	for key := range hv.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := hv.histograms[key]
+		// Labels are formatted as {a="b"}, `le` is added to them
+		prefix := "{"
+		if key != "" {
+			prefix = strings.TrimSuffix(key, "}") + ","
+		}
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%sle=\"%v\"} %d\n", name, prefix, le, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", name, key, h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, key, h.count)
+	}
+}
+
+// Metrics contains counters and histograms which are updated by the server.
+// Gauges are collected when metrics are requested
+type Metrics struct {
+	mutex           deadlock.Mutex
+	buildsTotal     map[string]uint64
+	buildDuration   *histogramVec
+	taskDuration    *histogramVec
+	httpDuration    *histogramVec
+	cleanerDuration float64
+	cleanerLastRun  time.Time
+}
+
+// NewMetrics creates new Metrics instance
+func NewMetrics() *Metrics {
+	return &Metrics{
+		buildsTotal:   map[string]uint64{},
+		buildDuration: newHistogramVec(buildDurationBuckets, "job", "status"),
+		taskDuration:  newHistogramVec(buildDurationBuckets, "job", "task", "kind"),
+		httpDuration:  newHistogramVec(httpDurationBuckets, "method", "route", "code"),
+	}
+}
+
+// ObserveBuild records the terminal build and durations of its tasks
+func (m *Metrics) ObserveBuild(b *Build) {
+	type taskInfo struct {
+		name     string
+		kind     string
+		duration time.Duration
+	}
+	var tasks []*taskInfo
+	b.mutex.Lock()
+	status := string(b.Status)
+	duration := b.Duration
+	started := !b.StartedAt.IsZero()
+	for _, t := range b.Job.Tasks {
+		switch t.Status {
+		case StatusPending, StatusSkipped:
+			continue
+		}
+		tasks = append(tasks, &taskInfo{name: t.Name, kind: t.Kind, duration: t.duration})
+	}
+	b.mutex.Unlock()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.buildsTotal[formatLabels([]string{"job", "status"}, []string{b.Job.Name, status})]++
+	// Builds which were removed from the queue have never started
+	if started {
+		m.buildDuration.observe(duration.Seconds(), b.Job.Name, status)
+	}
+	for _, t := range tasks {
+		m.taskDuration.observe(t.duration.Seconds(), b.Job.Name, t.name, t.kind)
+	}
+}
+
+// ObserveHTTPRequest records duration of the HTTP request
+func (m *Metrics) ObserveHTTPRequest(method string, route string, code int, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.httpDuration.observe(duration.Seconds(), method, route, fmt.Sprintf("%d", code))
+}
+
+// ObserveCleaner records duration of the last clean up of old builds
+func (m *Metrics) ObserveCleaner(duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.cleanerDuration = duration.Seconds()
+	m.cleanerLastRun = time.Now()
+}
+
+// Write writes all metrics in Prometheus text format
+func (m *Metrics) Write(w io.Writer) {
+	running, waiting, queued, concurrentBuilds := GlobalQueue.GetSize()
+	writeGauge(w, "wakeci_queue_length", "Number of queued builds", queued)
+	writeGauge(w, "wakeci_builds_running", "Number of running builds", running)
+	writeGauge(w, "wakeci_builds_waiting", "Number of builds waiting for approval", waiting)
+	writeGauge(w, "wakeci_concurrent_builds", "Maximum number of running builds", concurrentBuilds)
+	writeGauge(w, "wakeci_ws_clients", "Number of connected websocket clients", WSHub.CountClients())
+
+	dbStats := DB.Stats()
+	writeGauge(w, "wakeci_db_free_pages", "Number of free pages on the freelist", dbStats.FreePageN)
+	writeGauge(w, "wakeci_db_pending_pages", "Number of pending pages on the freelist", dbStats.PendingPageN)
+	writeGauge(w, "wakeci_db_free_alloc_bytes", "Bytes allocated in free pages", dbStats.FreeAlloc)
+	writeGauge(w, "wakeci_db_open_read_transactions", "Number of currently open read transactions", dbStats.OpenTxN)
+	writeHeader(w, "wakeci_db_read_transactions_total", "Total number of started read transactions", "counter")
+	fmt.Fprintf(w, "wakeci_db_read_transactions_total %d\n", dbStats.TxN)
+	if fi, err := os.Stat(DB.Path()); err == nil {
+		writeGauge(w, "wakeci_db_size_bytes", "Size of the database file", fi.Size())
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	writeHeader(w, "wakeci_builds_total", "Number of terminal builds", "counter")
+	keys := make([]string, 0, len(m.buildsTotal))
+	for key := range m.buildsTotal {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "wakeci_builds_total%s %d\n", key, m.buildsTotal[key])
+	}
+	m.buildDuration.write(w, "wakeci_build_duration_seconds", "Duration of terminal builds")
+	m.taskDuration.write(w, "wakeci_task_duration_seconds", "Duration of executed tasks of terminal builds")
+	m.httpDuration.write(w, "wakeci_http_request_duration_seconds", "Duration of HTTP requests")
+	writeGauge(w, "wakeci_cleaner_duration_seconds", "Duration of the last clean up of old builds", m.cleanerDuration)
+	var lastRun int64
+	if !m.cleanerLastRun.IsZero() {
+		lastRun = m.cleanerLastRun.Unix()
+	}
+	writeGauge(w, "wakeci_cleaner_last_run_timestamp_seconds", "Time of the last clean up of old builds", lastRun)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func writeGauge(w io.Writer, name string, help string, value interface{}) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats labels, e.g. {job="build",status="failed"}
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, labelValueReplacer.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
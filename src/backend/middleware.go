@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/subtle"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -18,6 +22,13 @@ type HandlerLogger string
 // HL is a handle logger
 const HL HandlerLogger = "logger"
 
+// AuthUser is a special type for the authenticated user of a request
+type AuthUser string
+
+// AU is a name of the authenticated user: the user name of basic auth
+// credentials ("api" if it is empty) or "web" for the session of the UI
+const AU AuthUser = "user"
+
 // LogMi is a middleware that creates a new logger per request and logs total time that took to process a request
 func LogMi(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -42,11 +53,18 @@ func LogMi(next http.Handler) http.Handler {
 		r = r.WithContext(ctx)
 
 		// Call actual handler
-		next.ServeHTTP(w, r.WithContext(ctx))
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r.WithContext(ctx))
 
 		defer func() {
 			duration := time.Since(startTime)
 			handlerLogger.Printf("%s %s [took %s]\n", r.Method, r.URL, duration)
+			// Route patterns are used instead of paths to keep cardinality low
+			route := "unknown"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			GlobalMetrics.ObserveHTTPRequest(r.Method, route, sr.status, duration)
 		}()
 	})
 }
@@ -101,7 +119,7 @@ func AuthMi(next http.Handler) http.Handler {
 		}
 
 		// Basic auth for API calls
-		_, password, ok := r.BasicAuth()
+		user, password, ok := r.BasicAuth()
 		if ok {
 			var hashedPassword []byte
 
@@ -123,7 +141,10 @@ func AuthMi(next http.Handler) http.Handler {
 				w.WriteHeader(http.StatusForbidden)
 				return
 			}
-			next.ServeHTTP(w, r)
+			if user == "" {
+				user = "api"
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), AU, user)))
 			return
 		}
 
@@ -140,7 +161,7 @@ func AuthMi(next http.Handler) http.Handler {
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), AU, "web")))
 	})
 }
 
@@ -170,3 +191,54 @@ func InternalAuthMi(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// MetricsAuthMi allows access to metrics with a valid token. If the token is
+// not configured, only local requests are allowed
+func MetricsAuthMi(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger, ok := r.Context().Value(HL).(*log.Logger)
+		if !ok {
+			logger = Logger
+		}
+
+		if Config.MetricsToken != "" {
+			token := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(token, []byte("Bearer "+Config.MetricsToken)) != 1 {
+				logger.Println("Invalid metrics token")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		InternalAuthMi(next).ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack is required by websocket connections
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer doesn't support hijacking")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Flush is required for streaming responses
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Types of notifiers
+const (
+	NotifierSMTP    = "smtp"
+	NotifierWebhook = "webhook"
+	NotifierSlack   = "slack"
+	NotifierMatrix  = "matrix"
+)
+
+// NotificationQueueSize is the maximum number of notifications which wait
+// for delivery. New notifications are dropped when the queue is full
+const NotificationQueueSize = 100
+
+// NotificationWorkers is the number of notifications which are delivered at
+// the same time
+const NotificationWorkers = 4
+
+// NotificationTimeout is the timeout of a single delivery attempt
+const NotificationTimeout = 10 * time.Second
+
+// DefaultNotificationTemplate is used when the notifier doesn't have a template
+const DefaultNotificationTemplate = `Build #{{.BuildID}} of {{.Job}} is {{.Status}}` +
+	`{{if .Duration}} after {{.Duration}}{{end}}` +
+	`{{if .FailedTask}}. Failed task: {{.FailedTask}}{{end}}` + "\n{{.URL}}"
+
+// NotifierConfig describes a notification channel in Wakefile.yaml
+type NotifierConfig struct {
+	Type string `yaml:"type"`
+	// Text of the message, text/template with NotificationEvent
+	Template string `yaml:"template"`
+	// Number of delivery attempts (default 3)
+	Retries int `yaml:"retries"`
+	// Webhook, Slack: URL to post to. Matrix: URL of the homeserver
+	URL string `yaml:"url"`
+	// Webhook: additional headers
+	Headers map[string]string `yaml:"headers"`
+	// Matrix: ID of the room and access token
+	Room  string `yaml:"room"`
+	Token string `yaml:"token"`
+	// SMTP
+	Host     string   `yaml:"host"`
+	Port     string   `yaml:"port"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	// Parsed Template
+	template *template.Template
+}
+
+// Verify verifies the configuration of the notifier
+func (nc *NotifierConfig) Verify(name string) error {
+	switch nc.Type {
+	case NotifierWebhook, NotifierSlack:
+		if nc.URL == "" {
+			return fmt.Errorf("notifier %s: url is required", name)
+		}
+	case NotifierMatrix:
+		if nc.URL == "" || nc.Room == "" || nc.Token == "" {
+			return fmt.Errorf("notifier %s: url, room and token are required", name)
+		}
+	case NotifierSMTP:
+		if nc.Host == "" || nc.From == "" || len(nc.To) == 0 {
+			return fmt.Errorf("notifier %s: host, from and to are required", name)
+		}
+		if nc.Port == "" {
+			nc.Port = "587"
+		}
+	default:
+		return fmt.Errorf("notifier %s: unknown type %q", name, nc.Type)
+	}
+	if nc.Retries <= 0 {
+		nc.Retries = 3
+	}
+	text := nc.Template
+	if text == "" {
+		text = DefaultNotificationTemplate
+	}
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return fmt.Errorf("notifier %s: %s", name, err.Error())
+	}
+	nc.template = tmpl
+	return nil
+}
+
+// JobNotification selects a notifier and statuses of the build which are
+// reported to it
+type JobNotification struct {
+	Notifier string       `yaml:"notifier" json:"notifier"`
+	Statuses []ItemStatus `yaml:"statuses" json:"statuses"`
+}
+
+// UnmarshalYAML allows to specify only the name of the notifier, then failed
+// builds are reported
+func (jn *JobNotification) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	err := unmarshal(&name)
+	if err == nil {
+		jn.Notifier = name
+		jn.Statuses = []ItemStatus{StatusFailed}
+		return nil
+	}
+
+	type plainNotification JobNotification
+	var pn plainNotification
+	err = unmarshal(&pn)
+	if err != nil {
+		return err
+	}
+	if pn.Notifier == "" {
+		return fmt.Errorf("notifier is required")
+	}
+	if len(pn.Statuses) == 0 {
+		pn.Statuses = []ItemStatus{StatusFailed}
+	}
+	*jn = JobNotification(pn)
+	return nil
+}
+
+// Verify verifies that the notifier is configured
+func (jn *JobNotification) Verify() error {
+	if _, ok := Config.Notifiers[jn.Notifier]; !ok {
+		return fmt.Errorf("notifier %s is not configured in Wakefile.yaml", jn.Notifier)
+	}
+	return nil
+}
+
+// NotificationEvent is a change of the build's status. It is available in
+// templates of the notifiers and is sent by webhook notifier as is
+type NotificationEvent struct {
+	BuildID    int                 `json:"buildID"`
+	Job        string              `json:"job"`
+	Status     ItemStatus          `json:"status"`
+	Params     []map[string]string `json:"params"`
+	Duration   time.Duration       `json:"duration"`
+	FailedTask string              `json:"failedTask"`
+	URL        string              `json:"url"`
+	Time       time.Time           `json:"time"`
+}
+
+// notification is an event which should be delivered by the notifier
+type notification struct {
+	name     string
+	notifier *NotifierConfig
+	event    *NotificationEvent
+}
+
+// Notifier delivers notifications asynchronously
+type Notifier struct {
+	queue    chan *notification
+	statuses chan *statusReport
+	Logger   *log.Logger
+}
+
+// GlobalNotifier delivers notifications about builds
+var GlobalNotifier *Notifier
+
+// CreateNotifier creates a notifier and starts delivering notifications
+func CreateNotifier() *Notifier {
+	n := Notifier{
+		queue:    make(chan *notification, NotificationQueueSize),
+		statuses: make(chan *statusReport, NotificationQueueSize),
+		Logger:   log.New(os.Stdout, "[notifier] ", log.Lmicroseconds|log.Lshortfile),
+	}
+	for i := 0; i < NotificationWorkers; i++ {
+		go n.run()
+	}
+	go n.runStatusReports()
+	return &n
+}
+
+// Notify puts the event in the delivery queue of all notifiers of the job
+// which are subscribed to the event's status
+func (n *Notifier) Notify(notifications []*JobNotification, event *NotificationEvent) {
+	for _, jn := range notifications {
+		if !jn.isSubscribed(event.Status) {
+			continue
+		}
+		notifier, ok := Config.Notifiers[jn.Notifier]
+		if !ok {
+			n.Logger.Printf("Notifier %s is not configured\n", jn.Notifier)
+			continue
+		}
+		select {
+		case n.queue <- &notification{name: jn.Notifier, notifier: notifier, event: event}:
+		default:
+			n.Logger.Printf("Queue is full, dropping notification about build %d\n", event.BuildID)
+		}
+	}
+}
+
+func (jn *JobNotification) isSubscribed(status ItemStatus) bool {
+	for _, s := range jn.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) run() {
+	for item := range n.queue {
+		var err error
+		for attempt := 1; attempt <= item.notifier.Retries; attempt++ {
+			err = item.notifier.send(item.event)
+			if err == nil {
+				n.Logger.Printf("Build %d: %s notification sent via %s\n", item.event.BuildID, item.event.Status, item.name)
+				break
+			}
+			n.Logger.Printf("Build %d: attempt %d via %s failed: %s\n", item.event.BuildID, attempt, item.name, err.Error())
+			if attempt < item.notifier.Retries {
+				time.Sleep(time.Duration(attempt*attempt) * time.Second)
+			}
+		}
+	}
+}
+
+// render returns the text of the notification
+func (nc *NotifierConfig) render(event *NotificationEvent) (string, error) {
+	var buf bytes.Buffer
+	err := nc.template.Execute(&buf, event)
+	return buf.String(), err
+}
+
+// send delivers the event
+func (nc *NotifierConfig) send(event *NotificationEvent) error {
+	text, err := nc.render(event)
+	if err != nil {
+		return err
+	}
+	switch nc.Type {
+	case NotifierSMTP:
+		return nc.sendEmail(event, text)
+	case NotifierWebhook:
+		payload := struct {
+			*NotificationEvent
+			Text string `json:"text"`
+		}{event, text}
+		return nc.sendJSON(http.MethodPost, nc.URL, payload)
+	case NotifierSlack:
+		return nc.sendJSON(http.MethodPost, nc.URL, map[string]string{"text": text})
+	case NotifierMatrix:
+		// Transaction id makes retries idempotent
+		txnID := fmt.Sprintf("wakeci-%d-%s-%d", event.BuildID, event.Status, event.Time.UnixNano())
+		endpoint := fmt.Sprintf(
+			"%s/_matrix/client/r0/rooms/%s/send/m.room.message/%s",
+			strings.TrimSuffix(nc.URL, "/"), url.PathEscape(nc.Room), url.PathEscape(txnID),
+		)
+		return nc.sendJSON(http.MethodPut, endpoint, map[string]string{"msgtype": "m.text", "body": text})
+	}
+	return fmt.Errorf("unknown notifier type %q", nc.Type)
+}
+
+func (nc *NotifierConfig) sendJSON(method string, endpoint string, payload interface{}) error {
+	payloadB, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(payloadB))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range nc.Headers {
+		req.Header.Set(key, value)
+	}
+	if nc.Type == NotifierMatrix {
+		req.Header.Set("Authorization", "Bearer "+nc.Token)
+	}
+	client := http.Client{Timeout: NotificationTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (nc *NotifierConfig) sendEmail(event *NotificationEvent, text string) error {
+	subject := fmt.Sprintf("[wakeci] %s #%d: %s", event.Job, event.BuildID, event.Status)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", nc.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(nc.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if nc.Username != "" {
+		auth = smtp.PlainAuth("", nc.Username, nc.Password, nc.Host)
+	}
+	return smtp.SendMail(nc.Host+":"+nc.Port, auth, nc.From, nc.To, msg.Bytes())
+}
+
+// notify sends notifications about the build's status
+func (b *Build) notify(status ItemStatus) {
+	if len(b.Job.Notify) == 0 || GlobalNotifier == nil {
+		return
+	}
+	event := NotificationEvent{
+		BuildID: b.ID,
+		Job:     b.Job.Name,
+		Status:  status,
+		URL:     fmt.Sprintf("%sbuild/%d", GetServiceURL(), b.ID),
+		Time:    time.Now(),
+	}
+	b.mutex.Lock()
+	event.Params = b.Job.Params.MaskSecrets(b.Params)
+	if !b.StartedAt.IsZero() {
+		event.Duration = b.Duration.Truncate(time.Millisecond)
+	}
+	for _, t := range b.Job.Tasks {
+		if t.Kind == KindMain && t.Status == StatusFailed {
+			event.FailedTask = t.Name
+			break
+		}
+	}
+	b.mutex.Unlock()
+	GlobalNotifier.Notify(b.Job.Notify, &event)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxOutputSize is the maximum size of WAKE_OUTPUT file which is parsed
+const MaxOutputSize = 1024 * 1024
+
+// outputRefRE matches references to task outputs, e.g. ${outputs.build.version}
+// Task can be referenced by name or id
+var outputRefRE = regexp.MustCompile(`\$\{outputs\.([^}]+)\.([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// outputKeyRE matches valid keys, they are used in names of variables
+var outputKeyRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// GetOutputFilename returns location of the file where the task writes its
+// outputs, it is exported as WAKE_OUTPUT
+func (b *Build) GetOutputFilename(task *Task) string {
+	return b.GetWakespaceDir() + fmt.Sprintf("task_%d.output", task.ID)
+}
+
+// collectOutputs reads outputs which were written by the task
+func (b *Build) collectOutputs(task *Task) (map[string]string, error) {
+	file, err := os.Open(b.GetOutputFilename(task))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	outputs, err := parseOutputs(io.LimitReader(file, MaxOutputSize))
+	if err != nil {
+		return nil, err
+	}
+	b.mutex.Lock()
+	task.outputs = outputs
+	b.mutex.Unlock()
+	return outputs, nil
+}
+
+// parseOutputs parses `key=value` lines. Multiline values are supported with
+// the heredoc syntax:
+//
+//	key<<EOF
+//	line 1
+//	line 2
+//	EOF
+func parseOutputs(r io.Reader) (map[string]string, error) {
+	outputs := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxOutputSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		eqIdx := strings.Index(line, "=")
+		hdIdx := strings.Index(line, "<<")
+		if hdIdx != -1 && (eqIdx == -1 || hdIdx < eqIdx) {
+			key := line[:hdIdx]
+			delimiter := line[hdIdx+2:]
+			if !outputKeyRE.MatchString(key) || delimiter == "" {
+				return nil, fmt.Errorf("invalid output: %s", line)
+			}
+			var value []string
+			closed := false
+			for scanner.Scan() {
+				if scanner.Text() == delimiter {
+					closed = true
+					break
+				}
+				value = append(value, scanner.Text())
+			}
+			if !closed {
+				return nil, fmt.Errorf("delimiter %s of output %s is not found", delimiter, key)
+			}
+			outputs[key] = strings.Join(value, "\n")
+			continue
+		}
+		if eqIdx == -1 || !outputKeyRE.MatchString(line[:eqIdx]) {
+			return nil, fmt.Errorf("invalid output: %s", line)
+		}
+		outputs[line[:eqIdx]] = line[eqIdx+1:]
+	}
+	return outputs, scanner.Err()
+}
+
+// getOutputsEnv returns outputs of all executed tasks as environmental
+// variables WAKE_OUTPUT_<key>, outputs of later tasks override outputs of
+// earlier ones. Outputs of each task are also available as
+// WAKE_TASK_<id>_OUTPUT_<key>. The prefix keeps outputs from overriding params
+// and other variables
+func (b *Build) getOutputsEnv() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var env []string
+	for _, t := range b.Job.Tasks {
+		keys := make([]string, 0, len(t.outputs))
+		for key := range t.outputs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			env = append(env, fmt.Sprintf("%s=%s", getTaskOutputVariable(t.ID, key), t.outputs[key]))
+			env = append(env, fmt.Sprintf("WAKE_OUTPUT_%s=%s", key, t.outputs[key]))
+		}
+	}
+	return env
+}
+
+// getTaskOutputVariable returns the name of the variable with the output
+func getTaskOutputVariable(taskID int, key string) string {
+	return fmt.Sprintf("WAKE_TASK_%d_OUTPUT_%s", taskID, key)
+}
+
+// substituteOutputs replaces references to outputs of other tasks, e.g.
+// ${outputs.build.version}, with references to the variables which contain
+// the values. Values are never pasted into the command, so they can't change
+// it. Unknown references are replaced with empty string
+func (b *Build) substituteOutputs(str string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return outputRefRE.ReplaceAllStringFunc(str, func(ref string) string {
+		match := outputRefRE.FindStringSubmatch(ref)
+		taskRef, key := match[1], match[2]
+		id, err := strconv.Atoi(taskRef)
+		for _, t := range b.Job.Tasks {
+			if t.Name == taskRef || (err == nil && t.ID == id) {
+				if _, ok := t.outputs[key]; ok {
+					return "${" + getTaskOutputVariable(t.ID, key) + "}"
+				}
+			}
+		}
+		return ""
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOutputs(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		expected map[string]string
+		err      bool
+	}{
+		{
+			name:     "empty",
+			data:     "",
+			expected: map[string]string{},
+		},
+		{
+			name:     "key and value",
+			data:     "version=1.2.0\n\nempty=\n",
+			expected: map[string]string{"version": "1.2.0", "empty": ""},
+		},
+		{
+			name:     "value with separators",
+			data:     "url=https://example.com/?a=b\ncmd=cat <<EOF\n",
+			expected: map[string]string{"url": "https://example.com/?a=b", "cmd": "cat <<EOF"},
+		},
+		{
+			name:     "later value overrides",
+			data:     "version=1\nversion=2\n",
+			expected: map[string]string{"version": "2"},
+		},
+		{
+			name:     "heredoc",
+			data:     "notes<<EOF\nline 1\n\nline=3\nEOF\nversion=1\n",
+			expected: map[string]string{"notes": "line 1\n\nline=3", "version": "1"},
+		},
+		{
+			name: "unclosed heredoc",
+			data: "notes<<EOF\nline 1\n",
+			err:  true,
+		},
+		{
+			name: "heredoc without delimiter",
+			data: "notes<<\nline 1\n",
+			err:  true,
+		},
+		{
+			name: "no separator",
+			data: "version\n",
+			err:  true,
+		},
+		{
+			name: "invalid key",
+			data: "app-version=1\n",
+			err:  true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			outputs, err := parseOutputs(strings.NewReader(c.data))
+			if c.err {
+				if err == nil {
+					t.Errorf("expected error, got %v", outputs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(outputs, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, outputs)
+			}
+		})
+	}
+}
+
+func TestSubstituteOutputs(t *testing.T) {
+	b := Build{Job: &Job{Tasks: []*Task{
+		{ID: 0, Name: "build", outputs: map[string]string{"version": "1.2.0"}},
+		{ID: 1, Name: "publish"},
+	}}}
+	cases := []struct {
+		str      string
+		expected string
+	}{
+		{"echo ${outputs.build.version}", "echo ${WAKE_TASK_0_OUTPUT_version}"},
+		{"echo ${outputs.0.version}", "echo ${WAKE_TASK_0_OUTPUT_version}"},
+		{"echo ${outputs.build.missing}", "echo "},
+		{"echo ${outputs.publish.version}", "echo "},
+		{"echo ${outputs.build.version-1}", "echo ${outputs.build.version-1}"},
+		{"echo ${version}", "echo ${version}"},
+	}
+	for _, c := range cases {
+		got := b.substituteOutputs(c.str)
+		if got != c.expected {
+			t.Errorf("substituteOutputs(%q): expected %q, got %q", c.str, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParamTypeString accepts any value
+const ParamTypeString = "string"
+
+// ParamTypeInt accepts integer numbers
+const ParamTypeInt = "int"
+
+// ParamTypeBool accepts values supported by strconv.ParseBool
+const ParamTypeBool = "bool"
+
+// ParamTypeChoice accepts one of the values listed in `choices`
+const ParamTypeChoice = "choice"
+
+// SecretMask replaces values of secret params everywhere they are visible
+const SecretMask = "*****"
+
+// JobParam describes a parameter of the job. In job file it can be specified
+// in a short form `- NAME: default` or as an object with `name` and any of
+// the other fields
+type JobParam struct {
+	Name         string   `yaml:"name" json:"name"`
+	Type         string   `yaml:"type" json:"type"`
+	Default      string   `yaml:"default" json:"default"`
+	Description  string   `yaml:"description" json:"description"`
+	Choices      []string `yaml:"choices" json:"choices"`
+	ChoicesFrom  string   `yaml:"choices_from" json:"choicesFrom"`
+	ChoicesCache string   `yaml:"choices_cache" json:"choicesCache"`
+	Regex        string   `yaml:"regex" json:"regex"`
+	Required     bool     `yaml:"required" json:"required"`
+	Secret       bool     `yaml:"secret" json:"secret"`
+}
+
+// JobParams is a list of job parameters
+type JobParams []*JobParam
+
+// paramFields are keys which make a param definition an object instead of
+// the short form
+var paramFields = []string{"type", "default", "description", "choices", "choices_from", "choices_cache", "regex", "required", "secret"}
+
+// paramItem is an item of `params` list in job file
+type paramItem struct {
+	params []*JobParam
+}
+
+// UnmarshalYAML supports both short and full forms of params
+func (pi *paramItem) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var item map[string]interface{}
+	err := unmarshal(&item)
+	if err != nil {
+		return err
+	}
+
+	if isFullParam(item) {
+		p := JobParam{}
+		err = unmarshal(&p)
+		if err != nil {
+			return err
+		}
+		if p.Type == "" {
+			p.Type = ParamTypeString
+		}
+		pi.params = []*JobParam{&p}
+		return nil
+	}
+
+	// Short form, one map may contain multiple params. Unmarshal it again to
+	// preserve values as they are written, e.g. 1.10
+	var short map[string]string
+	err = unmarshal(&short)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(short))
+	for key := range short {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pi.params = append(pi.params, &JobParam{
+			Name:    key,
+			Type:    ParamTypeString,
+			Default: short[key],
+		})
+	}
+	return nil
+}
+
+// UnmarshalYAML flattens params defined in different forms
+func (jp *JobParams) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items []*paramItem
+	err := unmarshal(&items)
+	if err != nil {
+		return err
+	}
+	params := JobParams{}
+	for _, item := range items {
+		if item != nil {
+			params = append(params, item.params...)
+		}
+	}
+	*jp = params
+	return nil
+}
+
+// isFullParam returns true if param is defined as an object
+func isFullParam(item map[string]interface{}) bool {
+	if _, ok := item["name"]; !ok {
+		return false
+	}
+	for _, field := range paramFields {
+		if _, ok := item[field]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify returns errors in param definitions
+func (jp JobParams) Verify() error {
+	for _, p := range jp {
+		if p.Name == "" {
+			return fmt.Errorf("param name is required")
+		}
+		switch p.Type {
+		case ParamTypeString, ParamTypeInt, ParamTypeBool:
+			break
+		case ParamTypeChoice:
+			if len(p.Choices) == 0 && p.ChoicesFrom == "" {
+				return fmt.Errorf("param %s of type choice requires choices or choices_from", p.Name)
+			}
+		default:
+			return fmt.Errorf("invalid type %q of param %s", p.Type, p.Name)
+		}
+		if p.Regex != "" {
+			_, err := regexp.Compile(p.Regex)
+			if err != nil {
+				return fmt.Errorf("invalid regex of param %s: %s", p.Name, err.Error())
+			}
+		}
+		if p.ChoicesCache != "" {
+			_, err := time.ParseDuration(p.ChoicesCache)
+			if err != nil {
+				return fmt.Errorf("invalid choices_cache of param %s: %s", p.Name, err.Error())
+			}
+		}
+		// Dynamic choices are not known yet
+		if p.Default != "" && p.ChoicesFrom == "" {
+			err := p.Validate(p.Default)
+			if err != nil {
+				return fmt.Errorf("invalid default value of param %s: %s", p.Name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Validate returns error if value is not allowed for the param
+func (p *JobParam) Validate(value string) error {
+	if value == "" {
+		if p.Required {
+			return fmt.Errorf("value is required")
+		}
+		return nil
+	}
+	switch p.Type {
+	case ParamTypeInt:
+		_, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+	case ParamTypeBool:
+		_, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+	}
+	if len(p.Choices) > 0 {
+		allowed := false
+		for _, c := range p.Choices {
+			if c == value {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%q is not one of %s", value, strings.Join(p.Choices, ", "))
+		}
+	}
+	if p.Regex != "" {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(value) {
+			return fmt.Errorf("%q doesn't match %s", value, p.Regex)
+		}
+	}
+	return nil
+}
+
+// DefaultValues returns default values of params in the format which is used
+// by builds
+func (jp JobParams) DefaultValues() []map[string]string {
+	values := make([]map[string]string, 0, len(jp))
+	for _, p := range jp {
+		values = append(values, map[string]string{p.Name: p.Default})
+	}
+	return values
+}
+
+// Get returns param by name
+func (jp JobParams) Get(name string) *JobParam {
+	for _, p := range jp {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// ParamValidationError describes an invalid param
+type ParamValidationError struct {
+	Param string `json:"param"`
+	Error string `json:"error"`
+}
+
+// ParamsValidationError contains all errors found in provided params
+type ParamsValidationError struct {
+	Errors []*ParamValidationError `json:"errors"`
+}
+
+func (e *ParamsValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, pe := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", pe.Param, pe.Error))
+	}
+	return "invalid params: " + strings.Join(msgs, "; ")
+}
+
+// ApplyParams validates provided values and returns params of a new build
+func (jp JobParams) ApplyParams(values url.Values) ([]map[string]string, error) {
+	verr := &ParamsValidationError{}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if jp.Get(key) == nil {
+			verr.Errors = append(verr.Errors, &ParamValidationError{
+				Param: key,
+				Error: "unknown param",
+			})
+		}
+	}
+
+	result := jp.DefaultValues()
+	for idx, p := range jp {
+		value := values.Get(p.Name)
+		// Masked secret was sent back, e.g. when a build is started from the
+		// build page
+		if p.Secret && value == SecretMask {
+			value = ""
+		}
+		if value == "" {
+			value = p.Default
+		}
+		err := p.Validate(value)
+		if err != nil {
+			verr.Errors = append(verr.Errors, &ParamValidationError{
+				Param: p.Name,
+				Error: err.Error(),
+			})
+			continue
+		}
+		result[idx][p.Name] = value
+	}
+	if len(verr.Errors) > 0 {
+		return nil, verr
+	}
+	return result, nil
+}
+
+// MaskSecrets returns a copy of build params where values of secret params
+// are replaced with SecretMask
+func (jp JobParams) MaskSecrets(params []map[string]string) []map[string]string {
+	masked := make([]map[string]string, 0, len(params))
+	for idx := range params {
+		item := make(map[string]string, len(params[idx]))
+		for key, value := range params[idx] {
+			p := jp.Get(key)
+			if p != nil && p.Secret && value != "" {
+				value = SecretMask
+			}
+			item[key] = value
+		}
+		masked = append(masked, item)
+	}
+	return masked
+}
+
+// Masked returns a copy of params where default values of secret params are
+// replaced with SecretMask
+func (jp JobParams) Masked() JobParams {
+	masked := make(JobParams, 0, len(jp))
+	for _, p := range jp {
+		mp := *p
+		if mp.Secret && mp.Default != "" {
+			mp.Default = SecretMask
+		}
+		masked = append(masked, &mp)
+	}
+	return masked
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/sasha-s/go-deadlock"
 
@@ -12,6 +14,7 @@ import (
 type Queue struct {
 	queued           []*Build
 	running          []*Build
+	waiting          []*Build // Builds which are waiting for approval
 	mutex            deadlock.Mutex
 	concurrentBuilds int
 }
@@ -23,25 +26,23 @@ func (q *Queue) Take() {
 	var foundItem bool
 	var foundItemID int
 	if toRun {
-	QLoop:
-		for id, qItem := range q.queued {
-			Logger.Printf("Inspecting build %d from queue\n", qItem.ID)
-			if !qItem.Job.AllowParallel {
-				// Verify that other build of the same job is not running
-				for _, rItem := range q.running {
-					if rItem.Job.Name == qItem.Job.Name {
-						continue QLoop
-					}
-				}
+		for id, reason := range q.getWaitingReasons() {
+			if reason == "" {
+				foundItem = true
+				foundItemID = id
+				break
 			}
-			foundItem = true
-			foundItemID = id
-			break
+			Logger.Printf("Build %d is waiting: %s\n", q.queued[id].ID, reason)
 		}
 		if foundItem {
 			Logger.Printf("Running item %d, build %d\n", foundItemID, q.queued[foundItemID].ID)
 			q.running = append(q.running, q.queued[foundItemID])
-			go q.queued[foundItemID].Start()
+			if q.queued[foundItemID].resuming {
+				q.queued[foundItemID].resuming = false
+				q.queued[foundItemID].resumeChannel <- true
+			} else {
+				go q.queued[foundItemID].Start()
+			}
 			q.queued[foundItemID] = nil
 			q.queued = append(q.queued[:foundItemID], q.queued[foundItemID+1:]...)
 		} else {
@@ -51,19 +52,188 @@ func (q *Queue) Take() {
 	q.mutex.Unlock()
 	if toRun && foundItem {
 		q.Take()
+		return
 	}
 	Logger.Printf("Executing %d builds, %d in queue\n", len(q.running), len(q.queued))
+	q.BroadcastUpdate()
+}
+
+// getWaitingReasons returns a reason why each of the queued builds can't be
+// started, not taking into account availability of executors for builds which
+// are not starving. Empty reason means that the build can be started. Should
+// be called when q.mutex is locked
+func (q *Queue) getWaitingReasons() []string {
+	reasons := make([]string, len(q.queued))
+	free := q.concurrentBuilds - len(q.running)
+	// Number of executors which are reserved for blocked starving builds
+	reserved := 0
+	// Locks requested by builds which are waiting for them. Builds further
+	// in the queue can't take these locks, so a stream of readers doesn't
+	// starve a writer
+	reservedLocks := map[*JobLock]int{}
+	for id, qItem := range q.queued {
+		reasons[id] = q.getBlockingReason(qItem, reservedLocks)
+		if reasons[id] != "" {
+			for _, l := range qItem.Job.Locks {
+				reservedLocks[l] = qItem.ID
+			}
+			if q.isStarving(qItem) {
+				reserved++
+			}
+			continue
+		}
+		if reserved > 0 && reserved >= free {
+			reasons[id] = "executors are reserved for starving builds"
+		}
+	}
+	return reasons
+}
+
+// getBlockingReason returns a reason why the build can't run at the same time
+// with builds holding their locks or has to wait for locks reserved by builds
+// earlier in the queue. Should be called when q.mutex is locked
+func (q *Queue) getBlockingReason(qItem *Build, reservedLocks map[*JobLock]int) string {
+	holders := q.getHolders()
+	if !qItem.Job.AllowParallel {
+		// Verify that other build of the same job is not running
+		for _, hItem := range holders {
+			if hItem != qItem && hItem.Job.Name == qItem.Job.Name {
+				return fmt.Sprintf("build %d of the same job is %s", hItem.ID, describeHolder(hItem))
+			}
+		}
+	}
+	if qItem.ConcurrencyGroup != "" {
+		// Verify that other build of the same concurrency group is not running
+		for _, hItem := range holders {
+			if hItem != qItem && hItem.ConcurrencyGroup == qItem.ConcurrencyGroup {
+				return fmt.Sprintf("build %d of concurrency group %s is %s", hItem.ID, qItem.ConcurrencyGroup, describeHolder(hItem))
+			}
+		}
+	}
+	if len(qItem.Job.Locks) > 0 {
+		// Verify that required locks are available
+		for _, hItem := range holders {
+			if hItem == qItem {
+				continue
+			}
+			lock := findLockConflict(qItem.Job.Locks, hItem.Job.Locks)
+			if lock != nil {
+				return fmt.Sprintf("waiting for lock %s held by build %d", lock.Name, hItem.ID)
+			}
+		}
+		for rLock, buildID := range reservedLocks {
+			lock := findLockConflict(qItem.Job.Locks, []*JobLock{rLock})
+			if lock != nil {
+				return fmt.Sprintf("lock %s is reserved by build %d", lock.Name, buildID)
+			}
+		}
+	}
+	return ""
+}
+
+// getHolders returns builds which hold their locks and concurrency groups:
+// running builds and builds which are paused for approval. The latter don't
+// occupy executors, but keep everything else until they are finished. Should
+// be called when q.mutex is locked
+func (q *Queue) getHolders() []*Build {
+	holders := make([]*Build, 0, len(q.running)+len(q.waiting))
+	holders = append(holders, q.running...)
+	holders = append(holders, q.waiting...)
+	for _, item := range q.queued {
+		if item.resuming {
+			holders = append(holders, item)
+		}
+	}
+	return holders
+}
+
+// describeHolder returns what the build holding its locks is doing
+func describeHolder(b *Build) string {
+	if b.getStatus() == StatusWaiting {
+		return "paused for approval"
+	}
+	return "running"
+}
+
+// isStarving returns true if the build is waiting in the queue for too long
+func (q *Queue) isStarving(b *Build) bool {
+	return Config.starvationTimeout > 0 && time.Since(b.QueuedAt) > Config.starvationTimeout
+}
+
+// getEffectivePriority returns priority of the build which increases the
+// longer the build is waiting in the queue
+func (q *Queue) getEffectivePriority(b *Build) int {
+	priority := b.Priority
+	if Config.priorityAging > 0 && !b.QueuedAt.IsZero() {
+		priority += int(time.Since(b.QueuedAt) / Config.priorityAging)
+	}
+	return priority
+}
+
+// CountQueued returns number of queued builds of the job
+func (q *Queue) CountQueued(jobName string) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.countQueued(jobName)
+}
+
+// countQueued should be called when q.mutex is locked
+func (q *Queue) countQueued(jobName string) int {
+	count := 0
+	for _, item := range q.queued {
+		if item.Job.Name == jobName {
+			count++
+		}
+	}
+	return count
 }
 
-// Add adds build to the queue
-func (q *Queue) Add(b *Build) {
+// GetSize returns number of running, waiting and queued builds and the
+// number of concurrent builds
+func (q *Queue) GetSize() (int, int, int, int) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
+	return len(q.running), len(q.waiting), len(q.queued), q.concurrentBuilds
+}
+
+// QueueFullError is returned when the job already has max_queued builds in
+// the queue
+type QueueFullError struct {
+	Job       string
+	MaxQueued int
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("job %s already has %d queued builds", e.Job, e.MaxQueued)
+}
+
+// Add adds build to the queue. Returns QueueFullError if the job already has
+// max_queued builds in the queue
+func (q *Queue) Add(b *Build) error {
+	q.mutex.Lock()
+	if b.Job.MaxQueued > 0 && q.countQueued(b.Job.Name) >= b.Job.MaxQueued {
+		q.mutex.Unlock()
+		return &QueueFullError{Job: b.Job.Name, MaxQueued: b.Job.MaxQueued}
+	}
+	b.QueuedAt = time.Now()
+	q.insert(b)
+	q.mutex.Unlock()
+	Logger.Printf("New build queued: %s %d\n", b.Job.Name, b.ID)
+	q.BroadcastUpdate()
+	return nil
+}
+
+// insert inserts build in the queue according to its effective priority.
+// Queued builds gain priority at the same rate, so the order of builds which
+// are already in the queue remains valid. Should be called when q.mutex is
+// locked
+func (q *Queue) insert(b *Build) {
 	q.queued = append(q.queued, b)
 	// Possibly shift queue
-	if b.Job.Priority != 0 {
+	priority := q.getEffectivePriority(b)
+	if priority != 0 {
 		for id, qItem := range q.queued {
-			if b.Job.Priority > qItem.Job.Priority {
+			if priority > q.getEffectivePriority(qItem) {
 				newQueue := make([]*Build, len(q.queued))
 				copy(newQueue, q.queued[:id])
 				newQueue[id] = q.queued[len(q.queued)-1]
@@ -73,12 +243,12 @@ func (q *Queue) Add(b *Build) {
 			}
 		}
 	}
-	Logger.Printf("New build queued: %s %d\n", b.Job.Name, b.ID)
 }
 
 // Remove removes a build from Queue
 func (q *Queue) Remove(id int) {
 	q.mutex.Lock()
+	defer q.BroadcastUpdate()
 	defer q.mutex.Unlock()
 	for i, ex := range q.running {
 		if ex.ID == id {
@@ -92,9 +262,236 @@ func (q *Queue) Remove(id int) {
 			return
 		}
 	}
+	for i, ex := range q.waiting {
+		if ex.ID == id {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
 	Logger.Printf("Build %d was not found in Q\n", id)
 }
 
+// Move moves a queued build to the new position in the queue
+func (q *Queue) Move(id int, position int) error {
+	q.mutex.Lock()
+	found := false
+	for i, item := range q.queued {
+		if item.ID == id {
+			if position < 0 {
+				position = 0
+			}
+			if position > len(q.queued)-1 {
+				position = len(q.queued) - 1
+			}
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			q.queued = append(q.queued[:position], append([]*Build{item}, q.queued[position:]...)...)
+			Logger.Printf("Build %d moved to position %d in Q\n", id, position)
+			found = true
+			break
+		}
+	}
+	q.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("Build %d is not queued", id)
+	}
+	q.Take()
+	return nil
+}
+
+// SetPriority changes priority of a queued build and updates its position
+// in the queue
+func (q *Queue) SetPriority(id int, priority int) error {
+	q.mutex.Lock()
+	found := false
+	for i, item := range q.queued {
+		if item.ID == id {
+			item.Priority = priority
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			q.insert(item)
+			Logger.Printf("Priority of build %d changed to %d\n", id, priority)
+			found = true
+			break
+		}
+	}
+	q.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("Build %d is not queued", id)
+	}
+	q.Take()
+	return nil
+}
+
+// estimateTimeToStart returns estimated duration before each of the queued
+// builds starts, -1 if it is unknown. It is based on ETA of running and queued
+// builds. Should be called when q.mutex is locked
+func (q *Queue) estimateTimeToStart() []time.Duration {
+	estimates := make([]time.Duration, len(q.queued))
+	if q.concurrentBuilds <= 0 {
+		for i := range estimates {
+			estimates[i] = -1
+		}
+		return estimates
+	}
+
+	// Builds which occupy executors, with time when they are finished
+	type estimatedBuild struct {
+		build  *Build
+		finish time.Duration
+	}
+	var builds []*estimatedBuild
+	var finishes []time.Duration
+	for _, rItem := range q.running {
+		finish := time.Duration(rItem.getETA()) - time.Since(rItem.getStartedAt())
+		if finish < 0 {
+			finish = 0
+		}
+		builds = append(builds, &estimatedBuild{build: rItem, finish: finish})
+		finishes = append(finishes, finish)
+	}
+
+	// Time when each of executors becomes available. If there are more running
+	// builds than executors (number of concurrent builds was decreased), an
+	// executor is available only when enough builds are finished
+	sort.Slice(finishes, func(i, j int) bool {
+		return finishes[i] < finishes[j]
+	})
+	for len(finishes) < q.concurrentBuilds {
+		finishes = append([]time.Duration{0}, finishes...)
+	}
+	executors := finishes[len(finishes)-q.concurrentBuilds:]
+
+	for i, qItem := range q.queued {
+		// Builds which are paused for approval may hold their locks for
+		// unknown time
+		if q.conflictsWithWaiting(qItem) {
+			estimates[i] = -1
+			continue
+		}
+		// Take the first available executor
+		executor := 0
+		for e := range executors {
+			if executors[e] < executors[executor] {
+				executor = e
+			}
+		}
+		start := executors[executor]
+		// Wait for builds which can't run at the same time
+		for _, eItem := range builds {
+			sameJob := !qItem.Job.AllowParallel && eItem.build.Job.Name == qItem.Job.Name
+			sameGroup := qItem.ConcurrencyGroup != "" && eItem.build.ConcurrencyGroup == qItem.ConcurrencyGroup
+			if sameJob || sameGroup || findLockConflict(qItem.Job.Locks, eItem.build.Job.Locks) != nil {
+				if eItem.finish > start {
+					start = eItem.finish
+				}
+			}
+		}
+		finish := start + time.Duration(qItem.getETA())
+		estimates[i] = start
+		executors[executor] = finish
+		builds = append(builds, &estimatedBuild{build: qItem, finish: finish})
+	}
+	return estimates
+}
+
+// conflictsWithWaiting returns true if the build can't run while builds which
+// are paused for approval are not finished. Should be called when q.mutex is
+// locked
+func (q *Queue) conflictsWithWaiting(qItem *Build) bool {
+	for _, wItem := range q.waiting {
+		sameJob := !qItem.Job.AllowParallel && wItem.Job.Name == qItem.Job.Name
+		sameGroup := qItem.ConcurrencyGroup != "" && wItem.ConcurrencyGroup == qItem.ConcurrencyGroup
+		if sameJob || sameGroup || findLockConflict(qItem.Job.Locks, wItem.Job.Locks) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// GetState returns information about running and queued builds
+func (q *Queue) GetState() *QueueStateData {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	state := QueueStateData{
+		ConcurrentBuilds: q.concurrentBuilds,
+		Running:          []*QueueItemData{},
+		Waiting:          []*QueueItemData{},
+		Queued:           []*QueueItemData{},
+		Locks:            q.getLocksState(),
+	}
+	for i, rItem := range q.running {
+		state.Running = append(state.Running, &QueueItemData{
+			ID:                rItem.ID,
+			Name:              rItem.Job.Name,
+			Status:            rItem.getStatus(),
+			Position:          i,
+			Priority:          rItem.Priority,
+			EffectivePriority: rItem.Priority,
+			Params:            rItem.Job.Params.MaskSecrets(rItem.Params),
+			Locks:             rItem.Job.Locks,
+			QueuedAt:          rItem.QueuedAt,
+			WaitTime:          rItem.getStartedAt().Sub(rItem.QueuedAt),
+			StartedAt:         rItem.getStartedAt(),
+			ETA:               rItem.getETA(),
+		})
+	}
+	for i, wItem := range q.waiting {
+		state.Waiting = append(state.Waiting, &QueueItemData{
+			ID:                wItem.ID,
+			Name:              wItem.Job.Name,
+			Status:            wItem.getStatus(),
+			Position:          i,
+			Priority:          wItem.Priority,
+			EffectivePriority: wItem.Priority,
+			Params:            wItem.Job.Params.MaskSecrets(wItem.Params),
+			Locks:             wItem.Job.Locks,
+			WaitingReason:     "waiting for approval",
+			QueuedAt:          wItem.QueuedAt,
+			StartedAt:         wItem.getStartedAt(),
+			ETA:               wItem.getETA(),
+			ETAToStart:        -1,
+		})
+	}
+	reasons := q.getWaitingReasons()
+	estimates := q.estimateTimeToStart()
+	free := q.concurrentBuilds - len(q.running)
+	for i, qItem := range q.queued {
+		reason := reasons[i]
+		if reason == "" {
+			if free > 0 {
+				free--
+			} else {
+				reason = "waiting for a free executor"
+			}
+		}
+		state.Queued = append(state.Queued, &QueueItemData{
+			ID:                qItem.ID,
+			Name:              qItem.Job.Name,
+			Status:            qItem.getStatus(),
+			Position:          i,
+			Priority:          qItem.Priority,
+			Params:            qItem.Job.Params.MaskSecrets(qItem.Params),
+			Locks:             qItem.Job.Locks,
+			WaitingReason:     reason,
+			QueuedAt:          qItem.QueuedAt,
+			WaitTime:          time.Since(qItem.QueuedAt),
+			EffectivePriority: q.getEffectivePriority(qItem),
+			ETA:               qItem.getETA(),
+			ETAToStart:        estimates[i],
+		})
+	}
+	return &state
+}
+
+// BroadcastUpdate sends current state of the queue to all subscribed clients
+func (q *Queue) BroadcastUpdate() {
+	msg := MsgBroadcast{
+		Type: "queue:update",
+		Data: q.GetState(),
+	}
+	WSHub.broadcast <- &msg
+	q.BroadcastLocksUpdate()
+}
+
 // Verify returns true if a build with provided id is queued or running
 func (q *Queue) Verify(id int) bool {
 	q.mutex.Lock()
@@ -109,39 +506,105 @@ func (q *Queue) Verify(id int) bool {
 			return true
 		}
 	}
+	for _, item := range q.waiting {
+		if item.ID == id {
+			return true
+		}
+	}
 	return false
 }
 
+// GetLogBuffer returns buffer with the latest log messages of a queued or
+// running build
+func (q *Queue) GetLogBuffer(id int) *LogBuffer {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, items := range [][]*Build{q.running, q.waiting, q.queued} {
+		for _, item := range items {
+			if item.ID == id {
+				return item.logBuffer
+			}
+		}
+	}
+	return nil
+}
+
 // Abort schedules build to be aborted
 func (q *Queue) Abort(id int) error {
 	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	// The build is signalled after q.mutex is unlocked, as it may need the
+	// queue to handle the signal
+	var toSignal *Build
+	found := false
 	for _, item := range q.running {
 		if item.ID == id {
-			item.abortedChannel <- true
-			return nil
+			toSignal = item
+			found = true
 		}
 	}
 	for _, item := range q.queued {
 		if item.ID == id {
-			go item.SetBuildStatus(StatusAborted)
-			return nil
+			if item.resuming {
+				// The build is waiting for an executor after approval
+				toSignal = item
+			} else {
+				go item.SetBuildStatus(StatusAborted)
+			}
+			found = true
+		}
+	}
+	for _, item := range q.waiting {
+		if item.ID == id {
+			if item.decided {
+				// The build doesn't read abortedChannel until it is resumed,
+				// so Resume aborts it instead
+				item.abortRequested = true
+			} else {
+				toSignal = item
+			}
+			found = true
 		}
 	}
-	return fmt.Errorf("Build %d not found in Q", id)
+	q.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("Build %d not found in Q", id)
+	}
+	if toSignal != nil {
+		toSignal.abort()
+	}
+	return nil
 }
 
 // FlushLogs instructs to flush logs
 func (q *Queue) FlushLogs(id int) error {
+	b := q.getActiveBuild(id)
+	if b == nil {
+		return fmt.Errorf("Build is not running")
+	}
+	b.flushTaskLogs()
+	return nil
+}
+
+// GetTaskLog returns the log of the task which is being written or nil
+func (q *Queue) GetTaskLog(id int, taskID int) *TaskLog {
+	b := q.getActiveBuild(id)
+	if b == nil {
+		return nil
+	}
+	return b.getTaskLog(taskID)
+}
+
+// getActiveBuild returns the build which has been started: it is running,
+// waiting for approval or waiting for an executor after approval
+func (q *Queue) getActiveBuild(id int) *Build {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	for _, item := range q.running {
+	for _, item := range q.getHolders() {
 		if item.ID == id {
-			item.flushChannel <- true
-			return nil
+			return item
 		}
 	}
-	return fmt.Errorf("Build is not running")
+	return nil
 }
 
 // SetConcurrency sets number of concurrent builds
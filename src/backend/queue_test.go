@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withConfig replaces the global config for the duration of the test
+func withConfig(t *testing.T, config *WakeConfig) {
+	original := Config
+	Config = config
+	t.Cleanup(func() {
+		Config = original
+	})
+}
+
+func newTestBuild(id int, job *Job) *Build {
+	return &Build{ID: id, Job: job, Priority: job.Priority, Status: StatusPending}
+}
+
+func TestGetEffectivePriority(t *testing.T) {
+	cases := []struct {
+		name     string
+		aging    time.Duration
+		priority int
+		waiting  time.Duration
+		expected int
+	}{
+		{"aging is disabled", 0, 5, time.Hour, 5},
+		{"just queued", 10 * time.Minute, 5, time.Second, 5},
+		{"aged", 10 * time.Minute, 5, 35 * time.Minute, 8},
+		{"negative priority", 10 * time.Minute, -3, 20*time.Minute + time.Second, -1},
+		{"not queued yet", 10 * time.Minute, 5, 0, 5},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			withConfig(t, &WakeConfig{priorityAging: c.aging})
+			b := Build{Priority: c.priority}
+			if c.waiting > 0 {
+				b.QueuedAt = time.Now().Add(-c.waiting)
+			}
+			q := Queue{}
+			got := q.getEffectivePriority(&b)
+			if got != c.expected {
+				t.Errorf("expected %d, got %d", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestQueueInsert(t *testing.T) {
+	withConfig(t, &WakeConfig{priorityAging: 10 * time.Minute})
+	now := time.Now()
+	q := Queue{}
+	queue := []struct {
+		id       int
+		priority int
+		waiting  time.Duration
+	}{
+		{1, 0, 30 * time.Minute},
+		{2, 5, 0},
+		{3, 0, 0},
+		// Priority of the first build has increased to 3
+		{4, 3, 0},
+		{5, 4, 0},
+	}
+	for _, item := range queue {
+		b := newTestBuild(item.id, &Job{Name: "job", Priority: item.priority})
+		b.QueuedAt = now.Add(-item.waiting)
+		q.insert(b)
+	}
+	var order []int
+	for _, b := range q.queued {
+		order = append(order, b.ID)
+	}
+	expected := []int{2, 5, 1, 4, 3}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected %v, got %v", expected, order)
+	}
+}
+
+func TestGetWaitingReasons(t *testing.T) {
+	withConfig(t, &WakeConfig{starvationTimeout: time.Hour})
+	lock := func(name string, mode string) []*JobLock {
+		return []*JobLock{{Name: name, Mode: mode}}
+	}
+	running := newTestBuild(1, &Job{Name: "deploy", Locks: lock("db", LockModeWrite)})
+	running.Status = StatusRunning
+	waiting := newTestBuild(2, &Job{Name: "release", ConcurrencyGroup: &ConcurrencyGroup{Name: "prod"}})
+	waiting.Status = StatusWaiting
+	waiting.ConcurrencyGroup = "prod"
+
+	cases := []struct {
+		name     string
+		queued   []*Build
+		starving bool
+		expected []string
+	}{
+		{
+			name:     "free",
+			queued:   []*Build{newTestBuild(10, &Job{Name: "test"})},
+			expected: []string{""},
+		},
+		{
+			name:     "same job",
+			queued:   []*Build{newTestBuild(10, &Job{Name: "deploy"})},
+			expected: []string{"build 1 of the same job is running"},
+		},
+		{
+			name:     "parallel builds of the same job",
+			queued:   []*Build{newTestBuild(10, &Job{Name: "deploy", AllowParallel: true})},
+			expected: []string{""},
+		},
+		{
+			name: "concurrency group of the build waiting for approval",
+			queued: func() []*Build {
+				b := newTestBuild(10, &Job{Name: "hotfix"})
+				b.ConcurrencyGroup = "prod"
+				return []*Build{b}
+			}(),
+			expected: []string{"build 2 of concurrency group prod is paused for approval"},
+		},
+		{
+			name: "locks",
+			queued: []*Build{
+				newTestBuild(10, &Job{Name: "migrate", Locks: lock("db", LockModeRead)}),
+				newTestBuild(11, &Job{Name: "backup", Locks: lock("db", LockModeRead)}),
+				newTestBuild(12, &Job{Name: "test", Locks: lock("cache", LockModeRead)}),
+			},
+			expected: []string{
+				"waiting for lock db held by build 1",
+				"waiting for lock db held by build 1",
+				"",
+			},
+		},
+		{
+			name: "reserved lock",
+			// The blocked build reserves its lock for itself
+			queued: []*Build{
+				newTestBuild(10, &Job{Name: "deploy", Locks: lock("cache", LockModeWrite)}),
+				newTestBuild(11, &Job{Name: "test", Locks: lock("cache", LockModeRead)}),
+			},
+			expected: []string{
+				"build 1 of the same job is running",
+				"lock cache is reserved by build 10",
+			},
+		},
+		{
+			name: "executors are reserved",
+			queued: []*Build{
+				newTestBuild(10, &Job{Name: "migrate", Locks: lock("db", LockModeRead)}),
+				newTestBuild(11, &Job{Name: "test"}),
+			},
+			starving: true,
+			expected: []string{
+				"waiting for lock db held by build 1",
+				"executors are reserved for starving builds",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := Queue{
+				running:          []*Build{running},
+				waiting:          []*Build{waiting},
+				queued:           c.queued,
+				concurrentBuilds: 2,
+			}
+			for _, b := range c.queued {
+				b.QueuedAt = time.Now()
+				if c.starving {
+					b.QueuedAt = b.QueuedAt.Add(-2 * time.Hour)
+				}
+			}
+			got := q.getWaitingReasons()
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
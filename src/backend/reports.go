@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Statuses of a test case
+const (
+	TestPassed  = "passed"
+	TestFailed  = "failed"
+	TestSkipped = "skipped"
+)
+
+// TestHistorySize is the number of the latest results of a test which are
+// used to detect flaky tests
+const TestHistorySize = 20
+
+// FlakyMinFlips is the number of changes between passed and failed within the
+// history of a test which make it flaky. A regression which is fixed later
+// changes the result only twice
+const FlakyMinFlips = 3
+
+// SlowestTestsCount is the number of the slowest tests in TestSummary
+const SlowestTestsCount = 10
+
+// MaxTestMessageSize is the maximum length of a failure message
+const MaxTestMessageSize = 4096
+
+// TestCaseResult is a result of a single test case
+type TestCaseResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Message  string        `json:"message,omitempty"`
+	Flaky    bool          `json:"flaky,omitempty"`
+}
+
+// TestSummary is a summary of all test reports of the build
+type TestSummary struct {
+	Total    int               `json:"total"`
+	Passed   int               `json:"passed"`
+	Failed   int               `json:"failed"`
+	Skipped  int               `json:"skipped"`
+	Duration time.Duration     `json:"duration"`
+	Slowest  []*TestCaseResult `json:"slowest"`
+	Failures []*TestCaseResult `json:"failures"`
+	Flaky    []string          `json:"flaky"`
+	Reports  []string          `json:"reports"`
+}
+
+// TestRun is a result of a test in one of the builds
+type TestRun struct {
+	BuildID int    `json:"buildID"`
+	Status  string `json:"status"`
+}
+
+// CollectReports parses test reports from workspace and saves the summary
+func (b *Build) CollectReports() {
+	if len(b.Job.Reports) == 0 {
+		return
+	}
+	var results []*TestCaseResult
+	var reports []string
+	for _, repPattern := range b.Job.Reports {
+		files, err := doublestar.Glob(b.GetWorkspaceDir() + repPattern)
+		if err != nil {
+			b.Logger.Println(err)
+			continue
+		}
+		for _, f := range files {
+			fi, err := os.Stat(f)
+			if err != nil {
+				b.Logger.Println(err)
+				continue
+			}
+			if fi.IsDir() {
+				continue
+			}
+			relPath := strings.TrimPrefix(f, b.GetWorkspaceDir())
+			b.Logger.Printf("Parsing test report %s...\n", relPath)
+			parsed, err := parseTestReport(f)
+			if err != nil {
+				b.Logger.Printf("Unable to parse %s: %s\n", relPath, err.Error())
+				continue
+			}
+			results = append(results, parsed...)
+			reports = append(reports, relPath)
+		}
+	}
+	if len(reports) == 0 {
+		return
+	}
+
+	summary := TestSummary{Reports: reports}
+	for _, r := range results {
+		summary.Total++
+		summary.Duration += r.Duration
+		switch r.Status {
+		case TestPassed:
+			summary.Passed++
+		case TestFailed:
+			summary.Failed++
+			summary.Failures = append(summary.Failures, r)
+		case TestSkipped:
+			summary.Skipped++
+		}
+	}
+	slowest := make([]*TestCaseResult, len(results))
+	copy(slowest, results)
+	sort.SliceStable(slowest, func(i, j int) bool {
+		return slowest[i].Duration > slowest[j].Duration
+	})
+	if len(slowest) > SlowestTestsCount {
+		slowest = slowest[:SlowestTestsCount]
+	}
+	summary.Slowest = slowest
+
+	err := DB.Update(func(tx *bolt.Tx) error {
+		flaky, err := updateTestHistory(tx, b.Job.Name, b.ID, results)
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			if flaky[r.Name] {
+				r.Flaky = true
+			}
+		}
+		for name := range flaky {
+			summary.Flaky = append(summary.Flaky, name)
+		}
+		sort.Strings(summary.Flaky)
+
+		dataB, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(TestsBucket).Put(Itob(b.ID), dataB)
+	})
+	if err != nil {
+		b.Logger.Println(err)
+		return
+	}
+	b.Logger.Printf("Tests: %d total, %d failed, %d skipped, %d flaky\n", summary.Total, summary.Failed, summary.Skipped, len(summary.Flaky))
+}
+
+// updateTestHistory records results of the tests and returns tests which
+// are flaky according to their history
+func updateTestHistory(tx *bolt.Tx, jobName string, buildID int, results []*TestCaseResult) (map[string]bool, error) {
+	jb, err := tx.Bucket(TestHistoryBucket).CreateBucketIfNotExists([]byte(jobName))
+	if err != nil {
+		return nil, err
+	}
+	flaky := map[string]bool{}
+	for _, r := range results {
+		if r.Status == TestSkipped {
+			continue
+		}
+		var history []*TestRun
+		if data := jb.Get([]byte(r.Name)); data != nil {
+			err = json.Unmarshal(data, &history)
+			if err != nil {
+				return nil, err
+			}
+		}
+		history = append(history, &TestRun{BuildID: buildID, Status: r.Status})
+		if len(history) > TestHistorySize {
+			history = history[len(history)-TestHistorySize:]
+		}
+		if isFlaky(history) {
+			flaky[r.Name] = true
+		}
+		dataB, err := json.Marshal(history)
+		if err != nil {
+			return nil, err
+		}
+		err = jb.Put([]byte(r.Name), dataB)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return flaky, nil
+}
+
+// isFlaky returns true if the test alternated between passed and failed
+// at least FlakyMinFlips times, runs are sorted from the oldest
+func isFlaky(history []*TestRun) bool {
+	flips := 0
+	for i := 1; i < len(history); i++ {
+		if history[i].Status != history[i-1].Status {
+			flips++
+		}
+	}
+	return flips >= FlakyMinFlips
+}
+
+// pruneTestHistory removes results of builds which are not newer than
+// buildID. Tests without results are removed
+func pruneTestHistory(tx *bolt.Tx, buildID int) error {
+	hb := tx.Bucket(TestHistoryBucket)
+	var jobs [][]byte
+	err := hb.ForEach(func(key, value []byte) error {
+		if value == nil {
+			jobs = append(jobs, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		jb := hb.Bucket(job)
+		// The bucket can't be modified while it is iterated
+		updates := map[string][]byte{}
+		err = jb.ForEach(func(key, value []byte) error {
+			var history []*TestRun
+			err := json.Unmarshal(value, &history)
+			if err != nil {
+				return err
+			}
+			var kept []*TestRun
+			for _, run := range history {
+				if run.BuildID > buildID {
+					kept = append(kept, run)
+				}
+			}
+			if len(kept) == len(history) {
+				return nil
+			}
+			if len(kept) == 0 {
+				updates[string(key)] = nil
+				return nil
+			}
+			dataB, err := json.Marshal(kept)
+			if err != nil {
+				return err
+			}
+			updates[string(key)] = dataB
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for name, dataB := range updates {
+			if dataB == nil {
+				err = jb.Delete([]byte(name))
+			} else {
+				err = jb.Put([]byte(name), dataB)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseTestReport detects the format of the report (JUnit XML, go test2json
+// or TAP) and parses it
+func parseTestReport(filename string) ([]*TestCaseResult, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("report is empty")
+	}
+	switch trimmed[0] {
+	case '<':
+		return parseJUnitReport(data)
+	case '{':
+		return parseTest2JSONReport(data)
+	default:
+		return parseTAPReport(data, filepath.Base(filename))
+	}
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Error     *junitMessage `xml:"error"`
+	Skipped   *junitMessage `xml:"skipped"`
+}
+
+// junitTestSuite describes both <testsuites> and <testsuite> elements
+type junitTestSuite struct {
+	Name      string            `xml:"name,attr"`
+	TestCases []*junitTestCase  `xml:"testcase"`
+	Suites    []*junitTestSuite `xml:"testsuite"`
+}
+
+func parseJUnitReport(data []byte) ([]*TestCaseResult, error) {
+	var root junitTestSuite
+	err := xml.Unmarshal(data, &root)
+	if err != nil {
+		return nil, err
+	}
+	var results []*TestCaseResult
+	var walk func(suite *junitTestSuite)
+	walk = func(suite *junitTestSuite) {
+		for _, tc := range suite.TestCases {
+			prefix := tc.Classname
+			if prefix == "" {
+				prefix = suite.Name
+			}
+			r := TestCaseResult{Name: tc.Name, Status: TestPassed}
+			if prefix != "" {
+				r.Name = prefix + "." + tc.Name
+			}
+			if seconds, err := strconv.ParseFloat(tc.Time, 64); err == nil {
+				r.Duration = time.Duration(seconds * float64(time.Second))
+			}
+			switch {
+			case tc.Failure != nil:
+				r.Status = TestFailed
+				r.Message = tc.Failure.text()
+			case tc.Error != nil:
+				r.Status = TestFailed
+				r.Message = tc.Error.text()
+			case tc.Skipped != nil:
+				r.Status = TestSkipped
+				r.Message = tc.Skipped.text()
+			}
+			results = append(results, &r)
+		}
+		for _, s := range suite.Suites {
+			walk(s)
+		}
+	}
+	walk(&root)
+	return results, nil
+}
+
+func (m *junitMessage) text() string {
+	return truncateTestMessage(strings.TrimSpace(m.Message + "\n" + strings.TrimSpace(m.Body)))
+}
+
+type test2jsonEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+func parseTest2JSONReport(data []byte) ([]*TestCaseResult, error) {
+	var results []*TestCaseResult
+	output := map[string]*strings.Builder{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		var ev test2jsonEvent
+		err := json.Unmarshal(line, &ev)
+		if err != nil {
+			return nil, err
+		}
+		// Events without a test describe the whole package
+		if ev.Test == "" {
+			continue
+		}
+		name := ev.Package + "." + ev.Test
+		switch ev.Action {
+		case "output":
+			if _, ok := output[name]; !ok {
+				output[name] = &strings.Builder{}
+			}
+			output[name].WriteString(ev.Output)
+		case "pass", "fail", "skip":
+			r := TestCaseResult{
+				Name:     name,
+				Duration: time.Duration(ev.Elapsed * float64(time.Second)),
+			}
+			switch ev.Action {
+			case "pass":
+				r.Status = TestPassed
+			case "fail":
+				r.Status = TestFailed
+			case "skip":
+				r.Status = TestSkipped
+			}
+			if r.Status != TestPassed && output[name] != nil {
+				r.Message = truncateTestMessage(strings.TrimSpace(output[name].String()))
+			}
+			delete(output, name)
+			results = append(results, &r)
+		}
+	}
+	return results, scanner.Err()
+}
+
+// tapLineRE matches TAP test lines, e.g. `not ok 2 - description # SKIP reason`
+var tapLineRE = regexp.MustCompile(`^(not ok|ok)\b\s*(\d+)?\s*-?\s*([^#]*?)\s*(?:#\s*(\w+)\s*(.*))?$`)
+
+func parseTAPReport(data []byte, filename string) ([]*TestCaseResult, error) {
+	var results []*TestCaseResult
+	var last *TestCaseResult
+	var diagnostic []string
+	inDiagnostic := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		// YAML diagnostic block of the previous test
+		if inDiagnostic {
+			if trimmed == "..." {
+				inDiagnostic = false
+				if last != nil && last.Status == TestFailed {
+					last.Message = truncateTestMessage(strings.Join(diagnostic, "\n"))
+				}
+				continue
+			}
+			diagnostic = append(diagnostic, trimmed)
+			continue
+		}
+		if trimmed == "---" && last != nil {
+			inDiagnostic = true
+			diagnostic = nil
+			continue
+		}
+		match := tapLineRE.FindStringSubmatch(trimmed)
+		if match == nil {
+			continue
+		}
+		r := TestCaseResult{Name: match[3], Status: TestPassed}
+		if r.Name == "" {
+			r.Name = "test " + match[2]
+		}
+		r.Name = filename + ": " + r.Name
+		if match[1] == "not ok" {
+			r.Status = TestFailed
+		}
+		switch strings.ToUpper(match[4]) {
+		case "SKIP":
+			r.Status = TestSkipped
+			r.Message = match[5]
+		case "TODO":
+			// Failures of TODO tests are expected
+			if r.Status == TestFailed {
+				r.Status = TestSkipped
+			}
+			r.Message = match[5]
+		}
+		last = &r
+		results = append(results, &r)
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no tests found")
+	}
+	return results, scanner.Err()
+}
+
+func truncateTestMessage(msg string) string {
+	if len(msg) > MaxTestMessageSize {
+		return msg[:MaxTestMessageSize] + "..."
+	}
+	return msg
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestParseJUnitReport(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		expected []*TestCaseResult
+	}{
+		{
+			name: "single suite",
+			data: `<testsuite name="suite">
+  <testcase name="ok" time="1.5"/>
+  <testcase classname="pkg.Class" name="fails"><failure message="boom">trace</failure></testcase>
+  <testcase name="errors"><error message="panic"/></testcase>
+  <testcase name="skipped"><skipped message="later"/></testcase>
+</testsuite>`,
+			expected: []*TestCaseResult{
+				{Name: "suite.ok", Status: TestPassed, Duration: 1500 * time.Millisecond},
+				{Name: "pkg.Class.fails", Status: TestFailed, Message: "boom\ntrace"},
+				{Name: "suite.errors", Status: TestFailed, Message: "panic"},
+				{Name: "suite.skipped", Status: TestSkipped, Message: "later"},
+			},
+		},
+		{
+			name: "nested suites",
+			data: `<testsuites>
+  <testsuite name="first"><testcase name="a"/></testsuite>
+  <testsuite name="second"><testcase name="b" time="invalid"/></testsuite>
+</testsuites>`,
+			expected: []*TestCaseResult{
+				{Name: "first.a", Status: TestPassed},
+				{Name: "second.b", Status: TestPassed},
+			},
+		},
+		{
+			name:     "no tests",
+			data:     `<testsuites/>`,
+			expected: nil,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			results, err := parseJUnitReport([]byte(c.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(results, c.expected) {
+				t.Errorf("expected %s, got %s", dumpResults(c.expected), dumpResults(results))
+			}
+		})
+	}
+
+	_, err := parseJUnitReport([]byte("<testsuite>"))
+	if err == nil {
+		t.Error("expected error for invalid XML")
+	}
+}
+
+func TestParseTest2JSONReport(t *testing.T) {
+	data := `{"Action":"run","Package":"pkg","Test":"TestA"}
+{"Action":"output","Package":"pkg","Test":"TestA","Output":"=== RUN TestA\n"}
+{"Action":"pass","Package":"pkg","Test":"TestA","Elapsed":0.25}
+{"Action":"output","Package":"pkg","Test":"TestB","Output":"expected 1\n"}
+{"Action":"fail","Package":"pkg","Test":"TestB","Elapsed":1}
+not a json line
+{"Action":"skip","Package":"pkg","Test":"TestC"}
+{"Action":"fail","Package":"pkg","Elapsed":1.25}
+`
+	expected := []*TestCaseResult{
+		{Name: "pkg.TestA", Status: TestPassed, Duration: 250 * time.Millisecond},
+		{Name: "pkg.TestB", Status: TestFailed, Duration: time.Second, Message: "expected 1"},
+		{Name: "pkg.TestC", Status: TestSkipped},
+	}
+	results, err := parseTest2JSONReport([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %s, got %s", dumpResults(expected), dumpResults(results))
+	}
+}
+
+func TestParseTAPReport(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		expected []*TestCaseResult
+		err      bool
+	}{
+		{
+			name: "statuses",
+			data: `TAP version 13
+1..5
+ok 1 - first
+not ok 2 - second
+ok 3 - third # SKIP no network
+not ok 4 - fourth # TODO not implemented
+ok 5
+`,
+			expected: []*TestCaseResult{
+				{Name: "t.tap: first", Status: TestPassed},
+				{Name: "t.tap: second", Status: TestFailed},
+				{Name: "t.tap: third", Status: TestSkipped, Message: "no network"},
+				{Name: "t.tap: fourth", Status: TestSkipped, Message: "not implemented"},
+				{Name: "t.tap: test 5", Status: TestPassed},
+			},
+		},
+		{
+			name: "diagnostic",
+			data: `ok 1 - first
+  ---
+  ignored: passed
+  ...
+not ok 2 - second
+  ---
+  message: expected 1
+  got: 2
+  ...
+`,
+			expected: []*TestCaseResult{
+				{Name: "t.tap: first", Status: TestPassed},
+				{Name: "t.tap: second", Status: TestFailed, Message: "message: expected 1\ngot: 2"},
+			},
+		},
+		{
+			name: "no tests",
+			data: "1..0\n",
+			err:  true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			results, err := parseTAPReport([]byte(c.data), "t.tap")
+			if c.err {
+				if err == nil {
+					t.Errorf("expected error, got %s", dumpResults(results))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(results, c.expected) {
+				t.Errorf("expected %s, got %s", dumpResults(c.expected), dumpResults(results))
+			}
+		})
+	}
+}
+
+func TestIsFlaky(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []string
+		expected bool
+	}{
+		{"empty", nil, false},
+		{"always passed", []string{TestPassed, TestPassed, TestPassed}, false},
+		{"broken", []string{TestPassed, TestPassed, TestFailed, TestFailed}, false},
+		{"broken and fixed", []string{TestPassed, TestFailed, TestFailed, TestPassed}, false},
+		{"alternating", []string{TestPassed, TestFailed, TestPassed, TestFailed}, true},
+		{"fixed and broken again", []string{TestFailed, TestPassed, TestPassed, TestFailed, TestPassed}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var history []*TestRun
+			for i, status := range c.statuses {
+				history = append(history, &TestRun{BuildID: i + 1, Status: status})
+			}
+			if isFlaky(history) != c.expected {
+				t.Errorf("expected %t for %v", c.expected, c.statuses)
+			}
+		})
+	}
+}
+
+func TestPruneTestHistory(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	history := map[string][]*TestRun{
+		"old":   {{BuildID: 1, Status: TestPassed}, {BuildID: 2, Status: TestFailed}},
+		"mixed": {{BuildID: 2, Status: TestPassed}, {BuildID: 3, Status: TestPassed}},
+		"new":   {{BuildID: 4, Status: TestFailed}},
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		hb, err := tx.CreateBucket(TestHistoryBucket)
+		if err != nil {
+			return err
+		}
+		jb, err := hb.CreateBucket([]byte("job"))
+		if err != nil {
+			return err
+		}
+		for name, runs := range history {
+			dataB, err := json.Marshal(runs)
+			if err != nil {
+				return err
+			}
+			err = jb.Put([]byte(name), dataB)
+			if err != nil {
+				return err
+			}
+		}
+		return pruneTestHistory(tx, 2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]*TestRun{
+		"mixed": {{BuildID: 3, Status: TestPassed}},
+		"new":   {{BuildID: 4, Status: TestFailed}},
+	}
+	got := map[string][]*TestRun{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(TestHistoryBucket).Bucket([]byte("job")).ForEach(func(key, value []byte) error {
+			var runs []*TestRun
+			err := json.Unmarshal(value, &runs)
+			got[string(key)] = runs
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func dumpResults(results []*TestCaseResult) string {
+	dataB, _ := json.Marshal(results)
+	return string(dataB)
+}
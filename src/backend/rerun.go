@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/jsnjack/cmd"
+	bolt "go.etcd.io/bbolt"
+)
+
+// RerunFromFailedTask is a value of `from_task` which means that the build
+// is restarted from the first failed task
+const RerunFromFailedTask = "failed"
+
+// RerunBuild creates a new build from the job config and params of the
+// original build. If fromTask is provided, the workspace of the original build
+// is reused and all main tasks before fromTask are skipped
+func RerunBuild(originalID int, fromTask string) (*Build, error) {
+	var original BuildUpdateData
+	err := DB.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket(HistoryBucket)
+		ud := hb.Get(Itob(originalID))
+		if ud == nil {
+			return fmt.Errorf("build %d not found", originalID)
+		}
+		return json.Unmarshal(ud, &original)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch original.Status {
+	case StatusPending, StatusRunning, StatusWaiting:
+		if GlobalQueue.Verify(originalID) {
+			return nil, fmt.Errorf("build %d is not completed", originalID)
+		}
+	}
+
+	jobFile := Config.WorkDir + "wakespace/" + strconv.Itoa(originalID) + "/build" + Config.jobsExt
+	job, err := CreateJobFromBuildFile(jobFile)
+	if err != nil {
+		return nil, err
+	}
+	// Job name is generated from the file name
+	job.Name = original.Name
+
+	// Verify which tasks can be skipped before creating the build
+	skipTo := -1
+	if fromTask != "" {
+		if len(job.Tasks) != len(original.Tasks) {
+			return nil, fmt.Errorf("tasks of build %d have changed", originalID)
+		}
+		if fromTask == RerunFromFailedTask {
+			for _, t := range original.Tasks {
+				if t.Kind == KindMain && (t.Status == StatusFailed || t.Status == StatusAborted) {
+					skipTo = t.ID
+					break
+				}
+			}
+			if skipTo == -1 {
+				return nil, fmt.Errorf("build %d doesn't have failed tasks", originalID)
+			}
+		} else {
+			skipTo, err = strconv.Atoi(fromTask)
+			if err != nil {
+				return nil, fmt.Errorf("invalid task id: %s", fromTask)
+			}
+			if skipTo < 0 || skipTo >= len(job.Tasks) || job.Tasks[skipTo].Kind != KindMain {
+				return nil, fmt.Errorf("task %d is not a main task of build %d", skipTo, originalID)
+			}
+		}
+		for _, t := range original.Tasks {
+			if t.Kind == KindMain && t.ID < skipTo && t.Status != StatusFinished && t.Status != StatusSkipped {
+				return nil, fmt.Errorf("task %d of build %d has not succeeded", t.ID, originalID)
+			}
+		}
+	}
+
+	// Values of secret params are not stored, defaults are used instead
+	values := url.Values{}
+	for idx := range original.Params {
+		for pkey, pval := range original.Params[idx] {
+			values.Set(pkey, pval)
+		}
+	}
+	err = job.Params.ResolveChoices(job.Name)
+	if err != nil {
+		return nil, err
+	}
+	buildParams, err := job.Params.ApplyParams(values)
+	if err != nil {
+		return nil, err
+	}
+
+	originalWorkspace := Config.WorkDir + "workspace/" + strconv.Itoa(originalID) + "/"
+	if skipTo != -1 {
+		if _, err := os.Stat(originalWorkspace); err != nil {
+			return nil, err
+		}
+	}
+
+	build, err := CreateBuild(job, jobFile, buildParams)
+	if err != nil {
+		return nil, err
+	}
+	build.RerunOf = originalID
+	build.Logger.Printf("Rerun of build %d\n", originalID)
+
+	if skipTo != -1 {
+		build.Logger.Printf("Copying workspace of build %d...\n", originalID)
+		c := cmd.NewCmd("cp", "-a", originalWorkspace+".", build.GetWorkspaceDir())
+		s := <-c.Start()
+		if s.Exit != 0 {
+			build.discard()
+			return nil, fmt.Errorf("unable to copy workspace of build %d, code %d", originalID, s.Exit)
+		}
+		for _, t := range build.Job.Tasks {
+			if t.Kind == KindMain && t.ID < skipTo {
+				t.Status = StatusSkipped
+				// Keep outputs of the skipped tasks for the following ones
+				t.outputs = original.Tasks[t.ID].Outputs
+			}
+		}
+	}
+
+	err = ScheduleBuild(build)
+	if err != nil {
+		return nil, err
+	}
+	return build, nil
+}
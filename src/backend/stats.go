@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// StatsBucketName is the name of the nested bucket in the job's bucket in
+// JobsBucket which contains BuildStatsRecord of every terminal build
+const StatsBucketName = "stats"
+
+// MaxStatsRecords is the number of the latest builds of a job which are kept
+// for statistics
+const MaxStatsRecords = 1000
+
+// DefaultStatsWindow is the default period for job statistics
+const DefaultStatsWindow = 30 * 24 * time.Hour
+
+// BuildStatsRecord describes a terminal build
+type BuildStatsRecord struct {
+	BuildID    int                `json:"buildID"`
+	Status     ItemStatus         `json:"status"`
+	FinishedAt time.Time          `json:"finishedAt"`
+	Duration   time.Duration      `json:"duration"`
+	WaitTime   time.Duration      `json:"waitTime"`
+	Params     map[string]string  `json:"params"`
+	Tasks      []*TaskStatsRecord `json:"tasks"`
+}
+
+// TaskStatsRecord describes an executed task of a terminal build
+type TaskStatsRecord struct {
+	Name     string        `json:"name"`
+	Kind     string        `json:"kind"`
+	Status   ItemStatus    `json:"status"`
+	Duration time.Duration `json:"duration"`
+}
+
+// JobStats contains statistics of builds of the job within the window
+type JobStats struct {
+	Name        string        `json:"name"`
+	Window      time.Duration `json:"window"`
+	Builds      int           `json:"builds"`
+	Finished    int           `json:"finished"`
+	Failed      int           `json:"failed"`
+	Aborted     int           `json:"aborted"`
+	SuccessRate float64       `json:"successRate"`
+	FailureRate float64       `json:"failureRate"`
+	DurationP50 time.Duration `json:"durationP50"`
+	DurationP90 time.Duration `json:"durationP90"`
+	WaitP50     time.Duration `json:"waitP50"`
+	WaitP90     time.Duration `json:"waitP90"`
+	Tasks       []*TaskStats  `json:"tasks"`
+}
+
+// TaskStats contains duration statistics of a task
+type TaskStats struct {
+	Name        string        `json:"name"`
+	Kind        string        `json:"kind"`
+	Count       int           `json:"count"`
+	Failed      int           `json:"failed"`
+	DurationP50 time.Duration `json:"durationP50"`
+	DurationP90 time.Duration `json:"durationP90"`
+}
+
+// JobStatsSummary is a short version of JobStats for the Jobs page
+type JobStatsSummary struct {
+	Builds      int           `json:"builds"`
+	SuccessRate float64       `json:"successRate"`
+	DurationP50 time.Duration `json:"durationP50"`
+}
+
+// RecordBuildStats saves statistics of the terminal build in JobsBucket
+func RecordBuildStats(b *Build) error {
+	record := BuildStatsRecord{
+		BuildID:    b.ID,
+		Status:     b.Status,
+		FinishedAt: time.Now(),
+		Params:     b.getParamsMap(),
+	}
+	// Builds which were removed from the queue have never started
+	if !b.StartedAt.IsZero() {
+		record.Duration = b.Duration
+		record.WaitTime = b.StartedAt.Sub(b.QueuedAt)
+	} else {
+		record.WaitTime = record.FinishedAt.Sub(b.QueuedAt)
+	}
+	b.mutex.Lock()
+	for _, t := range b.Job.Tasks {
+		switch t.Status {
+		case StatusPending, StatusSkipped:
+			continue
+		}
+		record.Tasks = append(record.Tasks, &TaskStatsRecord{
+			Name:     t.Name,
+			Kind:     t.Kind,
+			Status:   t.Status,
+			Duration: t.duration,
+		})
+	}
+	b.mutex.Unlock()
+
+	return DB.Update(func(tx *bolt.Tx) error {
+		jb := tx.Bucket(JobsBucket).Bucket([]byte(b.Job.Name))
+		if jb == nil {
+			return fmt.Errorf("job with name %s is not found in JobsBucket", b.Job.Name)
+		}
+		sb, err := jb.CreateBucketIfNotExists([]byte(StatsBucketName))
+		if err != nil {
+			return err
+		}
+		dataB, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		err = sb.Put(Itob(record.BuildID), dataB)
+		if err != nil {
+			return err
+		}
+		// Remove the oldest records
+		c := sb.Cursor()
+		count := 0
+		for key, _ := c.First(); key != nil; key, _ = c.Next() {
+			count++
+		}
+		toRemove := count - MaxStatsRecords
+		for key, _ := c.First(); key != nil && toRemove > 0; key, _ = c.First() {
+			err = c.Delete()
+			if err != nil {
+				return err
+			}
+			toRemove--
+		}
+		return nil
+	})
+}
+
+// GetPreviousBuildStatus returns status of the latest finished or failed
+// build of the job which is older than the build. Returns empty string if
+// there is no such build
+func GetPreviousBuildStatus(jobName string, buildID int) (ItemStatus, error) {
+	var status ItemStatus
+	err := DB.View(func(tx *bolt.Tx) error {
+		jb := tx.Bucket(JobsBucket).Bucket([]byte(jobName))
+		if jb == nil {
+			return fmt.Errorf("job with name %s is not found in JobsBucket", jobName)
+		}
+		sb := jb.Bucket([]byte(StatsBucketName))
+		if sb == nil {
+			return nil
+		}
+		c := sb.Cursor()
+		key, value := c.Seek(Itob(buildID))
+		if key == nil {
+			key, value = c.Last()
+		} else {
+			key, value = c.Prev()
+		}
+		for ; key != nil; key, value = c.Prev() {
+			var record BuildStatsRecord
+			err := json.Unmarshal(value, &record)
+			if err != nil {
+				return err
+			}
+			// Aborted builds don't change the outcome
+			switch record.Status {
+			case StatusFinished, StatusFailed:
+				status = record.Status
+				return nil
+			}
+		}
+		return nil
+	})
+	return status, err
+}
+
+// GetJobStats calculates statistics of the job's builds which finished within
+// the window
+func GetJobStats(jobName string, window time.Duration) (*JobStats, error) {
+	var stats *JobStats
+	err := DB.View(func(tx *bolt.Tx) error {
+		jb := tx.Bucket(JobsBucket).Bucket([]byte(jobName))
+		if jb == nil {
+			return fmt.Errorf("job with name %s is not found in JobsBucket", jobName)
+		}
+		var err error
+		stats, err = calcJobStats(jb, jobName, window)
+		return err
+	})
+	return stats, err
+}
+
+// calcJobStats calculates statistics from the job's bucket in JobsBucket
+func calcJobStats(jb *bolt.Bucket, jobName string, window time.Duration) (*JobStats, error) {
+	stats := JobStats{Name: jobName, Window: window, Tasks: []*TaskStats{}}
+	sb := jb.Bucket([]byte(StatsBucketName))
+	if sb == nil {
+		return &stats, nil
+	}
+
+	since := time.Now().Add(-window)
+	var durations, waits []time.Duration
+	taskDurations := map[string][]time.Duration{}
+	c := sb.Cursor()
+	for key, value := c.Last(); key != nil; key, value = c.Prev() {
+		var record BuildStatsRecord
+		err := json.Unmarshal(value, &record)
+		if err != nil {
+			return nil, err
+		}
+		if record.FinishedAt.Before(since) {
+			break
+		}
+		stats.Builds++
+		waits = append(waits, record.WaitTime)
+		switch record.Status {
+		case StatusFinished:
+			stats.Finished++
+			durations = append(durations, record.Duration)
+		case StatusFailed:
+			stats.Failed++
+			durations = append(durations, record.Duration)
+		default:
+			stats.Aborted++
+		}
+		for _, t := range record.Tasks {
+			ts := stats.getTask(t.Name, t.Kind)
+			ts.Count++
+			if t.Status == StatusFailed {
+				ts.Failed++
+			}
+			taskKey := t.Kind + "/" + t.Name
+			taskDurations[taskKey] = append(taskDurations[taskKey], t.Duration)
+		}
+	}
+	if stats.Builds > 0 {
+		stats.SuccessRate = roundRate(stats.Finished, stats.Builds)
+		stats.FailureRate = roundRate(stats.Failed, stats.Builds)
+	}
+	stats.DurationP50 = percentile(durations, 50)
+	stats.DurationP90 = percentile(durations, 90)
+	stats.WaitP50 = percentile(waits, 50)
+	stats.WaitP90 = percentile(waits, 90)
+	for _, ts := range stats.Tasks {
+		taskKey := ts.Kind + "/" + ts.Name
+		ts.DurationP50 = percentile(taskDurations[taskKey], 50)
+		ts.DurationP90 = percentile(taskDurations[taskKey], 90)
+	}
+	return &stats, nil
+}
+
+// getTask returns statistics of the task, tasks are identified by kind and
+// name because ids change when the job is modified
+func (s *JobStats) getTask(name string, kind string) *TaskStats {
+	for _, ts := range s.Tasks {
+		if ts.Name == name && ts.Kind == kind {
+			return ts
+		}
+	}
+	ts := &TaskStats{Name: name, Kind: kind}
+	s.Tasks = append(s.Tasks, ts)
+	return ts
+}
+
+// Summary returns a short version of the statistics
+func (s *JobStats) Summary() *JobStatsSummary {
+	return &JobStatsSummary{
+		Builds:      s.Builds,
+		SuccessRate: s.SuccessRate,
+		DurationP50: s.DurationP50,
+	}
+}
+
+// percentile returns nearest-rank percentile of the values
+func percentile(values []time.Duration, p int) time.Duration {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(float64(p) / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// roundRate returns the rate in percents rounded to 2 decimals
+func roundRate(count int, total int) float64 {
+	return math.Round(float64(count)*10000/float64(total)) / 100
+}
+
+// parseStatsWindow parses the window of statistics. In addition to
+// time.ParseDuration format, days are supported, e.g. 30d
+func parseStatsWindow(window string) (time.Duration, error) {
+	if window == "" {
+		return DefaultStatsWindow, nil
+	}
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(window, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(window, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(window)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid window: %q", window)
+	}
+	return d, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// MaxSummarySize is the maximum size of WAKE_SUMMARY file which is parsed
+const MaxSummarySize = 1024 * 1024
+
+// Lines of WAKE_SUMMARY file which start with these prefixes are not a part
+// of the markdown summary:
+//
+//	::badge version=1.2.0
+//	::link Coverage report=https://example.com/coverage/
+const (
+	summaryBadgePrefix = "::badge "
+	summaryLinkPrefix  = "::link "
+)
+
+// BuildLink is a link attached to the build by one of its tasks
+type BuildLink struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// BuildSummary contains information which tasks attach to the build via
+// WAKE_SUMMARY file
+type BuildSummary struct {
+	Markdown string            `json:"markdown"`
+	Badges   map[string]string `json:"badges"`
+	Links    []*BuildLink      `json:"links"`
+}
+
+// GetSummaryFilename returns location of the file where the task writes the
+// summary of the build, it is exported as WAKE_SUMMARY
+func (b *Build) GetSummaryFilename(task *Task) string {
+	return b.GetWakespaceDir() + fmt.Sprintf("task_%d.summary", task.ID)
+}
+
+// collectSummary reads the summary written by the task and adds it to the
+// summary of the build
+func (b *Build) collectSummary(task *Task) (bool, error) {
+	file, err := os.Open(b.GetSummaryFilename(task))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	summary, err := parseSummary(io.LimitReader(file, MaxSummarySize))
+	if err != nil {
+		return false, err
+	}
+	if summary.Markdown == "" && len(summary.Badges) == 0 && len(summary.Links) == 0 {
+		return false, nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.Summary == nil {
+		b.Summary = &BuildSummary{Badges: map[string]string{}}
+	}
+	if summary.Markdown != "" {
+		if b.Summary.Markdown != "" {
+			b.Summary.Markdown += "\n"
+		}
+		b.Summary.Markdown += summary.Markdown
+	}
+	for key, value := range summary.Badges {
+		b.Summary.Badges[key] = value
+	}
+	b.Summary.Links = append(b.Summary.Links, summary.Links...)
+	return true, nil
+}
+
+// addSummaryNote adds a paragraph to the markdown summary of the build, e.g.
+// a reason why the build failed which is not in logs of its tasks
+func (b *Build) addSummaryNote(note string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.Summary == nil {
+		b.Summary = &BuildSummary{Badges: map[string]string{}}
+	}
+	if b.Summary.Markdown != "" {
+		b.Summary.Markdown += "\n\n"
+	}
+	b.Summary.Markdown += note
+}
+
+// parseSummary parses content of WAKE_SUMMARY file
+func parseSummary(r io.Reader) (*BuildSummary, error) {
+	summary := BuildSummary{Badges: map[string]string{}}
+	var markdown []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxSummarySize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, summaryBadgePrefix):
+			kv := strings.SplitN(strings.TrimPrefix(line, summaryBadgePrefix), "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return nil, fmt.Errorf("invalid badge: %s", line)
+			}
+			summary.Badges[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		case strings.HasPrefix(line, summaryLinkPrefix):
+			// URL may contain `=`, title is before the first one
+			value := strings.TrimPrefix(line, summaryLinkPrefix)
+			idx := strings.Index(value, "=")
+			if idx == -1 {
+				return nil, fmt.Errorf("invalid link: %s", line)
+			}
+			link := &BuildLink{
+				Title: strings.TrimSpace(value[:idx]),
+				URL:   strings.TrimSpace(value[idx+1:]),
+			}
+			// Links are rendered in the UI, only web pages are allowed
+			u, err := url.Parse(link.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid link: %s", line)
+			}
+			if link.Title == "" {
+				link.Title = link.URL
+			}
+			summary.Links = append(summary.Links, link)
+		default:
+			markdown = append(markdown, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	summary.Markdown = strings.TrimSpace(strings.Join(markdown, "\n"))
+	return &summary, nil
+}
+
+// copy returns a copy of the summary which is safe to use outside Build.mutex
+func (s *BuildSummary) copy() *BuildSummary {
+	if s == nil {
+		return nil
+	}
+	c := BuildSummary{
+		Markdown: s.Markdown,
+		Badges:   make(map[string]string, len(s.Badges)),
+		Links:    append([]*BuildLink{}, s.Links...),
+	}
+	for key, value := range s.Badges {
+		c.Badges[key] = value
+	}
+	return &c
+}
+
+// matchBadge verifies if the summary contains the badge. Filter is either
+// `key=value` or `value` which matches a badge with any key
+func (s *BuildSummary) matchBadge(filter string) bool {
+	if s == nil {
+		return false
+	}
+	kv := strings.SplitN(filter, "=", 2)
+	if len(kv) == 2 {
+		value, ok := s.Badges[kv[0]]
+		return ok && value == kv[1]
+	}
+	for _, value := range s.Badges {
+		if value == filter {
+			return true
+		}
+	}
+	return false
+}
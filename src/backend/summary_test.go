@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSummary(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		expected *BuildSummary
+		err      bool
+	}{
+		{
+			name:     "empty",
+			data:     "",
+			expected: &BuildSummary{Badges: map[string]string{}},
+		},
+		{
+			name: "markdown, badges and links",
+			data: `
+## Release
+::badge version=1.2.0
+::badge  coverage = 87%
+::link Coverage report=https://example.com/coverage/?a=b
+::link =http://example.com/
+All checks passed
+`,
+			expected: &BuildSummary{
+				Markdown: "## Release\nAll checks passed",
+				Badges:   map[string]string{"version": "1.2.0", "coverage": "87%"},
+				Links: []*BuildLink{
+					{Title: "Coverage report", URL: "https://example.com/coverage/?a=b"},
+					{Title: "http://example.com/", URL: "http://example.com/"},
+				},
+			},
+		},
+		{
+			name:     "later badge overrides",
+			data:     "::badge version=1\n::badge version=2\n",
+			expected: &BuildSummary{Badges: map[string]string{"version": "2"}},
+		},
+		{
+			name: "badge without value",
+			data: "::badge version\n",
+			err:  true,
+		},
+		{
+			name: "badge without key",
+			data: "::badge =1.2.0\n",
+			err:  true,
+		},
+		{
+			name: "link without url",
+			data: "::link Report\n",
+			err:  true,
+		},
+		{
+			name: "empty url",
+			data: "::link Report=\n",
+			err:  true,
+		},
+		{
+			name: "javascript url",
+			data: "::link Report=javascript:alert(1)\n",
+			err:  true,
+		},
+		{
+			name: "data url",
+			data: "::link Report=data:text/html,<script>alert(1)</script>\n",
+			err:  true,
+		},
+		{
+			name: "relative url",
+			data: "::link Report=/build/1\n",
+			err:  true,
+		},
+		{
+			name: "url without host",
+			data: "::link Report=https:///report\n",
+			err:  true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			summary, err := parseSummary(strings.NewReader(c.data))
+			if c.err {
+				if err == nil {
+					t.Errorf("expected error, got %+v", summary)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(summary, c.expected) {
+				t.Errorf("expected %+v, got %+v", c.expected, summary)
+			}
+		})
+	}
+}
+
+func TestMatchBadge(t *testing.T) {
+	summary := &BuildSummary{Badges: map[string]string{"version": "1.2.0", "env": "prod"}}
+	cases := []struct {
+		filter   string
+		expected bool
+	}{
+		{"version=1.2.0", true},
+		{"1.2.0", true},
+		{"prod", true},
+		{"env=1.2.0", false},
+		{"version=", false},
+		{"1.3.0", false},
+	}
+	for _, c := range cases {
+		if summary.matchBadge(c.filter) != c.expected {
+			t.Errorf("matchBadge(%q): expected %t", c.filter, c.expected)
+		}
+	}
+
+	var empty *BuildSummary
+	if empty.matchBadge("1.2.0") {
+		t.Error("build without summary matches a badge")
+	}
+}
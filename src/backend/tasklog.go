@@ -0,0 +1,610 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+// LogFollowPeriod is how often a followed log is checked for new content
+const LogFollowPeriod = 500 * time.Millisecond
+
+// MaxLogTail is the maximum number of lines which can be requested with tail
+const MaxLogTail = 100000
+
+// MaxLogSearchResults is the default maximum number of lines returned by a
+// log search
+const MaxLogSearchResults = 1000
+
+// taskLogPathRE matches paths of task logs in the storage
+var taskLogPathRE = regexp.MustCompile(`^[0-9]+/task_[0-9]+\.log$`)
+
+// LogTruncatedMarker is the last line of a log which exceeded a limit
+const LogTruncatedMarker = "> The log is truncated: %s is exceeded"
+
+// TaskLog is the log file of a task which is being written. Writes are
+// buffered, the buffer can be flushed from other goroutines, so readers of
+// the file get the latest content
+type TaskLog struct {
+	mutex      deadlock.Mutex
+	file       *os.File
+	bw         *bufio.Writer
+	closed     bool
+	size       int64  // Bytes written
+	limit      int64  // Maximum size of the log, 0 disables the limit
+	buildSize  *int64 // Bytes written to all logs of the build, atomic
+	buildLimit int64
+	truncated  bool
+}
+
+// CreateTaskLog creates the log file
+func CreateTaskLog(filename string) (*TaskLog, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &TaskLog{file: file, bw: bufio.NewWriter(file)}, nil
+}
+
+// WriteString writes the string to the buffer
+func (tl *TaskLog) WriteString(s string) (int, error) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	if tl.closed {
+		return 0, fmt.Errorf("task log is closed")
+	}
+	n, err := tl.bw.WriteString(s)
+	tl.size += int64(n)
+	if tl.buildSize != nil {
+		atomic.AddInt64(tl.buildSize, int64(n))
+	}
+	return n, err
+}
+
+// reserve checks if a line of size bytes fits into the limits. When it
+// doesn't, the log is truncated and the following lines are dropped. The
+// exceeded limit is returned once, so it can be written in the marker
+func (tl *TaskLog) reserve(size int) (bool, string) {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	if tl.truncated {
+		return false, ""
+	}
+	if tl.limit > 0 && tl.size+int64(size) > tl.limit {
+		tl.truncated = true
+		return false, "the task log limit of " + FormatSize(tl.limit)
+	}
+	if tl.buildLimit > 0 && atomic.LoadInt64(tl.buildSize)+int64(size) > tl.buildLimit {
+		tl.truncated = true
+		return false, "the build log limit of " + FormatSize(tl.buildLimit)
+	}
+	return true, ""
+}
+
+// Size returns number of written bytes
+func (tl *TaskLog) Size() int64 {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	return tl.size
+}
+
+// Truncated returns true if the log exceeded a limit
+func (tl *TaskLog) Truncated() bool {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	return tl.truncated
+}
+
+// Flush writes buffered data to the file
+func (tl *TaskLog) Flush() error {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	if tl.closed {
+		return nil
+	}
+	return tl.bw.Flush()
+}
+
+// Close flushes the buffer and closes the file
+func (tl *TaskLog) Close() error {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+	if tl.closed {
+		return nil
+	}
+	tl.closed = true
+	err := tl.bw.Flush()
+	if err != nil {
+		tl.file.Close()
+		return err
+	}
+	return tl.file.Close()
+}
+
+// openTaskLog creates the log of the task and makes it available to readers
+// of the running build. The log is registered before the file is created, so
+// readers which see the file and don't find the log can rely on the file
+// being complete. The log must be closed with closeTaskLog
+func (b *Build) openTaskLog(task *Task) (*TaskLog, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	tl, err := CreateTaskLog(b.GetTaskLogFilename(task.ID))
+	if err != nil {
+		return nil, err
+	}
+	tl.limit = Config.taskLogLimit
+	tl.buildSize = &b.logSize
+	tl.buildLimit = Config.buildLogLimit
+	b.taskLogs[task.ID] = tl
+	return tl, nil
+}
+
+// closeTaskLog closes and compresses the log. It is removed from the build
+// after it is closed, so readers which don't find it can rely on the file
+// being complete
+func (b *Build) closeTaskLog(task *Task, tl *TaskLog) {
+	err := tl.Close()
+	if err != nil {
+		b.Logger.Println(err)
+	}
+	b.mutex.Lock()
+	delete(b.taskLogs, task.ID)
+	task.logSize = tl.Size()
+	task.logTruncated = tl.Truncated()
+	b.mutex.Unlock()
+	err = compressTaskLog(b.GetTaskLogFilename(task.ID))
+	if err != nil {
+		b.Logger.Println(err)
+	}
+}
+
+// compressTaskLog replaces the log with filename.gz. The log stays readable
+// all the time: the compressed file is complete before the log is removed
+func compressTaskLog(filename string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpFilename := filename + ".gz.tmp"
+	dst, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, filename+".gz")
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// gzipFile is a reader of a compressed file
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (gf *gzipFile) Close() error {
+	gf.Reader.Close()
+	return gf.file.Close()
+}
+
+// openTaskLogFile opens the log, or its compressed version if the task is
+// completed
+func openTaskLogFile(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err == nil {
+		return file, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err = os.Open(filename + ".gz")
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Report the name of the log
+			return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: zr, file: file}, nil
+}
+
+// getTaskLogSize returns the size of the log. The size of a compressed log
+// is read from the gzip trailer, so it is correct for logs up to 4GB
+func getTaskLogSize(filename string) (int64, error) {
+	info, err := os.Stat(filename)
+	if err == nil {
+		return info.Size(), nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	file, err := os.Open(filename + ".gz")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, &os.PathError{Op: "stat", Path: filename, Err: os.ErrNotExist}
+		}
+		return 0, err
+	}
+	defer file.Close()
+	trailer := make([]byte, 4)
+	info, err = file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.ReadAt(trailer, info.Size()-4)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint32(trailer)), nil
+}
+
+// getTaskLog returns the log of the task which is being written or nil
+func (b *Build) getTaskLog(taskID int) *TaskLog {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.taskLogs[taskID]
+}
+
+// flushTaskLogs flushes logs of all running tasks
+func (b *Build) flushTaskLogs() {
+	b.mutex.Lock()
+	logs := make([]*TaskLog, 0, len(b.taskLogs))
+	for _, tl := range b.taskLogs {
+		logs = append(logs, tl)
+	}
+	b.mutex.Unlock()
+	for _, tl := range logs {
+		err := tl.Flush()
+		if err != nil {
+			b.Logger.Println(err)
+		}
+	}
+}
+
+// GetTaskLogFilename returns path to the log of the task
+func (b *Build) GetTaskLogFilename(taskID int) string {
+	return getTaskLogFilename(b.ID, taskID)
+}
+
+func getTaskLogFilename(buildID int, taskID int) string {
+	return fmt.Sprintf("%swakespace/%d/task_%d.log", Config.WorkDir, buildID, taskID)
+}
+
+// getTaskLogIDs returns sorted IDs of tasks of the build which have logs
+func getTaskLogIDs(buildID int) ([]int, error) {
+	files, err := ioutil.ReadDir(fmt.Sprintf("%swakespace/%d", Config.WorkDir, buildID))
+	if err != nil {
+		return nil, err
+	}
+	found := map[int]bool{}
+	var ids []int
+	for _, f := range files {
+		// The log may be compressed
+		name := strings.TrimSuffix(f.Name(), ".gz")
+		if f.IsDir() || !strings.HasPrefix(name, "task_") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "task_"), ".log"))
+		if err != nil || found[id] {
+			continue
+		}
+		found[id] = true
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// LogRange selects a part of a log. Byte range is applied first, line
+// numbers and tail are counted within it
+type LogRange struct {
+	Offset   int64 // In bytes
+	Limit    int64 // In bytes, 0 means to the end
+	FromLine int   // 1-based, inclusive
+	ToLine   int   // Inclusive, 0 means to the end
+	Tail     int   // Number of the last lines
+}
+
+// ParseLogRange reads the range from offset, limit, fromLine, toLine and
+// tail query parameters
+func ParseLogRange(r *http.Request) (*LogRange, error) {
+	lr := LogRange{}
+	query := r.URL.Query()
+	var err error
+	parse := func(name string) int64 {
+		value := query.Get(name)
+		if value == "" || err != nil {
+			return 0
+		}
+		var n int64
+		n, err = strconv.ParseInt(value, 10, 64)
+		if err == nil && n < 0 {
+			err = fmt.Errorf("%s must not be negative", name)
+		}
+		return n
+	}
+	lr.Offset = parse("offset")
+	lr.Limit = parse("limit")
+	lr.FromLine = int(parse("fromLine"))
+	lr.ToLine = int(parse("toLine"))
+	lr.Tail = int(parse("tail"))
+	if err != nil {
+		return nil, err
+	}
+	if lr.Tail > MaxLogTail {
+		return nil, fmt.Errorf("tail must not be greater than %d", MaxLogTail)
+	}
+	if lr.Tail > 0 && (lr.FromLine > 0 || lr.ToLine > 0) {
+		return nil, fmt.Errorf("tail can't be used with fromLine and toLine")
+	}
+	if lr.ToLine > 0 && lr.ToLine < lr.FromLine {
+		return nil, fmt.Errorf("toLine must not be less than fromLine")
+	}
+	return &lr, nil
+}
+
+// IsBounded returns true if the range ends before the end of the log
+func (lr *LogRange) IsBounded() bool {
+	return lr.Limit > 0 || lr.ToLine > 0
+}
+
+// WriteTo writes the selected part of the file to w. Returns position in the
+// file after the read data
+func (lr *LogRange) WriteTo(w io.Writer, filename string) (int64, error) {
+	file, err := openTaskLogFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var pos int64
+	if seeker, ok := file.(io.Seeker); ok {
+		pos, err = seeker.Seek(lr.Offset, io.SeekStart)
+	} else {
+		// Compressed logs are read from the beginning
+		pos, err = io.CopyN(ioutil.Discard, file, lr.Offset)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	var r io.Reader = file
+	if lr.Limit > 0 {
+		r = io.LimitReader(file, lr.Limit)
+	}
+	if lr.FromLine == 0 && lr.ToLine == 0 && lr.Tail == 0 {
+		n, err := io.Copy(w, r)
+		return pos + n, err
+	}
+
+	br := bufio.NewReader(r)
+	var tail [][]byte
+	for number := 1; ; number++ {
+		if lr.ToLine > 0 && number > lr.ToLine {
+			return pos, nil
+		}
+		line, err := br.ReadBytes('\n')
+		pos += int64(len(line))
+		if len(line) > 0 {
+			switch {
+			case lr.Tail > 0:
+				if len(tail) == lr.Tail {
+					tail = tail[1:]
+				}
+				tail = append(tail, line)
+			case number >= lr.FromLine:
+				_, werr := w.Write(line)
+				if werr != nil {
+					return pos, werr
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return pos, err
+		}
+	}
+	for _, line := range tail {
+		_, err := w.Write(line)
+		if err != nil {
+			return pos, err
+		}
+	}
+	return pos, nil
+}
+
+// followTaskLog writes new content of the log after pos until the task is
+// completed or the context is done. The task may not be started yet
+func followTaskLog(ctx context.Context, w io.Writer, flusher http.Flusher, buildID int, taskID int, pos int64) error {
+	filename := getTaskLogFilename(buildID, taskID)
+	ticker := time.NewTicker(LogFollowPeriod)
+	defer ticker.Stop()
+	// The file has been seen before the log was checked
+	exists := false
+	for {
+		// The log is checked before reading. If it is not found while the
+		// file exists, the file is already complete
+		tl := GlobalQueue.GetTaskLog(buildID, taskID)
+		if tl != nil {
+			err := tl.Flush()
+			if err != nil {
+				return err
+			}
+		}
+		lr := LogRange{Offset: pos}
+		newPos, err := lr.WriteTo(w, filename)
+		if os.IsNotExist(err) {
+			// The task hasn't started yet
+			if !GlobalQueue.Verify(buildID) {
+				return nil
+			}
+		} else if err != nil {
+			return err
+		} else {
+			if newPos > pos {
+				flusher.Flush()
+			}
+			pos = newPos
+			if tl == nil {
+				if exists {
+					return nil
+				}
+				// The file could be created after the check, so the log is
+				// checked again
+				exists = true
+				continue
+			}
+			exists = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// getLogFormat returns the format from the query, plain by default
+func getLogFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		return LogFormatPlain, nil
+	}
+	if !IsLogFormat(format) {
+		return "", fmt.Errorf("unknown format %q", format)
+	}
+	return format, nil
+}
+
+// LogSearchMatch is a line of a task log which matches the search
+type LogSearchMatch struct {
+	TaskID int    `json:"taskID"`
+	Line   int    `json:"line"`
+	Text   string `json:"text"`
+}
+
+// LogSearchResult is the result of a log search
+type LogSearchResult struct {
+	Matches   []*LogSearchMatch `json:"matches"`
+	Truncated bool              `json:"truncated"` // More than the limit matched
+}
+
+// searchTaskLogs returns lines of the task logs which match the expression
+func searchTaskLogs(buildID int, taskIDs []int, re *regexp.Regexp, limit int) (*LogSearchResult, error) {
+	result := LogSearchResult{Matches: []*LogSearchMatch{}}
+	for _, taskID := range taskIDs {
+		file, err := openTaskLogFile(getTaskLogFilename(buildID, taskID))
+		if err != nil {
+			return nil, err
+		}
+		br := bufio.NewReader(file)
+		for number := 1; ; number++ {
+			line, err := br.ReadString('\n')
+			// The newline is removed, so `$` matches the end of the line
+			line = strings.TrimSuffix(StripColor(line), "\n")
+			if len(line) > 0 && re.MatchString(line) {
+				if len(result.Matches) == limit {
+					result.Truncated = true
+					file.Close()
+					return &result, nil
+				}
+				result.Matches = append(result.Matches, &LogSearchMatch{
+					TaskID: taskID,
+					Line:   number,
+					Text:   line,
+				})
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		file.Close()
+	}
+	return &result, nil
+}
+
+// addLogToZip writes the log to the archive under the name in the format
+func addLogToZip(zw *zip.Writer, filename string, name string, format string) error {
+	file, err := openTaskLogFile(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	lf := newLogFormatter(fw, format)
+	_, err = io.Copy(lf, file)
+	if err != nil {
+		return err
+	}
+	return lf.Close()
+}
+
+// serveTaskLog writes the whole log in the format, compressed logs are
+// decompressed
+func serveTaskLog(w http.ResponseWriter, r *http.Request, filename string, format string) error {
+	file, err := openTaskLogFile(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if format == LogFormatHTML {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	lf := newLogFormatter(w, format)
+	_, err = io.Copy(lf, file)
+	if err != nil {
+		return err
+	}
+	return lf.Close()
+}
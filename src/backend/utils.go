@@ -6,6 +6,8 @@ import (
 	"math/rand"
 	"net"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -48,3 +50,41 @@ func NormalizeNewlines(d []byte) []byte {
 	d = bytes.Replace(d, []byte{13}, []byte{10}, -1)
 	return d
 }
+
+// ParseSize parses size in bytes with optional K, M or G suffix (powers of
+// 1024), e.g. 100M or 512KB
+func ParseSize(s string) (int64, error) {
+	str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(str, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(str, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(str, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		str = str[:len(str)-1]
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// FormatSize returns size in bytes in human readable format, e.g. 1.5M
+func FormatSize(n int64) string {
+	units := []struct {
+		size   int64
+		suffix string
+	}{{1 << 30, "G"}, {1 << 20, "M"}, {1 << 10, "K"}}
+	for _, unit := range units {
+		if n >= unit.size {
+			value := strconv.FormatFloat(float64(n)/float64(unit.size), 'f', 1, 64)
+			return strings.TrimSuffix(value, ".0") + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
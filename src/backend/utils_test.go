@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		str      string
+		expected int64
+		err      bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"10K", 10 << 10, false},
+		{"10kb", 10 << 10, false},
+		{" 100M ", 100 << 20, false},
+		{"100MB", 100 << 20, false},
+		{"2G", 2 << 30, false},
+		{"", 0, true},
+		{"B", 0, true},
+		{"M", 0, true},
+		{"1.5M", 0, true},
+		{"-1M", 0, true},
+		{"10T", 0, true},
+		{"ten", 0, true},
+	}
+	for _, c := range cases {
+		got, err := ParseSize(c.str)
+		if c.err {
+			if err == nil {
+				t.Errorf("ParseSize(%q): expected error, got %d", c.str, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSize(%q): %s", c.str, err)
+			continue
+		}
+		if got != c.expected {
+			t.Errorf("ParseSize(%q): expected %d, got %d", c.str, c.expected, got)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	cases := []struct {
+		n        int64
+		expected string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1K"},
+		{1536, "1.5K"},
+		{100 << 20, "100M"},
+		{(1 << 30) + (1 << 29), "1.5G"},
+	}
+	for _, c := range cases {
+		got := FormatSize(c.n)
+		if got != c.expected {
+			t.Errorf("FormatSize(%d): expected %q, got %q", c.n, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// WSRevalidatePeriod is how often credentials of ws connections are checked,
+// so connections of expired sessions are closed
+const WSRevalidatePeriod = time.Minute
+
+// subscriptionTags are the types of messages which clients can subscribe to.
+// Tags which end with ":" match all messages with this prefix
+var subscriptionTags = regexp.MustCompile(`^(build:update:|(build:update|build:log|approval:waiting):[0-9]+|approval:waiting:|queue:update|locks:update)$`)
+
+// checkWSOrigin allows connections from the same origin and from the origin
+// which CORSMi allows. Without Config.Hostname only local origins are allowed
+// in addition, they are used by the development server of the frontend
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Not a browser
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if Config.Hostname != "" {
+		return u.Scheme == "https" && strings.EqualFold(u.Host, Config.Hostname)
+	}
+	hostname := u.Hostname()
+	if hostname == "localhost" {
+		return true
+	}
+	return net.ParseIP(hostname) != nil && EnsureLocalIP(hostname) == nil
+}
+
+// wsCredentials are the credentials which were used to open a ws connection
+type wsCredentials struct {
+	sessionToken string
+	// Hash of the password at the time of connection for basic auth, the
+	// connection is closed when the password changes
+	passwordHash []byte
+}
+
+// getWSCredentials returns credentials of the request which has already
+// passed AuthMi
+func getWSCredentials(r *http.Request) (*wsCredentials, error) {
+	if _, _, ok := r.BasicAuth(); ok {
+		hash, err := getPasswordHash()
+		if err != nil {
+			return nil, err
+		}
+		return &wsCredentials{passwordHash: hash}, nil
+	}
+	sessionToken, err := r.Cookie("session")
+	if err != nil {
+		return nil, err
+	}
+	return &wsCredentials{sessionToken: sessionToken.Value}, nil
+}
+
+// Verify returns error if the session has expired or was deleted, or the
+// password has changed
+func (wc *wsCredentials) Verify() error {
+	if wc.passwordHash == nil {
+		return GlobalSessionStorage.Verify(wc.sessionToken)
+	}
+	hash, err := getPasswordHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, wc.passwordHash) {
+		return fmt.Errorf("password has changed")
+	}
+	return nil
+}
+
+func getPasswordHash() ([]byte, error) {
+	var hash []byte
+	err := DB.View(func(tx *bolt.Tx) error {
+		hash = append(hash, tx.Bucket(GlobalBucket).Get([]byte("password"))...)
+		return nil
+	})
+	return hash, err
+}
+
+// authorizeSubscription returns error if the client can't subscribe to the
+// tag. There is a single user, so authenticated clients can subscribe to
+// updates of all builds, only the format of the tag is verified
+func (c *Client) authorizeSubscription(tag string) error {
+	if !subscriptionTags.MatchString(tag) {
+		return fmt.Errorf("unknown subscription %q", tag)
+	}
+	return nil
+}
+
+// matchSubscription returns true if the message tag matches the subscription
+func matchSubscription(subscription string, tag string) bool {
+	if strings.HasSuffix(subscription, ":") {
+		return strings.HasPrefix(tag, subscription)
+	}
+	return tag == subscription
+}
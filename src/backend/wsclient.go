@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,6 +26,9 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
+
+	// Maximum size of a frame which contains several messages to the peer.
+	maxFrameSize = 512 * 1024
 )
 
 var (
@@ -34,9 +38,7 @@ var (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin:     checkWSOrigin,
 }
 
 // Client is a middleman between the websocket connection and the hub.
@@ -46,8 +48,11 @@ type Client struct {
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	send chan []byte
+	// Outbound messages.
+	out *outbox
+
+	// Credentials which are checked periodically while the connection is open.
+	credentials *wsCredentials
 
 	SubscribedTo []string
 	Logger       *log.Logger
@@ -94,30 +99,34 @@ func (c *Client) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.Logger.Println("The hub closed the channel")
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case <-c.out.ready:
+			messages, closed := c.out.take()
+			// Pending messages are sent in frames of up to maxFrameSize
+			for len(messages) > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				w, err := c.conn.NextWriter(websocket.TextMessage)
+				if err != nil {
+					c.Logger.Println(err)
+					return
+				}
+				w.Write(messages[0])
+				size := len(messages[0])
+				messages = messages[1:]
+				for len(messages) > 0 && size+len(messages[0]) <= maxFrameSize {
+					w.Write(newline)
+					w.Write(messages[0])
+					size += len(messages[0]) + 1
+					messages = messages[1:]
+				}
+				if err := w.Close(); err != nil {
+					c.Logger.Println(err)
+					return
+				}
 			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				c.Logger.Println(err)
-				return
-			}
-			w.Write(message)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
-				c.Logger.Println(err)
+			if closed {
+				c.Logger.Println("The hub closed the connection")
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.conn.WriteMessage(websocket.CloseMessage, c.out.closeMessage)
 				return
 			}
 		case <-ticker.C:
@@ -135,17 +144,28 @@ func (c *Client) IsSubscribed(tag string) (bool, int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	for i, v := range c.SubscribedTo {
-		if strings.HasPrefix(tag, v) {
+		if matchSubscription(v, tag) {
 			return true, i
 		}
 	}
 	return false, 0
 }
 
+// subscriptionIndex returns index of the subscription or -1
+func (c *Client) subscriptionIndex(mt string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, v := range c.SubscribedTo {
+		if v == mt {
+			return i
+		}
+	}
+	return -1
+}
+
 // Subscribe subscribes a client to message
 func (c *Client) Subscribe(mt string) {
-	ok, _ := c.IsSubscribed(mt)
-	if !ok {
+	if c.subscriptionIndex(mt) == -1 {
 		c.mu.Lock()
 		defer c.mu.Unlock()
 		c.SubscribedTo = append(c.SubscribedTo, mt)
@@ -155,8 +175,8 @@ func (c *Client) Subscribe(mt string) {
 
 // Unsubscribe ...
 func (c *Client) Unsubscribe(mt string) {
-	ok, index := c.IsSubscribed(mt)
-	if ok {
+	index := c.subscriptionIndex(mt)
+	if index != -1 {
 		c.mu.Lock()
 		defer c.mu.Unlock()
 		c.SubscribedTo[index] = ""
@@ -175,6 +195,18 @@ func (c *Client) HandleIncomingMessage(msg *MsgIncoming) {
 			c.Logger.Println(err)
 			return
 		}
+		if data.Format != "" {
+			if data.Format != LogFormatPlain && data.Format != LogFormatHTML {
+				c.Logger.Printf("Unknown log format %q\n", data.Format)
+				return
+			}
+			c.out.setLogFormat(data.Format)
+		}
+		data.To = c.authorizeSubscriptions(data.To)
+		if data.Since != nil {
+			c.subscribeWithReplay(&data)
+			return
+		}
 		for _, item := range data.To {
 			c.Subscribe(item)
 		}
@@ -193,8 +225,55 @@ func (c *Client) HandleIncomingMessage(msg *MsgIncoming) {
 	}
 }
 
+// authorizeSubscriptions returns the tags which the client can subscribe to
+func (c *Client) authorizeSubscriptions(tags []string) []string {
+	allowed := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		err := c.authorizeSubscription(tag)
+		if err != nil {
+			c.Logger.Printf("Subscription to %q is rejected: %s\n", tag, err.Error())
+			continue
+		}
+		allowed = append(allowed, tag)
+	}
+	return allowed
+}
+
+// subscribeWithReplay subscribes the client and replays log messages of
+// running builds which were sent after data.Since
+func (c *Client) subscribeWithReplay(data *InSubscribeData) {
+	sub := subscription{
+		client:  c,
+		to:      data.To,
+		since:   *data.Since,
+		buffers: map[string]*LogBuffer{},
+	}
+	for _, item := range data.To {
+		if !strings.HasPrefix(item, "build:log:") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(item, "build:log:"))
+		if err != nil {
+			c.Logger.Println(err)
+			continue
+		}
+		lb := GlobalQueue.GetLogBuffer(id)
+		if lb != nil {
+			sub.buffers[item] = lb
+		}
+	}
+	c.hub.subscribe <- &sub
+}
+
 // HandleWS handles ws connection
 func HandleWS(w http.ResponseWriter, r *http.Request) {
+	credentials, err := getWSCredentials(r)
+	if err != nil {
+		Logger.Println(err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		Logger.Println(err)
@@ -214,7 +293,8 @@ func HandleWS(w http.ResponseWriter, r *http.Request) {
 	client := &Client{
 		hub:          WSHub,
 		conn:         conn,
-		send:         make(chan []byte, 1024),
+		out:          newOutbox(),
+		credentials:  credentials,
 		SubscribedTo: []string{},
 		Logger:       log.New(os.Stdout, "["+logID+" "+host+"] ", log.Lmicroseconds|log.Lshortfile),
 	}
@@ -1,6 +1,40 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sasha-s/go-deadlock"
+)
+
+// MaxLogMessageSize is the maximum size of log data which is sent in one
+// message
+const MaxLogMessageSize = 64 * 1024
+
+// LogBatchPeriod is how often new log messages of builds are sent to clients
+const LogBatchPeriod = 100 * time.Millisecond
+
+// LogStreamIdleTimeout is the time after which a log stream without new
+// messages is removed from the hub
+const LogStreamIdleTimeout = time.Minute
+
+// subscription is a request to subscribe the client and replay missed log
+// messages from the buffers. Key of buffers is the subscription tag
+type subscription struct {
+	client  *Client
+	to      []string
+	since   int
+	buffers map[string]*LogBuffer
+}
+
+// logStream is a log of a build which is broadcasted by the hub
+type logStream struct {
+	buffer     *LogBuffer
+	lastActive time.Time
+}
 
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
@@ -16,31 +50,65 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Subscribe requests which replay log messages. They are handled by the
+	// hub, so live messages can't get ahead of replayed ones
+	subscribe chan *subscription
+
+	// Logs of builds by subscription tag. New messages are broadcasted every
+	// LogBatchPeriod, so builds never wait for the hub
+	logStreams      map[string]*logStream
+	logStreamsMutex deadlock.Mutex
+
+	// Requests to broadcast logs before LogBatchPeriod ends, when a buffer
+	// is about to drop unsent messages
+	flushLogsRequest chan bool
+
+	// Requests to check credentials of clients before WSRevalidatePeriod
+	// ends, e.g. when a session is deleted
+	revalidateRequest chan bool
+
+	// Number of registered clients, is used outside of run()
+	clientsCount int64
 }
 
 func newHub() *Hub {
 	Logger.Println("Starting wshub...")
 	return &Hub{
-		broadcast:  make(chan *MsgBroadcast),
+		broadcast:  make(chan *MsgBroadcast, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		subscribe:  make(chan *subscription),
 		clients:    make(map[*Client]bool),
+		logStreams: make(map[string]*logStream),
+
+		flushLogsRequest:  make(chan bool, 1),
+		revalidateRequest: make(chan bool, 1),
 	}
 }
 
 func (h *Hub) run() {
+	ticker := time.NewTicker(LogBatchPeriod)
+	defer ticker.Stop()
+	revalidateTicker := time.NewTicker(WSRevalidatePeriod)
+	defer revalidateTicker.Stop()
 	for {
 		select {
 		case client := <-h.register:
 			client.Logger.Println("New ws connection registered")
 			h.clients[client] = true
+			atomic.StoreInt64(&h.clientsCount, int64(len(h.clients)))
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				client.Logger.Println("Connection unregistered")
-				delete(h.clients, client)
-				close(client.send)
+				h.disconnect(client, []byte{})
 			}
 		case message := <-h.broadcast:
+			// Logs of the build are sent before its status, so the status
+			// doesn't get ahead of them
+			if strings.HasPrefix(message.Type, "build:update:") {
+				h.flushLogs(strings.Replace(message.Type, "build:update:", "build:log:", 1))
+			}
 			msgB, err := json.Marshal(message)
 			if err != nil {
 				Logger.Println(err)
@@ -48,16 +116,199 @@ func (h *Hub) run() {
 				for client := range h.clients {
 					ok, _ := client.IsSubscribed(message.Type)
 					if ok {
-						select {
-						case client.send <- msgB:
-						default:
-							client.Logger.Println("Buffer is full")
-							close(client.send)
-							delete(h.clients, client)
-						}
+						client.out.push(message.Type, msgB, nil)
 					}
 				}
 			}
+		case sub := <-h.subscribe:
+			if _, ok := h.clients[sub.client]; !ok {
+				continue
+			}
+			for tag := range sub.buffers {
+				h.flushLogs(tag)
+			}
+			for _, item := range sub.to {
+				sub.client.Subscribe(item)
+			}
+			for tag, lb := range sub.buffers {
+				h.replay(sub.client, tag, lb, sub.since)
+			}
+		case <-ticker.C:
+			h.flushAllLogs()
+		case <-h.flushLogsRequest:
+			h.flushAllLogs()
+		case <-revalidateTicker.C:
+			h.revalidate()
+		case <-h.revalidateRequest:
+			h.revalidate()
+		}
+	}
+}
+
+// disconnect removes the client and closes its connection after pending
+// messages are sent
+func (h *Hub) disconnect(client *Client, closeMessage []byte) {
+	delete(h.clients, client)
+	client.out.close(closeMessage)
+	atomic.StoreInt64(&h.clientsCount, int64(len(h.clients)))
+}
+
+// revalidate closes connections of clients whose credentials are no longer
+// valid
+func (h *Hub) revalidate() {
+	for client := range h.clients {
+		err := client.credentials.Verify()
+		if err != nil {
+			client.Logger.Printf("Closing the connection: %s\n", err.Error())
+			h.disconnect(client, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication expired"))
+		}
+	}
+}
+
+// Revalidate schedules checking credentials of all clients
+func (h *Hub) Revalidate() {
+	select {
+	case h.revalidateRequest <- true:
+	default:
+	}
+}
+
+// PublishLogs schedules broadcasting of new messages from the buffer
+func (h *Hub) PublishLogs(tag string, lb *LogBuffer) {
+	h.logStreamsMutex.Lock()
+	defer h.logStreamsMutex.Unlock()
+	stream, ok := h.logStreams[tag]
+	if !ok {
+		stream = &logStream{buffer: lb}
+		h.logStreams[tag] = stream
+	}
+	stream.lastActive = time.Now()
+	if lb.CountUnsent() > len(lb.items)/2 {
+		select {
+		case h.flushLogsRequest <- true:
+		default:
 		}
 	}
 }
+
+// flushAllLogs broadcasts new messages of all logs and removes the ones
+// which didn't get new messages for a while
+func (h *Hub) flushAllLogs() {
+	h.logStreamsMutex.Lock()
+	tags := make([]string, 0, len(h.logStreams))
+	for tag := range h.logStreams {
+		tags = append(tags, tag)
+	}
+	h.logStreamsMutex.Unlock()
+	for _, tag := range tags {
+		h.flushLogs(tag)
+	}
+	h.logStreamsMutex.Lock()
+	for tag, stream := range h.logStreams {
+		if time.Since(stream.lastActive) > LogStreamIdleTimeout {
+			delete(h.logStreams, tag)
+		}
+	}
+	h.logStreamsMutex.Unlock()
+}
+
+// flushLogs broadcasts new messages of the log
+func (h *Hub) flushLogs(tag string) {
+	h.logStreamsMutex.Lock()
+	stream, ok := h.logStreams[tag]
+	h.logStreamsMutex.Unlock()
+	if !ok {
+		return
+	}
+	items, complete := stream.buffer.Unsent()
+	if len(items) == 0 {
+		return
+	}
+
+	var subscribers []*Client
+	for client := range h.clients {
+		ok, _ := client.IsSubscribed(tag)
+		if ok {
+			subscribers = append(subscribers, client)
+		}
+	}
+	if len(subscribers) == 0 {
+		return
+	}
+	if !complete {
+		Logger.Printf("Log messages of %s were dropped before broadcasting\n", tag)
+		for _, client := range subscribers {
+			h.sendLogMissed(client, tag, items[0].ID-1)
+		}
+	}
+	for _, merged := range mergeLogs(items, MaxLogMessageSize) {
+		// Every format is marshaled once for all clients
+		formatted := map[string][]byte{}
+		for _, client := range subscribers {
+			format := client.out.getLogFormat()
+			msgB, ok := formatted[format]
+			if !ok {
+				var err error
+				msgB, err = marshalLog(tag, merged, format)
+				if err != nil {
+					Logger.Println(err)
+					continue
+				}
+				formatted[format] = msgB
+			}
+			client.out.push(tag, msgB, merged)
+		}
+	}
+}
+
+// marshalLog returns the log message in the format. Colors are converted to
+// HTML within the message, colors which continue from the previous message
+// are lost
+func marshalLog(tag string, item *CommandLogData, format string) ([]byte, error) {
+	return json.Marshal(&MsgBroadcast{Type: tag, Data: &CommandLogData{
+		TaskID: item.TaskID,
+		ID:     item.ID,
+		Data:   FormatLog(item.Data, format),
+	}})
+}
+
+// sendLogMissed notifies the client that log messages after since are
+// missing and the log should be reloaded
+func (h *Hub) sendLogMissed(client *Client, tag string, since int) {
+	missedTag := strings.Replace(tag, "build:log:", "build:log:missed:", 1)
+	msgB, err := json.Marshal(&MsgBroadcast{
+		Type: missedTag,
+		Data: &LogMissedData{Since: since},
+	})
+	if err != nil {
+		Logger.Println(err)
+		return
+	}
+	client.out.push(missedTag, msgB, nil)
+}
+
+// replay sends log messages from the buffer which are newer than since
+func (h *Hub) replay(client *Client, tag string, lb *LogBuffer, since int) {
+	items, complete := lb.Since(since)
+	if !complete {
+		client.Logger.Printf("Some log messages of %s after %d are missing\n", tag, since)
+		h.sendLogMissed(client, tag, since)
+	}
+	format := client.out.getLogFormat()
+	for _, merged := range mergeLogs(items, MaxLogMessageSize) {
+		msgB, err := marshalLog(tag, merged, format)
+		if err != nil {
+			Logger.Println(err)
+			continue
+		}
+		client.out.push(tag, msgB, merged)
+	}
+	if len(items) > 0 {
+		client.Logger.Printf("Replayed %d log messages of %s\n", len(items), tag)
+	}
+}
+
+// CountClients returns number of registered clients
+func (h *Hub) CountClients() int64 {
+	return atomic.LoadInt64(&h.clientsCount)
+}
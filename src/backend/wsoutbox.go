@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sasha-s/go-deadlock"
+)
+
+// ClientQueueSize is the number of messages which wait for delivery to a
+// client. When the queue is full, log messages are skipped
+const ClientQueueSize = 256
+
+// LogSkippedMarker is added to the log of a slow client in place of skipped
+// messages
+const LogSkippedMarker = "> ... %d log lines skipped, reload the log to see them ...\n"
+
+// outMessage is a message which waits for delivery
+type outMessage struct {
+	tag   string
+	data  []byte
+	isLog bool
+}
+
+// skippedLogs describes log messages which were skipped
+type skippedLogs struct {
+	lines  int
+	taskID int
+	lastID int
+}
+
+// outbox is a queue of outbound messages of a client. Pushing messages never
+// blocks the hub: log messages are skipped when the queue is full, other
+// messages replace the pending message of the same type, so a slow client
+// gets the latest state instead of all intermediate ones
+type outbox struct {
+	mutex   deadlock.Mutex
+	queue   []*outMessage
+	skipped map[string]*skippedLogs // By message type
+	ready   chan bool               // Signals that there are messages to send
+	closed  bool
+	// Payload of the close message which is sent after pending messages
+	closeMessage []byte
+	logFormat    string // Format of log messages, see LogFormatPlain
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		skipped:   map[string]*skippedLogs{},
+		ready:     make(chan bool, 1),
+		logFormat: LogFormatPlain,
+	}
+}
+
+func (o *outbox) setLogFormat(format string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.logFormat = format
+}
+
+func (o *outbox) getLogFormat() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.logFormat
+}
+
+// push adds the message to the queue. logData is the data of log messages
+func (o *outbox) push(tag string, msgB []byte, logData *CommandLogData) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return
+	}
+	if logData != nil {
+		if len(o.queue) >= ClientQueueSize || o.skipped[tag] != nil {
+			sl, ok := o.skipped[tag]
+			if !ok {
+				sl = &skippedLogs{}
+				o.skipped[tag] = sl
+			}
+			sl.lines += strings.Count(logData.Data, "\n")
+			sl.taskID = logData.TaskID
+			sl.lastID = logData.ID
+			return
+		}
+		o.queue = append(o.queue, &outMessage{tag: tag, data: msgB, isLog: true})
+	} else {
+		// The newer state replaces the pending one. It is moved to the end of
+		// the queue, so it is not delivered before logs which preceded it
+		for i, item := range o.queue {
+			if !item.isLog && item.tag == tag {
+				o.queue = append(o.queue[:i], o.queue[i+1:]...)
+				break
+			}
+		}
+		o.queue = append(o.queue, &outMessage{tag: tag, data: msgB})
+	}
+	o.signal()
+}
+
+// take returns all pending messages. Skipped log messages are replaced with
+// LogSkippedMarker after the last log message. The second value is true when
+// the outbox is closed
+func (o *outbox) take() ([][]byte, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	lastLog := -1
+	for i, item := range o.queue {
+		if item.isLog {
+			lastLog = i
+		}
+	}
+	messages := make([][]byte, 0, len(o.queue)+len(o.skipped))
+	for i, item := range o.queue {
+		if i == lastLog+1 {
+			messages = append(messages, o.takeSkipped()...)
+		}
+		messages = append(messages, item.data)
+	}
+	if lastLog+1 == len(o.queue) {
+		messages = append(messages, o.takeSkipped()...)
+	}
+	o.queue = nil
+	return messages, o.closed
+}
+
+// takeSkipped returns markers of skipped log messages
+func (o *outbox) takeSkipped() [][]byte {
+	var messages [][]byte
+	for tag, sl := range o.skipped {
+		// The marker has ID of the last skipped message, so IDs which the
+		// client receives keep increasing
+		msgB, err := json.Marshal(&MsgBroadcast{Type: tag, Data: &CommandLogData{
+			TaskID: sl.taskID,
+			ID:     sl.lastID,
+			Data:   FormatLog(fmt.Sprintf(LogSkippedMarker, sl.lines), o.logFormat),
+		}})
+		if err != nil {
+			Logger.Println(err)
+			continue
+		}
+		messages = append(messages, msgB)
+	}
+	o.skipped = map[string]*skippedLogs{}
+	return messages
+}
+
+// close stops accepting messages, pending messages are still delivered
+// before the close message
+func (o *outbox) close(closeMessage []byte) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.closeMessage = closeMessage
+	o.signal()
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- true:
+	default:
+	}
+}
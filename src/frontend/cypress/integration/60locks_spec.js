@@ -0,0 +1,133 @@
+describe("Named locks", function() {
+    it("should not run builds which require the same lock at the same time", function() {
+        const suffix = new Date().getTime();
+        const lockName = "lock" + suffix;
+        const holderJob = "myjob-holder" + suffix;
+        const waiterJob = "myjob-waiter" + suffix;
+        cy.createJob(holderJob, `
+desc: Holds the lock
+locks:
+  - ${lockName}
+tasks:
+  - name: Sleep
+    run: sleep 3
+`);
+        cy.createJob(waiterJob, `
+desc: Waits for the lock
+locks:
+  - name: ${lockName}
+    mode: write
+tasks:
+  - name: Print date
+    run: date
+`);
+
+        cy.runJob(holderJob).then((holderID) => {
+            cy.waitForBuild(holderID, ["running"]);
+            cy.runJob(waiterJob).then((waiterID) => {
+                cy.api("/api/locks").then((resp) => {
+                    const lock = resp.body.find((item) => item.name === lockName);
+                    expect(lock.holders).to.have.length(1);
+                    expect(lock.holders[0].buildID).to.eq(holderID);
+                    expect(lock.waiters).to.have.length(1);
+                    expect(lock.waiters[0].buildID).to.eq(waiterID);
+                });
+                cy.api("/api/queue/").then((resp) => {
+                    const queued = resp.body.queued.find((item) => item.id === waiterID);
+                    expect(queued.waitingReason).to.include(`waiting for lock ${lockName} held by build ${holderID}`);
+                });
+
+                cy.waitForBuild(holderID).then((holder) => {
+                    cy.waitForBuild(waiterID).then((waiter) => {
+                        const holderEnd = new Date(holder.startedAt).getTime() + holder.duration / 1e6;
+                        expect(new Date(waiter.startedAt).getTime()).to.be.at.least(Math.floor(holderEnd));
+                    });
+                });
+            });
+        });
+    });
+
+    it("should share read locks", function() {
+        const suffix = new Date().getTime();
+        const lockName = "lock" + suffix;
+        const jobName = "myjob" + suffix;
+        cy.createJob(jobName, `
+desc: Reads
+allow_parallel: yes
+locks:
+  - name: ${lockName}
+    mode: read
+tasks:
+  - name: Sleep
+    run: sleep 2
+`);
+
+        cy.runJob(jobName).then((firstID) => {
+            cy.runJob(jobName).then((secondID) => {
+                cy.waitForBuild(firstID, ["running"]);
+                cy.waitForBuild(secondID, ["running"]);
+                cy.api("/api/locks").then((resp) => {
+                    const lock = resp.body.find((item) => item.name === lockName);
+                    expect(lock.holders.map((item) => item.buildID)).to.have.members([firstID, secondID]);
+                    expect(lock.holders[0].mode).to.eq("read");
+                });
+                cy.waitForBuild(firstID);
+                cy.waitForBuild(secondID);
+            });
+        });
+    });
+
+    it("should keep the lock while the build is waiting for approval", function() {
+        const suffix = new Date().getTime();
+        const lockName = "lock" + suffix;
+        const holderJob = "myjob-holder" + suffix;
+        const waiterJob = "myjob-waiter" + suffix;
+        cy.createJob(holderJob, `
+desc: Holds the lock during approval
+locks:
+  - ${lockName}
+tasks:
+  - name: Sign-off
+    approval:
+      message: Continue?
+
+  - name: Print date
+    run: date
+`);
+        cy.createJob(waiterJob, `
+desc: Waits for the lock
+locks:
+  - ${lockName}
+tasks:
+  - name: Print date
+    run: date
+`);
+
+        cy.runJob(holderJob).then((holderID) => {
+            cy.waitForBuild(holderID, ["waiting"]);
+            cy.runJob(waiterJob).then((waiterID) => {
+                cy.wait(1000);
+                cy.api("/api/locks").then((resp) => {
+                    const lock = resp.body.find((item) => item.name === lockName);
+                    expect(lock.holders).to.have.length(1);
+                    expect(lock.holders[0].buildID).to.eq(holderID);
+                    expect(lock.holders[0].status).to.eq("waiting");
+                    expect(lock.waiters.map((item) => item.buildID)).to.include(waiterID);
+                });
+                cy.api("/api/queue/").then((resp) => {
+                    const queued = resp.body.queued.find((item) => item.id === waiterID);
+                    expect(queued.waitingReason).to.include(`waiting for lock ${lockName} held by build ${holderID}`);
+                    expect(queued.etaToStart).to.eq(-1);
+                });
+
+                cy.api(`/api/build/${holderID}/approve`, {method: "POST"});
+                cy.waitForBuild(holderID).then((holder) => {
+                    cy.waitForBuild(waiterID).then((waiter) => {
+                        const holderEnd = new Date(holder.startedAt).getTime() + holder.duration / 1e6;
+                        expect(new Date(waiter.startedAt).getTime()).to.be.at.least(Math.floor(holderEnd));
+                    });
+                });
+            });
+        });
+    });
+});
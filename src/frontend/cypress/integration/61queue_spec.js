@@ -0,0 +1,62 @@
+describe("Queue", function() {
+    it("should reorder queued builds", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Queue test
+tasks:
+  - name: Sleep
+    run: sleep 3
+`);
+
+        cy.runJob(jobName).then((runningID) => {
+            cy.runJob(jobName).then((firstID) => {
+                cy.runJob(jobName).then((secondID) => {
+                    cy.waitForBuild(runningID, ["running"]);
+                    cy.api("/api/queue/").then((resp) => {
+                        expect(resp.body.running.map((item) => item.id)).to.include(runningID);
+                        const queued = resp.body.queued.filter((item) => item.name === jobName);
+                        expect(queued.map((item) => item.id)).to.deep.equal([firstID, secondID]);
+                        expect(queued[0].status).to.eq("pending");
+                        expect(queued[0].waitingReason).to.not.eq("");
+                    });
+
+                    // Move the second build to the front
+                    cy.api(`/api/queue/${secondID}/move`, {
+                        method: "POST",
+                        body: {position: 0},
+                        form: true,
+                    });
+                    cy.api("/api/queue/").then((resp) => {
+                        expect(resp.body.queued[0].id).to.eq(secondID);
+                    });
+
+                    // Higher priority moves the build in front of the others
+                    cy.api(`/api/queue/${firstID}/priority`, {
+                        method: "POST",
+                        body: {priority: 50},
+                        form: true,
+                    });
+                    cy.api("/api/queue/").then((resp) => {
+                        expect(resp.body.queued[0].id).to.eq(firstID);
+                        expect(resp.body.queued[0].priority).to.eq(50);
+                        // The priority is changed only for the build
+                        const other = resp.body.queued.find((item) => item.id === secondID);
+                        expect(other.priority).to.eq(0);
+                    });
+
+                    cy.api("/api/queue/999999/move", {
+                        method: "POST",
+                        body: {position: 0},
+                        form: true,
+                        failOnStatusCode: false,
+                    }).its("status").should("eq", 404);
+
+                    for (const id of [runningID, firstID, secondID]) {
+                        cy.api(`/api/build/${id}/abort`, {method: "POST"});
+                    }
+                    cy.waitForBuild(secondID, ["aborted"]);
+                });
+            });
+        });
+    });
+});
@@ -0,0 +1,117 @@
+describe("Concurrency groups", function() {
+    it("should supersede pending builds of the group", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Replace pending
+allow_parallel: yes
+params:
+  - ENV: staging
+concurrency_group:
+  name: deploy-${jobName}-\${ENV}
+  policy: replace-pending
+tasks:
+  - name: Sleep
+    run: sleep 2
+`);
+
+        cy.runJob(jobName).then((runningID) => {
+            cy.waitForBuild(runningID, ["running"]);
+            cy.runJob(jobName).then((pendingID) => {
+                // A build in another group is not affected
+                cy.runJob(jobName, {ENV: "production"}).then((otherID) => {
+                    cy.runJob(jobName).then((latestID) => {
+                        cy.waitForBuild(pendingID, ["superseded"]).its("supersededBy").should("eq", latestID);
+                        cy.waitForBuild(runningID);
+                        cy.waitForBuild(otherID);
+                        cy.waitForBuild(latestID).then((latest) => {
+                            cy.api(`/api/build/${runningID}`).then((resp) => {
+                                const running = resp.body.status_update;
+                                const runningEnd = new Date(running.startedAt).getTime() + running.duration / 1e6;
+                                expect(new Date(latest.startedAt).getTime()).to.be.at.least(Math.floor(runningEnd));
+                            });
+                        });
+                    });
+                });
+            });
+        });
+    });
+
+    it("should cancel the running build of the group", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Cancel running
+allow_parallel: yes
+concurrency_group:
+  name: ${jobName}
+  policy: cancel-running
+tasks:
+  - name: Sleep
+    run: sleep 10
+`);
+
+        cy.runJob(jobName).then((runningID) => {
+            cy.waitForBuild(runningID, ["running"]);
+            cy.runJob(jobName).then((latestID) => {
+                cy.waitForBuild(runningID, ["superseded"]).its("supersededBy").should("eq", latestID);
+                cy.waitForBuild(latestID, ["running"]);
+                cy.api(`/api/build/${latestID}/abort`, {method: "POST"});
+                cy.waitForBuild(latestID, ["aborted"]);
+            });
+        });
+    });
+
+    it("should abort the approved build of the group which waits for an executor", function() {
+        const suffix = new Date().getTime();
+        const jobName = "myjob" + suffix;
+        const blockerJob = "myjob-blocker" + suffix;
+        cy.createJob(jobName, `
+desc: Replace pending after approval
+allow_parallel: yes
+concurrency_group:
+  name: ${jobName}
+  policy: replace-pending
+tasks:
+  - name: Sign-off
+    approval:
+      message: Continue?
+
+  - name: Print date
+    run: date
+`);
+        cy.createJob(blockerJob, `
+desc: Occupies an executor
+allow_parallel: yes
+tasks:
+  - name: Sleep
+    run: sleep 30
+`);
+
+        cy.runJob(jobName).then((approvedID) => {
+            cy.waitForBuild(approvedID, ["waiting"]);
+            // Occupy all executors, so the approved build stays in the queue
+            cy.runJob(blockerJob).then((firstBlockerID) => {
+                cy.runJob(blockerJob).then((secondBlockerID) => {
+                    cy.waitForBuild(firstBlockerID, ["running"]);
+                    cy.waitForBuild(secondBlockerID, ["running"]);
+                    cy.api(`/api/build/${approvedID}/approve`, {method: "POST"});
+                    cy.api("/api/queue/").its("body.queued").then((queued) => {
+                        expect(queued.map((item) => item.id)).to.include(approvedID);
+                    });
+
+                    cy.runJob(jobName).then((latestID) => {
+                        cy.waitForBuild(approvedID, ["superseded"]).its("supersededBy").should("eq", latestID);
+                        cy.api(`/api/build/${approvedID}/task/0/log`).its("body").should("contain", "> Aborted.");
+                        cy.api("/api/queue/").then((resp) => {
+                            const ids = [...resp.body.running, ...resp.body.waiting, ...resp.body.queued].map((item) => item.id);
+                            expect(ids).to.not.include(approvedID);
+                        });
+                        cy.api(`/api/build/${latestID}/abort`, {method: "POST"});
+                        cy.api(`/api/build/${firstBlockerID}/abort`, {method: "POST"});
+                        cy.api(`/api/build/${secondBlockerID}/abort`, {method: "POST"});
+                        cy.waitForBuild(latestID, ["aborted"]);
+                    });
+                });
+            });
+        });
+    });
+});
@@ -0,0 +1,90 @@
+describe("Scheduling", function() {
+    it("should start builds with higher priority first", function() {
+        const suffix = new Date().getTime();
+        const lockName = "lock" + suffix;
+        const blockerJob = "myjob-blocker" + suffix;
+        const lowJob = "myjob-low" + suffix;
+        const highJob = "myjob-high" + suffix;
+        // All builds require the same lock, so they are queued while the
+        // first one is running
+        cy.createJob(blockerJob, `
+desc: Blocker
+locks:
+  - ${lockName}
+tasks:
+  - name: Sleep
+    run: sleep 2
+`);
+        cy.createJob(lowJob, `
+desc: Low priority
+locks:
+  - ${lockName}
+tasks:
+  - name: Print date
+    run: date
+`);
+        cy.createJob(highJob, `
+desc: High priority
+priority: 10
+locks:
+  - ${lockName}
+tasks:
+  - name: Print date
+    run: date
+`);
+
+        cy.runJob(blockerJob).then((blockerID) => {
+            cy.waitForBuild(blockerID, ["running"]);
+            cy.runJob(lowJob).then((lowID) => {
+                cy.runJob(highJob).then((highID) => {
+                    cy.api("/api/queue/").then((resp) => {
+                        const queued = resp.body.queued.filter((item) => [lowID, highID].includes(item.id));
+                        expect(queued.map((item) => item.id)).to.deep.equal([highID, lowID]);
+                        // Priority aging is disabled by default
+                        expect(queued[0].effectivePriority).to.eq(10);
+                        expect(queued[1].effectivePriority).to.eq(0);
+                    });
+                    cy.waitForBuild(lowID).then((low) => {
+                        cy.waitForBuild(highID).then((high) => {
+                            expect(new Date(high.startedAt).getTime()).to.be.below(new Date(low.startedAt).getTime());
+                        });
+                    });
+                });
+            });
+        });
+    });
+
+    it("should reject builds above max_queued", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Max queued
+max_queued: 1
+tasks:
+  - name: Sleep
+    run: sleep 3
+`);
+
+        cy.runJob(jobName).then((runningID) => {
+            cy.waitForBuild(runningID, ["running"]);
+            cy.runJob(jobName).then((queuedID) => {
+                cy.api(`/api/job/${jobName}/run`, {
+                    method: "POST",
+                    form: true,
+                    body: {},
+                    failOnStatusCode: false,
+                }).then((resp) => {
+                    expect(resp.status).to.eq(429);
+                    expect(resp.body).to.include("already has 1 queued builds");
+                });
+                // The rejected build is not kept in the history
+                cy.api("/api/feed", {qs: {filter: jobName}}).then((resp) => {
+                    const ids = resp.body.filter((item) => item.name === jobName).map((item) => item.id);
+                    expect(ids).to.have.members([runningID, queuedID]);
+                });
+                cy.api(`/api/build/${runningID}/abort`, {method: "POST"});
+                cy.api(`/api/build/${queuedID}/abort`, {method: "POST"});
+                cy.waitForBuild(queuedID, ["aborted"]);
+            });
+        });
+    });
+});
@@ -0,0 +1,127 @@
+describe("Approval", function() {
+    it("should wait for approval of every approval task", function() {
+        const jobName = "myjob" + new Date().getTime();
+        // The build is waiting longer than the timeout of the job, the time of
+        // waiting for approval is not counted
+        cy.createJob(jobName, `
+desc: Approval test
+timeout: 5s
+tasks:
+  - name: Sign-off 1
+    approval:
+      message: Continue?
+
+  - name: Sleep
+    run: sleep 2
+
+  - name: Sign-off 2
+    approval:
+      message: Continue again?
+
+  - name: Print kernel information
+    run: uname -a
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id, ["waiting"]);
+            cy.wait(6000);
+            cy.api(`/api/build/${id}`).its("body.status_update.status").should("eq", "waiting");
+            // The approver is taken from credentials, not from the request
+            cy.api(`/api/build/${id}/approve`, {
+                method: "POST",
+                auth: {user: "cypress", pass: "admin"},
+                body: {approver: "somebody", comment: "first"},
+                form: true,
+            });
+            // A decision can be made only once
+            cy.api(`/api/build/${id}/approve`, {
+                method: "POST",
+                auth: {user: "cypress", pass: "admin"},
+                body: {comment: "again"},
+                form: true,
+                failOnStatusCode: false,
+            }).its("status").should("eq", 404);
+
+            // The second approval task doesn't use the repeated decision
+            cy.wait(3000);
+            cy.waitForBuild(id, ["waiting"]).then((update) => {
+                expect(update.tasks[1].status).to.eq("finished");
+                expect(update.tasks[2].status).to.eq("waiting");
+                expect(update.approvals).to.have.length(1);
+                expect(update.approvals[0].approver).to.eq("cypress");
+                expect(update.approvals[0].comment).to.eq("first");
+            });
+            cy.api(`/api/build/${id}/approve`, {
+                method: "POST",
+                body: {comment: "second"},
+                form: true,
+            });
+            cy.waitForBuild(id).then((update) => {
+                expect(update.approvals).to.have.length(2);
+                expect(update.approvals[1].decision).to.eq("approved");
+                expect(update.approvals[1].approver).to.eq("api");
+            });
+            cy.api(`/api/build/${id}/task/3/log`).its("body").should("contain", "uname -a");
+        });
+    });
+
+    it("should fail rejected build", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Rejection test
+tasks:
+  - name: Sign-off
+    approval:
+      message: Continue?
+
+  - name: Print date
+    run: date
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id, ["waiting"]);
+            // The build doesn't occupy an executor while it is waiting
+            cy.api("/api/queue/").then((resp) => {
+                expect(resp.body.waiting.map((item) => item.id)).to.include(id);
+                expect(resp.body.running.map((item) => item.id)).to.not.include(id);
+            });
+            cy.api(`/api/build/${id}/reject`, {
+                method: "POST",
+                auth: {user: "cypress", pass: "admin"},
+                body: {comment: "not now"},
+                form: true,
+            });
+            cy.waitForBuild(id, ["failed"]).then((update) => {
+                expect(update.tasks[1].status).to.eq("pending");
+                expect(update.approvals[0].decision).to.eq("rejected");
+            });
+            cy.api(`/api/build/${id}/task/0/log`).its("body").should("contain", "> Rejected by cypress: not now");
+        });
+    });
+
+    it("should abort the build right after approval", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Abort after approval test
+tasks:
+  - name: Sign-off
+    approval:
+      message: Continue?
+
+  - name: Sleep
+    run: sleep 10
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id, ["waiting"]);
+            cy.api(`/api/build/${id}/approve`, {method: "POST"});
+            cy.api(`/api/build/${id}/abort`, {method: "POST"});
+            cy.waitForBuild(id, ["aborted"], 20);
+            // The queue is still operational
+            cy.api("/api/queue/").then((resp) => {
+                expect(resp.body.waiting.map((item) => item.id)).to.not.include(id);
+                expect(resp.body.running.map((item) => item.id)).to.not.include(id);
+            });
+        });
+    });
+});
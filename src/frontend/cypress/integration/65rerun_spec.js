@@ -0,0 +1,74 @@
+describe("Rerun", function() {
+    it("should rerun a build from the failed task", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Rerun test
+params:
+  - GREETING: hello
+tasks:
+  - name: Prepare workspace
+    run: echo $GREETING > state.txt
+
+  - name: Skipped by condition
+    run: echo skipped
+    when: 1 == 2
+
+  - name: Fail for the first time
+    run: test -f fixed || (touch fixed; exit 1)
+
+  - name: Read workspace
+    run: cat state.txt
+`);
+
+        cy.runJob(jobName, {GREETING: "bonjour"}).then((id) => {
+            cy.waitForBuild(id, ["failed"]);
+            cy.api(`/api/build/${id}/rerun`, {
+                method: "POST",
+                body: {from_task: "failed"},
+                form: true,
+            }).then((resp) => {
+                const rerunID = parseInt(resp.body, 10);
+                cy.waitForBuild(rerunID).then((update) => {
+                    expect(update.rerunOf).to.eq(id);
+                    expect(update.params).to.deep.equal([{GREETING: "bonjour"}]);
+                    expect(update.tasks.map((item) => item.status)).to.deep.equal(["skipped", "skipped", "finished", "finished"]);
+                });
+                // The workspace of the original build is reused
+                cy.api(`/api/build/${rerunID}/task/3/log`).its("body").should("contain", "bonjour");
+
+                // There is nothing to rerun from
+                cy.api(`/api/build/${rerunID}/rerun`, {
+                    method: "POST",
+                    body: {from_task: "failed"},
+                    form: true,
+                    failOnStatusCode: false,
+                }).then((resp) => {
+                    expect(resp.status).to.eq(400);
+                    expect(resp.body).to.include("doesn't have failed tasks");
+                });
+            });
+        });
+    });
+
+    it("should rerun the whole build", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Rerun test
+tasks:
+  - name: Print date
+    run: date
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/rerun`, {method: "POST"}).then((resp) => {
+                const rerunID = parseInt(resp.body, 10);
+                expect(rerunID).to.be.above(id);
+                cy.waitForBuild(rerunID).then((update) => {
+                    expect(update.rerunOf).to.eq(id);
+                    expect(update.tasks[0].status).to.eq("finished");
+                });
+            });
+        });
+    });
+});
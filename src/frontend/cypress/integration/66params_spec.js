@@ -0,0 +1,70 @@
+describe("Typed params", function() {
+    it("should validate params", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Params test
+params:
+  - name: COUNT
+    type: int
+    default: 1
+  - name: MODE
+    type: choice
+    choices: [fast, slow]
+    default: fast
+  - name: TAG
+    regex: ^v[0-9]+$
+    default: v1
+tasks:
+  - name: Print params
+    run: echo $COUNT $MODE $TAG
+`);
+
+        cy.api(`/api/job/${jobName}/params`).then((resp) => {
+            expect(resp.body.map((item) => item.type)).to.deep.equal(["int", "choice", "string"]);
+            expect(resp.body[1].choices).to.deep.equal(["fast", "slow"]);
+        });
+
+        cy.api(`/api/job/${jobName}/run`, {
+            method: "POST",
+            body: {COUNT: "five", MODE: "medium", TAG: "latest"},
+            form: true,
+            failOnStatusCode: false,
+        }).then((resp) => {
+            expect(resp.status).to.eq(400);
+            expect(resp.body.errors.map((item) => item.param)).to.have.members(["COUNT", "MODE", "TAG"]);
+        });
+
+        cy.runJob(jobName, {COUNT: "3", MODE: "slow"}).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/task/0/log`).its("body").should("contain", "3 slow v1");
+        });
+    });
+
+    it("should hide values of secret params", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Secret params test
+params:
+  - name: TOKEN
+    secret: true
+    default: ""
+  - name: USER
+    default: joe
+tasks:
+  - name: Use the token
+    run: |
+      test -n "$TOKEN"
+      echo "params=$WAKE_JOB_PARAMS"
+`);
+
+        cy.runJob(jobName, {TOKEN: "s3cr3t"}).then((id) => {
+            cy.waitForBuild(id).then((update) => {
+                expect(JSON.stringify(update.params)).to.not.include("s3cr3t");
+            });
+            cy.api(`/api/build/${id}/task/0/log`).then((resp) => {
+                expect(resp.body).to.not.include("s3cr3t");
+                expect(resp.body).to.include("USER=joe");
+            });
+        });
+    });
+});
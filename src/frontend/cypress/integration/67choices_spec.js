@@ -0,0 +1,39 @@
+describe("Dynamic choices", function() {
+    it("should generate choices of params by the command", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Dynamic choices test
+params:
+  - name: TARGET
+    type: choice
+    choices_from: echo $WAKE_JOB_NAME; date +%s%N
+    choices_cache: 2s
+tasks:
+  - name: Print target
+    run: echo deploy to $TARGET
+`);
+
+        cy.api(`/api/job/${jobName}/params`).then((resp) => {
+            const choices = resp.body[0].choices;
+            expect(choices).to.have.length(2);
+            expect(choices[0]).to.eq(jobName);
+
+            // The choices are cached
+            cy.api(`/api/job/${jobName}/params`).its("body.0.choices").should("deep.equal", choices);
+            cy.wait(2500);
+            cy.api(`/api/job/${jobName}/params`).its("body.0.choices.1").should("not.eq", choices[1]);
+        });
+
+        cy.api(`/api/job/${jobName}/run`, {
+            method: "POST",
+            body: {TARGET: "nowhere"},
+            form: true,
+            failOnStatusCode: false,
+        }).its("status").should("eq", 400);
+
+        cy.runJob(jobName, {TARGET: jobName}).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/task/0/log`).its("body").should("contain", `deploy to ${jobName}`);
+        });
+    });
+});
@@ -0,0 +1,43 @@
+describe("Task outputs", function() {
+    it("should pass outputs to the following tasks", function() {
+        const jobName = "myjob" + new Date().getTime();
+        // Values of outputs are never pasted into commands
+        cy.createJob(jobName, `
+desc: Outputs test
+tasks:
+  - name: build
+    run: |
+      echo "version=1.2.3" >> $WAKE_OUTPUT
+      echo "PATH=/nowhere" >> $WAKE_OUTPUT
+      echo 'payload=$(touch pwned)' >> $WAKE_OUTPUT
+
+  - name: Skipped by outputs
+    run: echo skipped
+    when: \${outputs.build.version} == "0.0.1"
+
+  - name: Use outputs
+    run: |
+      test ! -f pwned
+      echo "version=$WAKE_OUTPUT_version"
+      echo "payload=\${outputs.build.payload}"
+      which bash
+    when: \${outputs.0.version} == "1.2.3"
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id).then((update) => {
+                expect(update.tasks[0].outputs).to.deep.equal({
+                    version: "1.2.3",
+                    PATH: "/nowhere",
+                    payload: "$(touch pwned)",
+                });
+            });
+            cy.api(`/api/build/${id}/task/1/log`).its("body").should("contain", "Skipping the task");
+            cy.api(`/api/build/${id}/task/2/log`).then((resp) => {
+                expect(resp.body).to.include("version=1.2.3");
+                expect(resp.body).to.include("payload=$(touch pwned)");
+                expect(resp.body).to.include("Condition is true");
+            });
+        });
+    });
+});
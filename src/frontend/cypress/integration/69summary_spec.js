@@ -0,0 +1,53 @@
+describe("Build summary", function() {
+    it("should attach summary, badges and links to the build", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Summary test
+tasks:
+  - name: Write summary
+    run: |
+      echo "## Release" >> $WAKE_SUMMARY
+      echo "::badge version=${jobName}" >> $WAKE_SUMMARY
+      echo "::link Coverage report=https://example.com/coverage/" >> $WAKE_SUMMARY
+
+  - name: Append summary
+    run: |
+      echo "All checks passed" >> $WAKE_SUMMARY
+      echo "::badge coverage=87%" >> $WAKE_SUMMARY
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id).then((update) => {
+                expect(update.summary.markdown).to.include("## Release");
+                expect(update.summary.markdown).to.include("All checks passed");
+                expect(update.summary.badges).to.deep.equal({version: jobName, coverage: "87%"});
+                expect(update.summary.links).to.deep.equal([{title: "Coverage report", url: "https://example.com/coverage/"}]);
+            });
+
+            cy.api("/api/feed", {qs: {badge: `version=${jobName}`}}).then((resp) => {
+                expect(resp.body.map((item) => item.id)).to.deep.equal([id]);
+            });
+            cy.api("/api/feed", {qs: {badge: jobName}}).its("body.0.id").should("eq", id);
+            cy.api("/api/feed", {qs: {badge: `coverage=${jobName}`}}).its("body").should("be.null");
+        });
+    });
+
+    it("should reject links which are not web pages", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Summary test
+tasks:
+  - name: Write summary
+    run: |
+      echo "Unsafe link" >> $WAKE_SUMMARY
+      echo "::link Click me=javascript:alert(1)" >> $WAKE_SUMMARY
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id).then((update) => {
+                expect(update.status).to.eq("finished");
+                expect(update.summary).to.be.null;
+            });
+        });
+    });
+});
@@ -0,0 +1,77 @@
+describe("Test reports", function() {
+    it("should parse test reports of the build", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Test reports
+params:
+  - RESULT: passed
+tasks:
+  - name: Run tests
+    run: |
+      mkdir -p reports
+      if [ "$RESULT" = "failed" ]; then MOO='<failure message="expected moo"/>'; fi
+      cat > reports/junit.xml <<EOF
+      <testsuites>
+        <testsuite name="pkg.A">
+          <testcase name="TestSay" time="1.5"/>
+          <testcase name="TestMoo" time="0.1">$MOO</testcase>
+          <testcase name="TestSleep"><skipped/></testcase>
+        </testsuite>
+      </testsuites>
+      EOF
+      printf "TAP version 13\\n1..2\\nok 1 - lint\\nok 2 - docs # SKIP no docs\\n" > reports/checks.tap
+reports:
+  - "reports/*"
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/tests`).then((resp) => {
+                expect(resp.body.total).to.eq(5);
+                expect(resp.body.passed).to.eq(3);
+                expect(resp.body.skipped).to.eq(2);
+                expect(resp.body.slowest[0].name).to.eq("pkg.A.TestSay");
+                expect(resp.body.reports).to.have.members(["reports/junit.xml", "reports/checks.tap"]);
+            });
+        });
+
+        // A regression which is fixed later is not flaky
+        cy.runJob(jobName, {RESULT: "failed"}).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/tests`).then((resp) => {
+                expect(resp.body.failed).to.eq(1);
+                expect(resp.body.failures[0].name).to.eq("pkg.A.TestMoo");
+                expect(resp.body.failures[0].message).to.eq("expected moo");
+                expect(resp.body.flaky).to.be.null;
+            });
+        });
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/tests`).its("body.flaky").should("be.null");
+        });
+
+        // The test which keeps changing its result is flaky
+        cy.runJob(jobName, {RESULT: "failed"}).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/tests`).then((resp) => {
+                expect(resp.body.flaky).to.deep.equal(["pkg.A.TestMoo"]);
+                expect(resp.body.failures[0].flaky).to.be.true;
+            });
+        });
+    });
+
+    it("should return 404 for builds without reports", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: No reports
+tasks:
+  - name: Print date
+    run: date
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/tests`, {failOnStatusCode: false}).its("status").should("eq", 404);
+        });
+    });
+});
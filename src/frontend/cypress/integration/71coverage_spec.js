@@ -0,0 +1,56 @@
+describe("Coverage", function() {
+    it("should fail the build when coverage regresses", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Coverage test
+params:
+  - COVERED: 1
+tasks:
+  - name: Write coverage
+    run: |
+      echo "SF:cow/say.go" > lcov.info
+      echo "DA:1,1" >> lcov.info
+      echo "DA:2,$COVERED" >> lcov.info
+      echo "end_of_record" >> lcov.info
+      echo "SF:cow/sleep/sleep.go" >> lcov.info
+      echo "DA:1,1" >> lcov.info
+      echo "DA:2,1" >> lcov.info
+      echo "end_of_record" >> lcov.info
+coverage:
+  files:
+    - lcov.info
+  threshold: 40
+  fail_on_regression: yes
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/coverage`).then((resp) => {
+                expect(resp.body.total).to.eq(100);
+                expect(resp.body.packages).to.deep.equal({"cow": 100, "cow/sleep": 100});
+                expect(resp.body.files).to.deep.equal(["lcov.info"]);
+            });
+        });
+
+        cy.runJob(jobName, {COVERED: "0"}).then((id) => {
+            // The task has succeeded, the reason is in the summary
+            cy.waitForBuild(id, ["failed"]).then((update) => {
+                expect(update.tasks[0].status).to.eq("finished");
+                expect(update.summary.markdown).to.include("**Coverage check failed:** coverage 75% is lower than 100%");
+            });
+            cy.api(`/api/build/${id}/coverage`).then((resp) => {
+                expect(resp.body.total).to.eq(75);
+                expect(resp.body.packages.cow).to.eq(50);
+                expect(resp.body.error).to.include("is lower than");
+            });
+        });
+
+        cy.api(`/api/job/${jobName}/coverage`, {qs: {last: 1}}).then((resp) => {
+            expect(resp.body.map((item) => item.total)).to.deep.equal([75]);
+        });
+        cy.api(`/api/job/${jobName}/coverage`).then((resp) => {
+            expect(resp.body.map((item) => item.total)).to.deep.equal([100, 75]);
+        });
+        cy.api(`/api/job/${jobName}/coverage`, {qs: {last: 1000}}).its("body").should("have.length", 2);
+    });
+});
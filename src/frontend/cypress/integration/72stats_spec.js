@@ -0,0 +1,42 @@
+describe("Job statistics", function() {
+    it("should collect statistics of terminal builds", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Statistics test
+params:
+  - EXIT_CODE: 0
+tasks:
+  - name: Exit
+    run: exit $EXIT_CODE
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id);
+        });
+        cy.runJob(jobName, {EXIT_CODE: "1"}).then((id) => {
+            cy.waitForBuild(id, ["failed"]);
+        });
+
+        cy.api(`/api/job/${jobName}/stats`, {qs: {window: "1d"}}).then((resp) => {
+            expect(resp.body.window).to.eq(24 * 3600 * 1e9);
+            expect(resp.body.builds).to.eq(2);
+            expect(resp.body.finished).to.eq(1);
+            expect(resp.body.failed).to.eq(1);
+            expect(resp.body.successRate).to.eq(50);
+            expect(resp.body.failureRate).to.eq(50);
+            expect(resp.body.durationP50).to.be.above(0);
+            expect(resp.body.tasks).to.have.length(1);
+            expect(resp.body.tasks[0].name).to.eq("Exit");
+            expect(resp.body.tasks[0].count).to.eq(2);
+            expect(resp.body.tasks[0].failed).to.eq(1);
+        });
+
+        cy.api(`/api/job/${jobName}/stats`, {qs: {window: "forever"}, failOnStatusCode: false}).its("status").should("eq", 400);
+
+        cy.api("/api/jobs/").then((resp) => {
+            const job = resp.body.find((item) => item.name === jobName);
+            expect(job.stats.builds).to.eq(2);
+            expect(job.stats.successRate).to.eq(50);
+        });
+    });
+});
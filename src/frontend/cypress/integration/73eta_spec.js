@@ -0,0 +1,59 @@
+describe("ETA", function() {
+    it("should estimate duration of running and queued builds", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: ETA test
+tasks:
+  - name: Sleep 1
+    run: sleep 1
+
+  - name: Sleep 2
+    run: sleep 1
+`);
+
+        // Without history there is nothing to estimate
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id).its("eta").should("eq", 0);
+        });
+
+        cy.runJob(jobName).then((runningID) => {
+            cy.runJob(jobName).then((queuedID) => {
+                cy.waitForBuild(runningID, ["running"]).then((update) => {
+                    expect(update.eta).to.be.within(1.5e9, 4e9);
+                    expect(update.etaLow).to.be.at.most(update.eta);
+                    expect(update.etaHigh).to.be.at.least(update.eta);
+                });
+                cy.api("/api/queue/").then((resp) => {
+                    const queued = resp.body.queued.find((item) => item.id === queuedID);
+                    // The build can't start before the running build of the same job is finished
+                    expect(queued.etaToStart).to.be.within(0.5e9, 4e9);
+                    expect(queued.eta).to.be.above(0);
+                });
+                cy.waitForBuild(queuedID);
+            });
+        });
+    });
+
+    it("should not save the job with unknown eta_params", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.api("/api/jobs/create", {method: "POST", body: {name: jobName}, form: true});
+        cy.api(`/api/job/${jobName}`, {
+            method: "POST",
+            body: {fileContent: `
+desc: ETA test
+params:
+  - ENV: staging
+eta_params:
+  - TARGET
+tasks:
+  - name: Print date
+    run: date
+`},
+            form: true,
+            failOnStatusCode: false,
+        }).then((resp) => {
+            expect(resp.status).to.eq(400);
+            expect(resp.body).to.include("unknown param TARGET in eta_params");
+        });
+    });
+});
@@ -0,0 +1,26 @@
+describe("Metrics", function() {
+    it("should export metrics of builds", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Metrics test
+tasks:
+  - name: Print date
+    run: date
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id);
+        });
+
+        // Metrics are available without credentials from the local host
+        cy.request("/metrics").then((resp) => {
+            expect(resp.body).to.include("# TYPE wakeci_queue_length gauge");
+            expect(resp.body).to.include("wakeci_ws_clients");
+            expect(resp.body).to.include("wakeci_db_size_bytes");
+            expect(resp.body).to.include(`wakeci_builds_total{job="${jobName}",status="finished"} 1`);
+            expect(resp.body).to.include(`wakeci_build_duration_seconds_count{job="${jobName}",status="finished"} 1`);
+            expect(resp.body).to.include(`wakeci_task_duration_seconds_count{job="${jobName}",task="Print date",kind="main"} 1`);
+            expect(resp.body).to.include("wakeci_http_request_duration_seconds_bucket");
+        });
+    });
+});
@@ -0,0 +1,86 @@
+describe("Notifications", function() {
+    it("should notify about the failed build", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Notifications test
+notify:
+  - cypress-chat
+  - cypress-mail
+  - notifier: cypress-webhook
+    statuses: [running, failed]
+tasks:
+  - name: Compile
+    run: exit 1
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id, ["failed"]);
+
+            cy.task("standin:requests", {path: "/webhook", contains: `"job":"${jobName}"`, count: 2}).then((requests) => {
+                // Notifications are delivered in parallel
+                expect(requests.map((item) => item.json.status)).to.have.members(["running", "failed"]);
+                const failed = requests.find((item) => item.json.status === "failed");
+                expect(failed.headers["x-token"]).to.eq("cypress");
+                expect(failed.json.buildID).to.eq(id);
+                expect(failed.json.failedTask).to.eq("Compile");
+                expect(failed.json.url).to.match(new RegExp(`build/${id}$`));
+                expect(failed.json.text).to.include("Failed task: Compile");
+            });
+
+            // Only failed builds are reported by default
+            cy.task("standin:requests", {path: "/chat", contains: `${jobName} #`}).then((requests) => {
+                expect(requests.map((item) => item.json.text)).to.deep.equal([`${jobName} #${id}: failed (Compile)`]);
+            });
+
+            cy.task("standin:mails", {contains: jobName}).then((mails) => {
+                expect(mails).to.have.length(1);
+                expect(mails[0].to).to.deep.equal(["<team@localhost>"]);
+                expect(mails[0].data).to.include(`Subject: [wakeci] ${jobName} #${id}: failed`);
+                expect(mails[0].data).to.include("Failed task: Compile");
+            });
+        });
+    });
+
+    it("should retry delivery of notifications", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Notifications test
+notify:
+  - notifier: cypress-flaky
+    statuses: [finished]
+tasks:
+  - name: Print date
+    run: date
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id);
+            // The first attempt fails
+            cy.task("standin:requests", {path: "/flaky", contains: `"job":"${jobName}"`, count: 2}).then((requests) => {
+                expect(requests.map((item) => item.status)).to.deep.equal([503, 200]);
+                expect(requests[1].body).to.eq(requests[0].body);
+            });
+        });
+    });
+
+    it("should not save the job with unknown notifier", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.api("/api/jobs/create", {method: "POST", body: {name: jobName}, form: true});
+        cy.api(`/api/job/${jobName}`, {
+            method: "POST",
+            body: {fileContent: `
+desc: Notifications test
+notify:
+  - nobody
+tasks:
+  - name: Print date
+    run: date
+`},
+            form: true,
+            failOnStatusCode: false,
+        }).then((resp) => {
+            expect(resp.status).to.eq(400);
+            expect(resp.body).to.include("nobody");
+        });
+    });
+});
@@ -0,0 +1,48 @@
+describe("Fixed and broken builds", function() {
+    it("should react only when the outcome changes", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Fixed and broken test
+params:
+  - EXIT_CODE: 0
+notify:
+  - notifier: cypress-webhook
+    statuses: [fixed, broken]
+tasks:
+  - name: Exit
+    run: exit $EXIT_CODE
+on_fixed:
+  - name: Celebrate
+    run: echo fixed
+on_broken:
+  - name: Complain
+    run: echo broken
+`);
+
+        const executed = (update, kind) => update.tasks.find((item) => item.kind === kind).status !== "pending";
+        // The first build has nothing to compare with
+        const outcomes = [
+            ["1", "failed", false, false],
+            ["1", "failed", false, false],
+            ["0", "finished", false, true],
+            ["0", "finished", false, false],
+            ["1", "failed", true, false],
+        ];
+        const ids = [];
+        for (const [exitCode, status, broken, fixed] of outcomes) {
+            cy.runJob(jobName, {EXIT_CODE: exitCode}).then((id) => {
+                ids.push(id);
+                cy.waitForBuild(id, [status]).then((update) => {
+                    expect(executed(update, "broken")).to.eq(broken);
+                    expect(executed(update, "fixed")).to.eq(fixed);
+                });
+            });
+        }
+
+        // Notifications are delivered asynchronously
+        cy.wait(1000);
+        cy.task("standin:requests", {path: "/webhook", contains: `"job":"${jobName}"`, count: 2}).then((requests) => {
+            expect(requests.map((item) => [item.json.buildID, item.json.status])).to.deep.equal([[ids[2], "fixed"], [ids[4], "broken"]]);
+        });
+    });
+});
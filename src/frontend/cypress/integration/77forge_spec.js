@@ -0,0 +1,99 @@
+describe("Commit statuses", function() {
+    it("should report statuses of the build to Gitea", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Gitea test
+params:
+  - name: SHA
+    default: ""
+  - name: GITEA_TOKEN
+    secret: true
+    default: ""
+report_status:
+  forge: gitea
+  url: http://127.0.0.1:8082/gitea/
+  repo: owner/${jobName}
+  sha: SHA
+  token: GITEA_TOKEN
+tasks:
+  - name: Print date
+    run: date
+`);
+
+        cy.runJob(jobName, {SHA: "abc123", GITEA_TOKEN: "t0ken"}).then((id) => {
+            cy.waitForBuild(id);
+            const path = `/gitea/api/v1/repos/owner/${jobName}/statuses/abc123`;
+            cy.task("standin:requests", {path: path, count: 3}).then((requests) => {
+                expect(requests.map((item) => item.json.state)).to.deep.equal(["pending", "pending", "success"]);
+                expect(requests[2].headers["authorization"]).to.eq("token t0ken");
+                expect(requests[2].json.context).to.eq(`wakeci/${jobName}`);
+                expect(requests[2].json.target_url).to.match(new RegExp(`build/${id}$`));
+            });
+        });
+
+        // Nothing is reported without the commit
+        cy.runJob(jobName, {GITEA_TOKEN: "t0ken"}).then((id) => {
+            cy.waitForBuild(id);
+            cy.wait(500);
+            cy.task("standin:requests", {path: `/gitea/api/v1/repos/owner/${jobName}/statuses/`, timeout: 0}).its("length").should("eq", 3);
+        });
+    });
+
+    it("should report statuses of the build to GitHub Enterprise", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: GitHub test
+params:
+  - name: COMMIT
+    default: ""
+  - name: TOKEN
+    secret: true
+    default: ""
+report_status:
+  forge: github
+  url: http://127.0.0.1:8082/github
+  repo: owner/${jobName}
+  sha: COMMIT
+  token: TOKEN
+  context: ci/wakeci
+tasks:
+  - name: Fail
+    run: exit 1
+`);
+
+        cy.runJob(jobName, {COMMIT: "def456", TOKEN: "t0ken"}).then((id) => {
+            cy.waitForBuild(id, ["failed"]);
+            cy.task("standin:requests", {path: `/github/api/v3/repos/owner/${jobName}/statuses/def456`, count: 3}).then((requests) => {
+                expect(requests.map((item) => item.json.state)).to.deep.equal(["pending", "pending", "failure"]);
+                expect(requests[2].json.context).to.eq("ci/wakeci");
+            });
+        });
+    });
+
+    it("should require the token in a secret param", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.api("/api/jobs/create", {method: "POST", body: {name: jobName}, form: true});
+        cy.api(`/api/job/${jobName}`, {
+            method: "POST",
+            body: {fileContent: `
+desc: GitHub test
+params:
+  - COMMIT: ""
+  - TOKEN: ""
+report_status:
+  forge: github
+  repo: owner/${jobName}
+  sha: COMMIT
+  token: TOKEN
+tasks:
+  - name: Print date
+    run: date
+`},
+            form: true,
+            failOnStatusCode: false,
+        }).then((resp) => {
+            expect(resp.status).to.eq(400);
+            expect(resp.body).to.include("must be secret");
+        });
+    });
+});
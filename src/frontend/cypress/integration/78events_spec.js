@@ -0,0 +1,68 @@
+describe("Events", function() {
+    // Event hooks in Wakefile.yaml are subscribed to events of this job
+    const jobName = "cypress-events";
+
+    before(function() {
+        cy.api("/api/jobs/create", {method: "POST", body: {name: jobName}, form: true, failOnStatusCode: false});
+        cy.api(`/api/job/${jobName}`, {
+            method: "POST",
+            body: {fileContent: `
+desc: Events test
+params:
+  - GREETING: hello
+  - SLEEP: 0
+tasks:
+  - name: Print greeting
+    run: sleep $SLEEP; echo $GREETING
+`},
+            form: true,
+        });
+    });
+
+    it("should replay events of the build", function() {
+        cy.runJob(jobName, {GREETING: "bonjour"}).then((id) => {
+            cy.waitForBuild(id);
+            cy.task("sse:read", {path: "/api/events", qs: {since: 0, jobs: jobName}}).then((result) => {
+                expect(result.status).to.eq(200);
+                expect(result.headers["content-type"]).to.eq("text/event-stream");
+                const events = result.events.filter((item) => item.data.buildID === id);
+                expect(events.map((item) => [item.event, item.data.status])).to.deep.equal([
+                    ["build:created", "pending"],
+                    ["build:status", "running"],
+                    ["task:status", "running"],
+                    ["task:status", "running"],
+                    ["build:status", "finished"],
+                ]);
+                expect(events[0].data.params).to.deep.equal([{GREETING: "bonjour"}, {SLEEP: "0"}]);
+                expect(events[3].data.task.status).to.eq("finished");
+                for (const item of events) {
+                    expect(item.data.seq).to.eq(item.id);
+                    expect(item.data.job).to.eq(jobName);
+                }
+
+                // Resume from the last received event
+                const headers = {"Last-Event-ID": events[1].id};
+                cy.task("sse:read", {path: "/api/events", qs: {types: "build:status"}, headers: headers}).then((result) => {
+                    const resumed = result.events.filter((item) => item.data.buildID === id);
+                    expect(resumed.map((item) => item.data.status)).to.deep.equal(["finished"]);
+                });
+            });
+
+            // The same events are sent to the event hook
+            cy.task("standin:requests", {path: "/events", contains: `"buildID":${id},`, count: 3}).then((requests) => {
+                expect(requests.map((item) => item.json.type)).to.deep.equal(["build:created", "build:status", "build:status"]);
+                expect(requests[0].headers["x-wakeci-signature"]).to.match(/^sha256=[0-9a-f]{64}$/);
+            });
+        });
+    });
+
+    it("should stream new events", function() {
+        cy.runJob(jobName, {SLEEP: "1"}).then((id) => {
+            const qs = {jobs: jobName, types: "build:status"};
+            cy.task("sse:read", {path: "/api/events", qs: qs, duration: 2000}).then((result) => {
+                const events = result.events.filter((item) => item.data.buildID === id);
+                expect(events.map((item) => item.data.status)).to.include("finished");
+            });
+        });
+    });
+});
@@ -0,0 +1,53 @@
+describe("Log replay", function() {
+    it("should replay log messages missed by the client", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Replay test
+tasks:
+  - name: Print lines
+    run: |
+      for i in $(seq 1 10); do echo "line $i"; done
+      sleep 3
+`);
+
+        cy.runJob(jobName).then((id) => {
+            const tag = `build:log:${id}`;
+            const subscribe = (since) => ({type: "in:subscribe", data: {to: [tag], since: since}});
+            const logOf = (result) => result.messages.filter((item) => item.type === tag).map((item) => item.data);
+            cy.waitForBuild(id, ["running"]);
+            cy.wait(1000);
+            cy.task("ws:session", {send: [subscribe(0)], duration: 500}).then((result) => {
+                expect(result.status).to.eq(101);
+                const messages = logOf(result);
+                const text = messages.map((item) => item.data).join("");
+                expect(text).to.include("line 1\n");
+                expect(text).to.include("line 10\n");
+                // IDs are increasing
+                const ids = messages.map((item) => item.id);
+                expect(ids).to.deep.equal([...ids].sort((a, b) => a - b));
+                const lastID = ids[ids.length - 1];
+
+                // Only messages after since are replayed
+                cy.task("ws:session", {send: [subscribe(lastID - 2)], duration: 500}).then((result) => {
+                    const replayed = logOf(result);
+                    const text = replayed.map((item) => item.data).join("");
+                    expect(text).to.include("line 9\n");
+                    expect(text).to.include("line 10\n");
+                    expect(text).to.not.include("line 8\n");
+                    expect(replayed[replayed.length - 1].id).to.eq(lastID);
+                });
+                cy.task("ws:session", {send: [subscribe(lastID)], duration: 500}).then((result) => {
+                    expect(logOf(result)).to.have.length(0);
+                });
+            });
+
+            // Live messages follow the replayed ones
+            cy.task("ws:session", {send: [subscribe(0)], duration: 3000}).then((result) => {
+                const text = logOf(result).map((item) => item.data).join("");
+                expect(text).to.include("line 1\n");
+                expect(text).to.include("> Exit code: 0");
+            });
+            cy.waitForBuild(id);
+        });
+    });
+});
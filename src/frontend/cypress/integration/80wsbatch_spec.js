@@ -0,0 +1,29 @@
+describe("Log batching", function() {
+    it("should send log lines in batches", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Batching test
+tasks:
+  - name: Print lines
+    run: |
+      sleep 1
+      seq -f "line %g" 1 2000
+`);
+
+        cy.runJob(jobName).then((id) => {
+            const tag = `build:log:${id}`;
+            cy.task("ws:session", {send: [{type: "in:subscribe", data: {to: [tag]}}], duration: 3000}).then((result) => {
+                const messages = result.messages.filter((item) => item.type === tag);
+                const text = messages.map((item) => item.data.data).join("");
+                // All lines are delivered to the client which keeps up
+                expect(text).to.include("line 1\n");
+                expect(text).to.include("line 2000\n");
+                expect(text).to.not.include("log lines skipped");
+                // Lines are merged into a few messages and frames
+                expect(messages.length).to.be.below(100);
+                expect(result.frames.length).to.be.at.most(result.messages.length);
+            });
+            cy.waitForBuild(id).its("duration").should("be.below", 3e9);
+        });
+    });
+});
@@ -0,0 +1,45 @@
+describe("Websocket authorization", function() {
+    it("should reject connections from other origins", function() {
+        cy.task("ws:session", {origin: "http://evil.example.com", duration: 100}).its("status").should("eq", 403);
+        cy.task("ws:session", {origin: "http://localhost:8080", duration: 100}).its("status").should("eq", 101);
+    });
+
+    it("should reject connections without credentials", function() {
+        cy.task("ws:session", {auth: false, duration: 100}).its("status").should("eq", 403);
+    });
+
+    it("should reject unknown subscriptions", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Subscriptions test
+tasks:
+  - name: Sleep
+    run: sleep 1
+`);
+
+        cy.runJob(jobName).then((id) => {
+            // The empty prefix used to match all messages
+            const send = [
+                {type: "in:subscribe", data: {to: ["", "build:", "build:log:999999"]}},
+                {type: "in:subscribe", data: {to: [`build:update:${id}`]}},
+            ];
+            cy.task("ws:session", {send: send, duration: 2000}).then((result) => {
+                const types = new Set(result.messages.map((item) => item.type));
+                expect([...types]).to.deep.equal([`build:update:${id}`]);
+            });
+            cy.waitForBuild(id);
+        });
+    });
+
+    it("should close connections of the session when the user logs out", function() {
+        cy.request({url: "/auth/login", method: "POST", body: {password: "admin"}, form: true}).then((resp) => {
+            const cookie = resp.headers["set-cookie"][0].split(";")[0];
+            const options = {auth: false, cookie: cookie, duration: 3000, request: {path: "/auth/logout", delay: 500}};
+            cy.task("ws:session", options).then((result) => {
+                expect(result.status).to.eq(101);
+                expect(result.closeCode).to.eq(1008);
+                expect(result.closeReason).to.eq("authentication expired");
+            });
+        });
+    });
+});
@@ -0,0 +1,98 @@
+describe("Task logs", function() {
+    it("should return parts of the log", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Logs test
+tasks:
+  - name: Print lines
+    run: seq -f "line %g" 1 20
+
+  - name: Print error
+    run: sleep 1; echo "ERROR - disk full"
+`);
+
+        cy.runJob(jobName).then((id) => {
+            // The request waits for the task to complete
+            cy.api(`/api/build/${id}/task/1/log`, {qs: {follow: true}}).its("body").should("contain", "> Exit code: 0");
+
+            cy.api(`/api/build/${id}/task/0/log`).then((resp) => {
+                const size = parseInt(resp.headers["x-log-size"], 10);
+                expect(size).to.eq(resp.body.length);
+                cy.api(`/api/build/${id}/task/0/log`, {qs: {offset: size}}).its("body").should("eq", "");
+                cy.api(`/api/build/${id}/task/0/log`, {qs: {offset: size - 10, limit: 5}}).its("body").should("have.length", 5);
+            });
+
+            // The first line is the command
+            cy.api(`/api/build/${id}/task/0/log`, {qs: {fromLine: 3, toLine: 4}}).then((resp) => {
+                const lines = resp.body.trim().split("\n");
+                expect(lines).to.have.length(2);
+                expect(lines[0]).to.match(/ line 2$/);
+                expect(lines[1]).to.match(/ line 3$/);
+            });
+            cy.api(`/api/build/${id}/task/0/log`, {qs: {tail: 2}}).then((resp) => {
+                const lines = resp.body.trim().split("\n");
+                expect(lines).to.have.length(2);
+                expect(lines[0]).to.match(/ line 20$/);
+                expect(lines[1]).to.include("> Exit code: 0");
+            });
+            cy.api(`/api/build/${id}/task/0/log`, {qs: {follow: true, limit: 10}, failOnStatusCode: false}).its("status").should("eq", 400);
+        });
+    });
+
+    it("should follow logs of tasks which start while they are followed", function() {
+        const jobName = "myjob" + new Date().getTime();
+        const tasks = [...Array(10).keys()].map((i) => `
+  - name: Task ${i}
+    run: echo "task ${i}"
+`).join("");
+        cy.createJob(jobName, `
+desc: Follow quick tasks test
+tasks:${tasks}`);
+
+        cy.runJob(jobName).then((id) => {
+            for (let i = 9; i >= 0; i--) {
+                cy.api(`/api/build/${id}/task/${i}/log`, {qs: {follow: true}}).its("body").then((body) => {
+                    expect(body).to.contain(`task ${i}`);
+                    expect(body).to.contain("> Exit code: 0");
+                });
+            }
+        });
+    });
+
+    it("should search logs of the build", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Search test
+tasks:
+  - name: Print lines
+    run: seq -f "line %g" 1 20
+
+  - name: Print error
+    run: echo "ERROR - disk full"
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/log/search`, {qs: {q: "(?i)\\] error"}}).then((resp) => {
+                expect(resp.body.truncated).to.eq(false);
+                expect(resp.body.matches).to.have.length(1);
+                expect(resp.body.matches[0].taskID).to.eq(1);
+                expect(resp.body.matches[0].line).to.eq(2);
+                expect(resp.body.matches[0].text).to.match(/ERROR - disk full$/);
+            });
+            cy.api(`/api/build/${id}/log/search`, {qs: {q: "^\\[.*\\] line 1\\d$", limit: 5}}).then((resp) => {
+                expect(resp.body.truncated).to.eq(true);
+                expect(resp.body.matches.map((item) => item.line)).to.deep.equal([11, 12, 13, 14, 15]);
+            });
+            cy.api(`/api/build/${id}/log/search`, {qs: {q: "("}, failOnStatusCode: false}).its("status").should("eq", 400);
+
+            cy.api(`/api/build/${id}/log/download`, {encoding: "binary"}).then((resp) => {
+                expect(resp.headers["content-type"]).to.eq("application/zip");
+                expect(resp.headers["content-disposition"]).to.include(`build_${id}_logs.zip`);
+                expect(resp.body.startsWith("PK")).to.eq(true);
+                expect(resp.body).to.include("task_0.log");
+                expect(resp.body).to.include("task_1.log");
+            });
+        });
+    });
+});
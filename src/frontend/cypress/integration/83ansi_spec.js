@@ -0,0 +1,47 @@
+describe("Colored logs", function() {
+    it("should return logs in the requested format", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Colors test
+tasks:
+  - name: Print colors
+    run: printf '\\033[31mred\\033[0m <b>bold</b>\\n'
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id);
+            cy.api(`/api/build/${id}/task/0/log`).then((resp) => {
+                expect(resp.body).to.include("] red <b>bold</b>\n");
+                expect(resp.body).to.not.include("\u001b");
+            });
+            cy.api(`/api/build/${id}/task/0/log`, {qs: {format: "ansi"}}).its("body").should("contain", "\u001b[31mred\u001b[0m");
+            cy.api(`/api/build/${id}/task/0/log`, {qs: {format: "html"}}).then((resp) => {
+                expect(resp.body).to.include("<span class=\"ansi-fg-1\">red</span> &lt;b&gt;bold&lt;/b&gt;");
+            });
+            // Completed logs are compressed in the storage
+            cy.api(`/storage/build/${id}/task_0.log`, {qs: {format: "html"}})
+                .its("body").should("contain", "<span class=\"ansi-fg-1\">red</span>");
+            cy.api(`/api/build/${id}/task/0/log`, {qs: {format: "rainbow"}, failOnStatusCode: false}).its("status").should("eq", 400);
+        });
+    });
+
+    it("should stream logs in HTML", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Colors test
+tasks:
+  - name: Print colors
+    run: sleep 1; printf '\\033[1;32mgreen\\033[0m <i>\\n'
+`);
+
+        cy.runJob(jobName).then((id) => {
+            const tag = `build:log:${id}`;
+            const send = [{type: "in:subscribe", data: {to: [tag], format: "html"}}];
+            cy.task("ws:session", {send: send, duration: 2000}).then((result) => {
+                const text = result.messages.filter((item) => item.type === tag).map((item) => item.data.data).join("");
+                expect(text).to.include("<span class=\"ansi-fg-2 ansi-bold\">green</span> &lt;i&gt;");
+                expect(text).to.not.include("\u001b");
+            });
+        });
+    });
+});
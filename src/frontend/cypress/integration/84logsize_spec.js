@@ -0,0 +1,55 @@
+describe("Log size", function() {
+    // Limits are configured in Wakefile.yaml: 1M per task and 2M per build
+    it("should compress completed logs and report their size", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Log size test
+tasks:
+  - name: Print date
+    run: date
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id).then((update) => {
+                expect(update.tasks[0].logTruncated).to.eq(false);
+                expect(update.logSize).to.eq(update.tasks[0].logSize);
+                cy.api(`/api/build/${id}/task/0/log`).its("body.length").should("eq", update.tasks[0].logSize);
+            });
+            // The storage decompresses logs
+            cy.api(`/storage/build/${id}/task_0.log`).its("body").should("contain", "> Exit code: 0");
+            cy.api(`/storage/build/${id}/task_0.log.gz`, {encoding: "binary"}).then((resp) => {
+                expect(resp.headers["content-type"]).to.eq("application/gzip");
+                expect(resp.body.slice(0, 2)).to.eq("\x1f\x8b");
+            });
+        });
+    });
+
+    it("should truncate logs which exceed the limits", function() {
+        const jobName = "myjob" + new Date().getTime();
+        cy.createJob(jobName, `
+desc: Log limits test
+tasks:
+  - name: Exceed the task limit
+    run: for i in $(seq 1 1500); do printf '%01000d\\n' $i; done
+
+  - name: Print 800K
+    run: for i in $(seq 1 800); do printf '%01000d\\n' $i; done
+
+  - name: Exceed the build limit
+    run: for i in $(seq 1 800); do printf '%01000d\\n' $i; done
+`);
+
+        cy.runJob(jobName).then((id) => {
+            cy.waitForBuild(id).then((update) => {
+                expect(update.tasks.map((item) => item.status)).to.deep.equal(["finished", "finished", "finished"]);
+                expect(update.tasks.map((item) => item.logTruncated)).to.deep.equal([true, false, true]);
+                expect(update.tasks[0].logSize).to.be.within(1000 * 1000, 1024 * 1024 + 100);
+                expect(update.logSize).to.be.within(2000 * 1000, 2 * 1024 * 1024 + 200);
+            });
+            cy.api(`/api/build/${id}/task/0/log`, {qs: {tail: 1}})
+                .its("body").should("contain", "> The log is truncated: the task log limit of 1M is exceeded");
+            cy.api(`/api/build/${id}/task/2/log`, {qs: {tail: 1}})
+                .its("body").should("contain", "> The log is truncated: the build log limit of 2M is exceeded");
+        });
+    });
+});
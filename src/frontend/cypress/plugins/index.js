@@ -9,10 +9,21 @@
 // https://on.cypress.io/plugins-guide
 // ***********************************************************
 
+const sse = require("./sse");
+const standins = require("./standins");
+const wsclient = require("./wsclient");
+
 // This function is called when a project is opened or re-opened (e.g. due to
 // the project's config changing)
 
 module.exports = (on, config) => {
     // `on` is used to hook into various events Cypress emits
     // `config` is the resolved Cypress config
+    standins.start();
+    on("task", {
+        "standin:requests": standins.requests,
+        "standin:mails": standins.mails,
+        "sse:read": (options) => sse.read(config.baseUrl, options),
+        "ws:session": (options) => wsclient.session(config.baseUrl, options),
+    });
 };
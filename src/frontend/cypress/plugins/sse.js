@@ -0,0 +1,63 @@
+// Reads Server-Sent Events, cy.request waits for the end of the response which
+// never comes
+const http = require("http");
+
+// Reads the stream for the duration and yields the status, headers and
+// parsed events
+function read(baseUrl, {path, qs = {}, headers = {}, duration = 1000}) {
+    const url = new URL(path, baseUrl);
+    for (const [key, value] of Object.entries(qs)) {
+        url.searchParams.set(key, value);
+    }
+    const result = {status: 0, headers: {}, events: [], body: ""};
+    return new Promise((resolve, reject) => {
+        const req = http.get(url, {auth: ":admin", headers: headers}, (res) => {
+            result.status = res.statusCode;
+            result.headers = res.headers;
+            res.setEncoding("utf8");
+            res.on("data", (chunk) => {
+                result.body += chunk;
+            });
+            res.on("end", () => resolve(parse(result)));
+            // The stream is interrupted by the client
+            res.on("error", () => {});
+            setTimeout(() => {
+                req.destroy();
+                resolve(parse(result));
+            }, duration);
+        });
+        req.on("error", (err) => {
+            if (result.status === 0) {
+                reject(err);
+            }
+        });
+    });
+}
+
+function parse(result) {
+    result.events = [];
+    for (const block of result.body.split("\n\n")) {
+        const event = {};
+        for (const line of block.split("\n")) {
+            const sep = line.indexOf(": ");
+            if (sep === -1) {
+                continue;
+            }
+            const field = line.slice(0, sep);
+            const value = line.slice(sep + 2);
+            if (field === "id") {
+                event.id = parseInt(value, 10);
+            } else if (field === "event") {
+                event.event = value;
+            } else if (field === "data") {
+                event.data = JSON.parse(value);
+            }
+        }
+        if (event.data) {
+            result.events.push(event);
+        }
+    }
+    return result;
+}
+
+module.exports = {read};
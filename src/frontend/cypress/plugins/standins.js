@@ -0,0 +1,137 @@
+// Local stand-ins of the services which wakeci sends notifications, events
+// and commit statuses to. They are configured in Wakefile.yaml in the root of
+// the repository
+const http = require("http");
+const net = require("net");
+
+const HTTP_PORT = 8082;
+const SMTP_PORT = 2525;
+
+const requests = [];
+const mails = [];
+// Bodies of the requests to /flaky which have already failed once
+const failed = new Set();
+
+let started = false;
+
+// Records all requests. The first delivery of each payload to /flaky fails,
+// so retries can be tested
+function startHTTP() {
+    http.createServer((req, res) => {
+        let body = "";
+        req.on("data", (chunk) => {
+            body += chunk;
+        });
+        req.on("end", () => {
+            const item = {method: req.method, url: req.url, headers: req.headers, body: body, status: 200};
+            try {
+                item.json = JSON.parse(body);
+            } catch (e) {
+                item.json = null;
+            }
+            if (req.url.startsWith("/flaky") && !failed.has(body)) {
+                failed.add(body);
+                item.status = 503;
+            }
+            requests.push(item);
+            res.writeHead(item.status, {"Content-Type": "application/json"});
+            res.end("{}");
+        });
+    }).listen(HTTP_PORT, "127.0.0.1");
+}
+
+// Accepts all messages, only commands which net/smtp uses are supported
+function startSMTP() {
+    net.createServer((socket) => {
+        let buffer = "";
+        let mail = null;
+        let inData = false;
+        socket.write("220 localhost stand-in\r\n");
+        socket.on("data", (chunk) => {
+            buffer += chunk.toString();
+            for (;;) {
+                if (inData) {
+                    const end = buffer.indexOf("\r\n.\r\n");
+                    if (end === -1) {
+                        return;
+                    }
+                    mail.data = buffer.slice(0, end);
+                    mails.push(mail);
+                    buffer = buffer.slice(end + 5);
+                    inData = false;
+                    socket.write("250 OK\r\n");
+                    continue;
+                }
+                const end = buffer.indexOf("\r\n");
+                if (end === -1) {
+                    return;
+                }
+                const line = buffer.slice(0, end);
+                buffer = buffer.slice(end + 2);
+                switch (line.slice(0, 4).toUpperCase()) {
+                case "EHLO":
+                case "HELO":
+                    socket.write("250 localhost\r\n");
+                    break;
+                case "MAIL":
+                    mail = {from: line.slice(10), to: []};
+                    socket.write("250 OK\r\n");
+                    break;
+                case "RCPT":
+                    mail.to.push(line.slice(8));
+                    socket.write("250 OK\r\n");
+                    break;
+                case "DATA":
+                    inData = true;
+                    socket.write("354 End data with <CR><LF>.<CR><LF>\r\n");
+                    break;
+                case "QUIT":
+                    socket.end("221 Bye\r\n");
+                    return;
+                default:
+                    socket.write("250 OK\r\n");
+                }
+            }
+        });
+    }).listen(SMTP_PORT, "127.0.0.1");
+}
+
+// Resolves with the found items as soon as there are at least count of them
+// or the timeout expires
+function waitFor(find, count, timeout) {
+    const deadline = Date.now() + timeout;
+    return new Promise((resolve) => {
+        const check = () => {
+            const found = find();
+            if (found.length >= count || Date.now() >= deadline) {
+                resolve(found);
+                return;
+            }
+            setTimeout(check, 100);
+        };
+        check();
+    });
+}
+
+module.exports = {
+    start() {
+        if (started) {
+            return;
+        }
+        started = true;
+        startHTTP();
+        startSMTP();
+    },
+
+    // Yields requests to the path which contain the text in the body
+    requests({path, contains = "", count = 1, timeout = 10000}) {
+        return waitFor(() => requests.filter((item) => {
+            return item.url.startsWith(path) && item.body.includes(contains);
+        }), count, timeout);
+    },
+
+    // Yields messages which contain the text
+    mails({contains = "", count = 1, timeout = 10000}) {
+        return waitFor(() => mails.filter((item) => item.data.includes(contains)), count, timeout);
+    },
+};
@@ -0,0 +1,149 @@
+// Minimal websocket client which is able to send any Origin and credentials,
+// which is not possible from the browser
+const crypto = require("crypto");
+const http = require("http");
+
+const OPCODE_TEXT = 0x1;
+const OPCODE_CLOSE = 0x8;
+
+// Client frames are always masked
+function encodeFrame(opcode, payload) {
+    const mask = crypto.randomBytes(4);
+    let header;
+    if (payload.length < 126) {
+        header = Buffer.from([0x80 | opcode, 0x80 | payload.length]);
+    } else {
+        header = Buffer.alloc(4);
+        header[0] = 0x80 | opcode;
+        header[1] = 0x80 | 126;
+        header.writeUInt16BE(payload.length, 2);
+    }
+    const masked = Buffer.alloc(payload.length);
+    for (let i = 0; i < payload.length; i++) {
+        masked[i] = payload[i] ^ mask[i % 4];
+    }
+    return Buffer.concat([header, mask, masked]);
+}
+
+// Returns the first frame from the buffer and the rest of the buffer, or null
+// if the frame is incomplete. Server frames are not masked
+function decodeFrame(buffer) {
+    if (buffer.length < 2) {
+        return null;
+    }
+    let length = buffer[1] & 0x7f;
+    let offset = 2;
+    if (length === 126) {
+        if (buffer.length < 4) {
+            return null;
+        }
+        length = buffer.readUInt16BE(2);
+        offset = 4;
+    } else if (length === 127) {
+        if (buffer.length < 10) {
+            return null;
+        }
+        length = Number(buffer.readBigUInt64BE(2));
+        offset = 10;
+    }
+    if (buffer.length < offset + length) {
+        return null;
+    }
+    return {
+        fin: (buffer[0] & 0x80) !== 0,
+        opcode: buffer[0] & 0x0f,
+        payload: buffer.slice(offset, offset + length),
+        rest: buffer.slice(offset + length),
+    };
+}
+
+// Opens a connection to /ws, sends the messages and collects text frames for
+// the duration. Yields the status of the handshake, the frames, messages from
+// all frames (a frame may contain several messages separated by newlines) and
+// the close frame of the server. If request is set, GET request to its path
+// is made with the same credentials after its delay
+function session(baseUrl, {origin, auth = true, cookie, send = [], duration = 1000, request}) {
+    const url = new URL("/ws", baseUrl);
+    const headers = {
+        "Connection": "Upgrade",
+        "Upgrade": "websocket",
+        "Sec-WebSocket-Version": "13",
+        "Sec-WebSocket-Key": crypto.randomBytes(16).toString("base64"),
+    };
+    if (origin) {
+        headers["Origin"] = origin;
+    }
+    if (auth) {
+        headers["Authorization"] = "Basic " + Buffer.from(":admin").toString("base64");
+    }
+    if (cookie) {
+        headers["Cookie"] = cookie;
+    }
+    const result = {status: 0, frames: [], messages: [], closeCode: 0, closeReason: ""};
+    return new Promise((resolve, reject) => {
+        const req = http.request({hostname: url.hostname, port: url.port, path: url.pathname, headers: headers});
+        req.on("error", reject);
+        req.on("response", (res) => {
+            result.status = res.statusCode;
+            res.resume();
+            resolve(result);
+        });
+        req.on("upgrade", (res, socket, head) => {
+            result.status = res.statusCode;
+            let buffer = head;
+            let fragments = [];
+            const finish = () => {
+                clearTimeout(timer);
+                socket.destroy();
+                resolve(result);
+            };
+            const timer = setTimeout(() => {
+                socket.write(encodeFrame(OPCODE_CLOSE, Buffer.from([0x03, 0xe8])));
+                finish();
+            }, duration);
+            socket.on("data", (chunk) => {
+                buffer = Buffer.concat([buffer, chunk]);
+                for (let frame = decodeFrame(buffer); frame !== null; frame = decodeFrame(buffer)) {
+                    buffer = frame.rest;
+                    if (frame.opcode === OPCODE_CLOSE) {
+                        if (frame.payload.length >= 2) {
+                            result.closeCode = frame.payload.readUInt16BE(0);
+                            result.closeReason = frame.payload.slice(2).toString();
+                        }
+                        finish();
+                        return;
+                    }
+                    // Control frames, e.g. pings, are ignored
+                    if (frame.opcode !== OPCODE_TEXT && frame.opcode !== 0) {
+                        continue;
+                    }
+                    fragments.push(frame.payload);
+                    if (frame.fin) {
+                        const text = Buffer.concat(fragments).toString();
+                        fragments = [];
+                        result.frames.push(text);
+                        for (const line of text.split("\n")) {
+                            result.messages.push(JSON.parse(line));
+                        }
+                    }
+                }
+            });
+            socket.on("close", finish);
+            for (const msg of send) {
+                socket.write(encodeFrame(OPCODE_TEXT, Buffer.from(JSON.stringify(msg))));
+            }
+            if (request) {
+                setTimeout(() => {
+                    const reqHeaders = {...headers};
+                    for (const name of ["Connection", "Upgrade", "Sec-WebSocket-Version", "Sec-WebSocket-Key"]) {
+                        delete reqHeaders[name];
+                    }
+                    http.get(new URL(request.path, baseUrl), {headers: reqHeaders}, (res) => res.resume());
+                }, request.delay || 0);
+            }
+        });
+        req.end();
+    });
+}
+
+module.exports = {session};
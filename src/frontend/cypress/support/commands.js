@@ -29,3 +29,83 @@ Cypress.Commands.add("login", (password="admin")=>{
     // FF: Allow browser to login
     cy.wait(100);
 });
+
+// API helpers. They use basic auth, so they work without logging in
+const apiAuth = {
+    user: "",
+    pass: "admin",
+};
+
+Cypress.Commands.add("createJob", (name, content) => {
+    cy.request({
+        url: "/api/jobs/create",
+        method: "POST",
+        auth: apiAuth,
+        body: {
+            "name": name,
+        },
+        form: true,
+    });
+    cy.request({
+        url: "/api/job/" + name,
+        method: "POST",
+        auth: apiAuth,
+        body: {
+            "fileContent": content,
+        },
+        form: true,
+    });
+});
+
+// Yields id of the new build
+Cypress.Commands.add("runJob", (name, params={}) => {
+    cy.request({
+        url: `/api/job/${name}/run`,
+        method: "POST",
+        auth: apiAuth,
+        body: params,
+        form: true,
+    }).then((resp) => {
+        return parseInt(resp.body, 10);
+    });
+});
+
+// The API doesn't set JSON content type, so bodies are parsed here
+const parseBody = (resp) => {
+    if (typeof resp.body === "string") {
+        try {
+            resp.body = JSON.parse(resp.body);
+        } catch (e) {
+            // Not a JSON
+        }
+    }
+    return resp;
+};
+
+// Polls the build until it gets one of the statuses. Yields status update of
+// the build
+Cypress.Commands.add("waitForBuild", (id, statuses=["finished"], attempts=60) => {
+    cy.request({
+        url: `/api/build/${id}`,
+        auth: apiAuth,
+    }).then(parseBody).then((resp) => {
+        const update = resp.body.status_update;
+        if (statuses.includes(update.status)) {
+            return update;
+        }
+        if (attempts <= 1) {
+            throw new Error(`Build ${id} is ${update.status}, expected ${statuses.join(" or ")}`);
+        }
+        cy.wait(500);
+        return cy.waitForBuild(id, statuses, attempts - 1);
+    });
+});
+
+// Yields the response of the request to the API, JSON body is parsed
+Cypress.Commands.add("api", (url, options={}) => {
+    cy.request({
+        url: url,
+        auth: apiAuth,
+        ...options,
+    }).then(parseBody);
+});